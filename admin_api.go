@@ -0,0 +1,619 @@
+package consulkv
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+const adminMaxBodySize = 1 << 20
+
+// AdminAPI serves a REST API to manage the records of the configured zones.
+// Writes are validated, written with check-and-set and increase the SOA serial of the zone.
+type AdminAPI struct {
+	*HTTPServer
+	plug   *ConsulKVPlugin
+	tokens []string
+}
+
+// adminRecord is the representation of a single record returned by the API.
+type adminRecord struct {
+	Zone     string          `json:"zone"`
+	Name     string          `json:"name"`
+	Index    uint64          `json:"index"`
+	Record   *records.Record `json:"record"`
+	Warnings []records.Issue `json:"warnings,omitempty"`
+}
+
+// adminError is returned as body of every failed request.
+type adminError struct {
+	Status  int             `json:"-"`
+	Message string          `json:"error"`
+	Issues  []records.Issue `json:"issues,omitempty"`
+}
+
+func (e *adminError) Error() string {
+	return e.Message
+}
+
+// adminPatch contains the changes of a PATCH request: Entries replace all existing entries
+// of the same type and entries with a null value remove the type. Views are merged the same way,
+// a view set to null is removed; A TTL set to null is removed as well.
+type adminPatch struct {
+	TTL     json.RawMessage                  `json:"ttl"`
+	Records []records.RecordEntry            `json:"records"`
+	Views   map[string][]records.RecordEntry `json:"views"`
+}
+
+// adminAnswer is the response the plugin would send for a query.
+type adminAnswer struct {
+	Rcode      string   `json:"rcode"`
+	Answer     []string `json:"answer"`
+	Authority  []string `json:"authority"`
+	Additional []string `json:"additional"`
+}
+
+func CreateAdminAPI(plug *ConsulKVPlugin) *AdminAPI {
+	admin := &AdminAPI{
+		plug:   plug,
+		tokens: plug.Consul.AdminTokens,
+	}
+	admin.HTTPServer = CreateHTTPServer("admin API", plug.Consul.AdminAddress, admin.Handler())
+
+	return admin
+}
+
+// Handler returns the routes of the API, all of them protected by the bearer tokens.
+func (admin *AdminAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /zones", admin.handleListZones)
+	mux.HandleFunc("GET /zones/{zone}/records", admin.handleListRecords)
+	mux.HandleFunc("GET /zones/{zone}/records/{name}", admin.handleGetRecord)
+	mux.HandleFunc("PUT /zones/{zone}/records/{name}", admin.handlePutRecord)
+	mux.HandleFunc("PATCH /zones/{zone}/records/{name}", admin.handlePatchRecord)
+	mux.HandleFunc("DELETE /zones/{zone}/records/{name}", admin.handleDeleteRecord)
+	mux.HandleFunc("GET /zones/{zone}/answer/{name}", admin.handleGetAnswer)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		status := &adminStatusWriter{ResponseWriter: writer, status: http.StatusOK}
+		defer func() {
+			IncrementMetricsAdminRequestsTotal(r.Method, status.status)
+		}()
+
+		if !admin.isAuthorized(r) {
+			status.Header().Set("WWW-Authenticate", `Bearer realm="consulkv"`)
+			writeAdminError(status, &adminError{Status: http.StatusUnauthorized, Message: "missing or invalid bearer token"})
+			return
+		}
+
+		mux.ServeHTTP(status, r)
+	})
+}
+
+func (admin *AdminAPI) isAuthorized(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return false
+	}
+
+	authorized := false
+	for _, t := range admin.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			authorized = true
+		}
+	}
+
+	return authorized
+}
+
+func (admin *AdminAPI) handleListZones(writer http.ResponseWriter, r *http.Request) {
+	admin.plug.cfgMu.RLock()
+	zones := []string{}
+	if admin.plug.Config != nil {
+		zones = append(zones, admin.plug.Config.Zones...)
+	}
+	admin.plug.cfgMu.RUnlock()
+
+	sort.Strings(zones)
+	writeAdminJSON(writer, http.StatusOK, map[string][]string{"zones": zones})
+}
+
+func (admin *AdminAPI) handleListRecords(writer http.ResponseWriter, r *http.Request) {
+	zone, err := admin.getZone(r)
+	if err != nil {
+		writeAdminError(writer, err)
+		return
+	}
+
+	useCache := false
+	names, err := admin.plug.Consul.ListZoneRecordNamesFromConsul(zone, &ConsulKVCache{UseCache: &useCache})
+	if err != nil {
+		logging.Log.Errorf("Error listing records of zone '%s': %v", zone, err)
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+		writeAdminError(writer, &adminError{Status: http.StatusBadGateway, Message: "unable to list records"})
+		return
+	}
+
+	sort.Strings(names)
+	writeAdminJSON(writer, http.StatusOK, map[string]interface{}{"zone": zone, "records": names})
+}
+
+func (admin *AdminAPI) handleGetRecord(writer http.ResponseWriter, r *http.Request) {
+	zone, name, err := admin.getZoneAndName(r)
+	if err != nil {
+		writeAdminError(writer, err)
+		return
+	}
+
+	record, index, err := admin.plug.Consul.GetZoneRecordForUpdateFromConsul(zone, name)
+	if err != nil {
+		logging.Log.Errorf("Error receiving record '%s' of zone '%s': %v", name, zone, err)
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+		writeAdminError(writer, &adminError{Status: http.StatusBadGateway, Message: "unable to read record"})
+		return
+	}
+
+	if record == nil {
+		writeAdminError(writer, &adminError{Status: http.StatusNotFound, Message: fmt.Sprintf("record '%s' not found", name)})
+		return
+	}
+
+	writer.Header().Set("ETag", formatETag(index))
+	writeAdminJSON(writer, http.StatusOK, &adminRecord{Zone: zone, Name: name, Index: index, Record: record})
+}
+
+func (admin *AdminAPI) handlePutRecord(writer http.ResponseWriter, r *http.Request) {
+	var record records.Record
+	if err := readAdminBody(r, &record); err != nil {
+		writeAdminError(writer, err)
+		return
+	}
+
+	admin.writeRecord(writer, r, func(current *records.Record) (*records.Record, error) {
+		return record.Clone(), nil
+	})
+}
+
+func (admin *AdminAPI) handlePatchRecord(writer http.ResponseWriter, r *http.Request) {
+	var patch adminPatch
+	if err := readAdminBody(r, &patch); err != nil {
+		writeAdminError(writer, err)
+		return
+	}
+
+	admin.writeRecord(writer, r, func(current *records.Record) (*records.Record, error) {
+		if current == nil {
+			return nil, &adminError{Status: http.StatusNotFound, Message: fmt.Sprintf("record '%s' not found", r.PathValue("name"))}
+		}
+
+		return patch.apply(current)
+	})
+}
+
+func (admin *AdminAPI) handleDeleteRecord(writer http.ResponseWriter, r *http.Request) {
+	admin.writeRecord(writer, r, func(current *records.Record) (*records.Record, error) {
+		if current == nil {
+			return nil, &adminError{Status: http.StatusNotFound, Message: fmt.Sprintf("record '%s' not found", r.PathValue("name"))}
+		}
+
+		return nil, nil
+	})
+}
+
+// writeRecord applies change to the current value of the record and writes the result
+// together with an increased SOA serial within a single transaction; A nil result deletes the record.
+// Without 'If-Match' header, concurrent changes are retried like dynamic updates.
+func (admin *AdminAPI) writeRecord(writer http.ResponseWriter, r *http.Request, change func(current *records.Record) (*records.Record, error)) {
+	zone, name, err := admin.getZoneAndName(r)
+	if err != nil {
+		writeAdminError(writer, err)
+		return
+	}
+
+	match, err := parseETag(r.Header.Get("If-Match"))
+	if err != nil {
+		writeAdminError(writer, err)
+		return
+	}
+
+	for attempt := 1; attempt <= dynamicUpdateAttempts; attempt++ {
+		current, index, err := admin.plug.Consul.GetZoneRecordForUpdateFromConsul(zone, name)
+		if err != nil {
+			logging.Log.Errorf("Error receiving record '%s' of zone '%s': %v", name, zone, err)
+			IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+			writeAdminError(writer, &adminError{Status: http.StatusBadGateway, Message: "unable to read record"})
+			return
+		}
+
+		if (match != nil && *match != index) || (r.Header.Get("If-None-Match") == "*" && current != nil) {
+			writeAdminError(writer, &adminError{Status: http.StatusPreconditionFailed, Message: fmt.Sprintf("record '%s' has been modified (index %d)", name, index)})
+			return
+		}
+
+		updated, err := change(current)
+		if err != nil {
+			writeAdminError(writer, err)
+			return
+		}
+
+		warnings, err := validateAdminRecord(name, current, updated)
+		if err != nil {
+			writeAdminError(writer, err)
+			return
+		}
+
+		u := &updateRecord{record: updated, index: index, changed: true}
+		writes := []ZoneRecordWrite{{Name: name, Record: updated, ModifyIndex: index}}
+
+		if err := admin.plug.bumpUpdateSerial(zone, map[string]*updateRecord{name: u}, &writes); err != nil {
+			logging.Log.Errorf("Error increasing SOA serial of zone '%s': %v", zone, err)
+			IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+			writeAdminError(writer, &adminError{Status: http.StatusBadGateway, Message: "unable to increase SOA serial"})
+			return
+		}
+
+		ok, err := admin.plug.Consul.WriteZoneRecordsToConsul(zone, writes)
+		if err != nil {
+			logging.Log.Errorf("Error writing record '%s' of zone '%s': %v", name, zone, err)
+			IncrementMetricsPluginErrorsTotal("CONSUL_PUT")
+
+			writeAdminError(writer, &adminError{Status: http.StatusBadGateway, Message: "unable to write record"})
+			return
+		}
+
+		if !ok {
+			logging.Log.Debugf("Retrying admin API write of '%s' in zone '%s' after conflict (attempt %d)", name, zone, attempt)
+			continue
+		}
+
+		if updated == nil {
+			logging.Log.Infof("Deleted record '%s' of zone '%s' with admin API", name, zone)
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		logging.Log.Infof("Wrote record '%s' of zone '%s' with admin API", name, zone)
+
+		stored, index, err := admin.plug.Consul.GetZoneRecordForUpdateFromConsul(zone, name)
+		if err != nil || stored == nil {
+			stored, index = updated, 0
+		}
+
+		status := http.StatusOK
+		if current == nil {
+			status = http.StatusCreated
+		}
+
+		if index != 0 {
+			writer.Header().Set("ETag", formatETag(index))
+		}
+
+		writeAdminJSON(writer, status, &adminRecord{Zone: zone, Name: name, Index: index, Record: stored, Warnings: warnings})
+		return
+	}
+
+	logging.Log.Warningf("Giving up admin API write of '%s' in zone '%s' after %d conflicts", name, zone, dynamicUpdateAttempts)
+	writeAdminError(writer, &adminError{Status: http.StatusConflict, Message: "record was modified concurrently"})
+}
+
+func (admin *AdminAPI) handleGetAnswer(writer http.ResponseWriter, r *http.Request) {
+	zone, name, err := admin.getZoneAndName(r)
+	if err != nil {
+		writeAdminError(writer, err)
+		return
+	}
+
+	qtype := dns.TypeA
+	if t := r.URL.Query().Get("type"); t != "" {
+		var exists bool
+		if qtype, exists = dns.StringToType[strings.ToUpper(t)]; !exists {
+			writeAdminError(writer, &adminError{Status: http.StatusBadRequest, Message: fmt.Sprintf("unknown type '%s'", t)})
+			return
+		}
+	}
+
+	client := net.IPv4(127, 0, 0, 1)
+	if c := r.URL.Query().Get("client"); c != "" {
+		if client = net.ParseIP(c); client == nil {
+			writeAdminError(writer, &adminError{Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid client address '%s'", c)})
+			return
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(GetRecordOwnerName(zone, name), qtype)
+
+	response := &adminResponseWriter{remote: &net.UDPAddr{IP: client, Port: 53}}
+	if _, err := admin.plug.ServeDNS(r.Context(), response, req); err != nil && response.msg == nil {
+		logging.Log.Errorf("Error resolving '%s' for admin API: %v", req.Question[0].Name, err)
+		writeAdminError(writer, &adminError{Status: http.StatusBadGateway, Message: "unable to resolve query"})
+		return
+	}
+
+	if response.msg == nil {
+		writeAdminError(writer, &adminError{Status: http.StatusInternalServerError, Message: "query wasn't answered"})
+		return
+	}
+
+	writeAdminJSON(writer, http.StatusOK, &adminAnswer{
+		Rcode:      dns.RcodeToString[response.msg.Rcode],
+		Answer:     formatAdminRRs(response.msg.Answer),
+		Authority:  formatAdminRRs(response.msg.Ns),
+		Additional: formatAdminRRs(response.msg.Extra),
+	})
+}
+
+// getZone returns the configured zone of the request; Zones are matched case-insensitive
+// and with or without trailing dot.
+func (admin *AdminAPI) getZone(r *http.Request) (string, error) {
+	zone := strings.TrimSuffix(r.PathValue("zone"), ".")
+
+	admin.plug.cfgMu.RLock()
+	defer admin.plug.cfgMu.RUnlock()
+
+	if admin.plug.Config != nil {
+		for _, z := range admin.plug.Config.Zones {
+			if strings.EqualFold(strings.TrimSuffix(z, "."), zone) {
+				return z, nil
+			}
+		}
+	}
+
+	return "", &adminError{Status: http.StatusNotFound, Message: fmt.Sprintf("zone '%s' not found", zone)}
+}
+
+// getZoneAndName returns the zone and the lower case name of the record relative to the zone.
+func (admin *AdminAPI) getZoneAndName(r *http.Request) (string, string, error) {
+	zone, err := admin.getZone(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	name := strings.ToLower(r.PathValue("name"))
+	if name != "@" {
+		if _, ok := dns.IsDomainName(name); !ok || strings.HasSuffix(name, ".") || strings.Contains(name, "/") {
+			return "", "", &adminError{Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid record name '%s', names are relative to the zone", name)}
+		}
+	}
+
+	return zone, name, nil
+}
+
+// validateAdminRecord validates the new value of a record and returns its warnings.
+// The SOA and NS records at the zone apex can't be removed, same as with dynamic updates.
+func validateAdminRecord(name string, current, updated *records.Record) ([]records.Issue, error) {
+	if name == "@" {
+		before := &updateRecord{record: current}
+		after := &updateRecord{record: updated}
+
+		for _, rtype := range []string{"SOA", "NS"} {
+			if before.hasType(rtype) && !after.hasType(rtype) {
+				return nil, &adminError{Status: http.StatusUnprocessableEntity, Message: fmt.Sprintf("%s record at zone apex can't be removed", rtype)}
+			}
+		}
+
+		if after.hasType("CNAME") {
+			return nil, &adminError{Status: http.StatusUnprocessableEntity, Message: "CNAME isn't allowed at zone apex"}
+		}
+	}
+
+	if updated == nil {
+		return nil, nil
+	}
+
+	value, err := json.Marshal(updated)
+	if err != nil {
+		return nil, &adminError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	_, issues := records.ValidateRecord(name, value, records.ValidateOptions{})
+
+	errs, warnings := []records.Issue{}, []records.Issue{}
+	for _, issue := range issues {
+		if issue.Severity == records.SeverityError {
+			errs = append(errs, issue)
+		} else {
+			warnings = append(warnings, issue)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, &adminError{Status: http.StatusUnprocessableEntity, Message: "record is invalid", Issues: errs}
+	}
+
+	return warnings, nil
+}
+
+// apply returns a copy of the record with the patch applied.
+func (patch *adminPatch) apply(current *records.Record) (*records.Record, error) {
+	record := current.Clone()
+
+	if patch.TTL != nil {
+		if string(patch.TTL) == "null" {
+			record.TTL = nil
+		} else {
+			var ttl int
+			if err := json.Unmarshal(patch.TTL, &ttl); err != nil {
+				return nil, &adminError{Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid ttl: %v", err)}
+			}
+			record.TTL = &ttl
+		}
+	}
+
+	record.Records = mergeRecordEntries(record.Records, patch.Records)
+
+	for view, entries := range patch.Views {
+		if entries == nil {
+			delete(record.Views, view)
+			continue
+		}
+
+		if record.Views == nil {
+			record.Views = make(map[string][]records.RecordEntry)
+		}
+		record.Views[view] = mergeRecordEntries(record.Views[view], entries)
+	}
+
+	if len(record.Views) == 0 {
+		record.Views = nil
+	}
+
+	return record, nil
+}
+
+// mergeRecordEntries replaces all entries of the types within patch, keeping the position
+// of the first replaced entry. Entries with a null value only remove their type.
+func mergeRecordEntries(entries, patch []records.RecordEntry) []records.RecordEntry {
+	replaced := make(map[string][]records.RecordEntry)
+	for _, rec := range patch {
+		rtype := strings.ToUpper(rec.Type)
+		if _, exists := replaced[rtype]; !exists {
+			replaced[rtype] = []records.RecordEntry{}
+		}
+
+		if len(rec.Value) > 0 && string(rec.Value) != "null" {
+			replaced[rtype] = append(replaced[rtype], records.RecordEntry{Type: rtype, Value: rec.Value})
+		}
+	}
+
+	merged := make([]records.RecordEntry, 0, len(entries)+len(patch))
+	written := make(map[string]bool)
+
+	for _, rec := range entries {
+		patched, exists := replaced[rec.Type]
+		if !exists {
+			merged = append(merged, rec)
+			continue
+		}
+
+		if !written[rec.Type] {
+			merged = append(merged, patched...)
+			written[rec.Type] = true
+		}
+	}
+
+	for _, rec := range patch {
+		rtype := strings.ToUpper(rec.Type)
+		if !written[rtype] {
+			merged = append(merged, replaced[rtype]...)
+			written[rtype] = true
+		}
+	}
+
+	return merged
+}
+
+func readAdminBody(r *http.Request, value interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, adminMaxBodySize+1))
+	if err != nil {
+		return &adminError{Status: http.StatusBadRequest, Message: fmt.Sprintf("unable to read body: %v", err)}
+	}
+
+	if len(data) > adminMaxBodySize {
+		return &adminError{Status: http.StatusRequestEntityTooLarge, Message: "body is too large"}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(value); err != nil {
+		return &adminError{Status: http.StatusBadRequest, Message: fmt.Sprintf("error converting json: %v", err)}
+	}
+
+	return nil
+}
+
+func writeAdminJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		logging.Log.Errorf("Error writing admin API response: %v", err)
+	}
+}
+
+func writeAdminError(writer http.ResponseWriter, err error) {
+	var e *adminError
+	if !errors.As(err, &e) {
+		e = &adminError{Status: http.StatusInternalServerError, Message: err.Error()}
+	}
+
+	writeAdminJSON(writer, e.Status, e)
+}
+
+// parseETag returns the ModifyIndex of an 'If-Match' header, or nil if it isn't set.
+func parseETag(value string) (*uint64, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	index, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(value, "W/"), `"`), 10, 64)
+	if err != nil {
+		return nil, &adminError{Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid 'If-Match' header '%s'", value)}
+	}
+
+	return &index, nil
+}
+
+func formatETag(index uint64) string {
+	return `"` + strconv.FormatUint(index, 10) + `"`
+}
+
+func formatAdminRRs(rrs []dns.RR) []string {
+	result := []string{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		result = append(result, rr.String())
+	}
+
+	return result
+}
+
+// adminStatusWriter remembers the status code of a response for the metrics.
+type adminStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *adminStatusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// adminResponseWriter captures the response of a query resolved for the admin API.
+type adminResponseWriter struct {
+	ResponseWriterWrapper
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *adminResponseWriter) WriteMsg(res *dns.Msg) error {
+	w.msg = res
+	return nil
+}
+
+func (w *adminResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *adminResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
@@ -0,0 +1,217 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+func TestAdminAPI(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		backend memory
+		admin_api 127.0.0.1:0
+		admin_token secret
+	}`)
+
+	plug, err := CreatePlugin(c)
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/@", []byte(`{"records":[`+
+		`{"type":"SOA","value":{"mname":"ns1.example.com","rname":"admin.example.com","serial":1,"refresh":3600,"retry":600,"expire":86400,"minimum":300}},`+
+		`{"type":"NS","value":["ns1.example.com"]}]}`))
+	backend.Put("dns/zones/example.com/www", []byte(`{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]}]}`))
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+
+	if err := plug.Admin.Start(); err != nil {
+		tst.Fatalf("Unable to start admin API: %v", err)
+	}
+	if err := plug.Admin.Stop(); err != nil {
+		tst.Errorf("Unable to stop admin API: %v", err)
+	}
+
+	handler := plug.Admin.Handler()
+	request := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	serial := func() uint32 {
+		record, _, _ := plug.Consul.GetZoneRecordForUpdateFromConsul("example.com", "@")
+		soa, _ := GetSOAFromRecord("example.com", record)
+		return soa.SERIAL
+	}
+
+	tst.Run("Missing token", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/zones", nil)
+		r.Header.Set("Authorization", "Bearer wrong")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Code)
+		}
+	})
+
+	tst.Run("List zones", func(t *testing.T) {
+		w := request(http.MethodGet, "/zones", "", nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"example.com"`) {
+			t.Errorf("Expected zone list, got %d: %s", w.Code, w.Body)
+		}
+
+		if w := request(http.MethodGet, "/zones/example.org/records", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for unknown zone, got %d", w.Code)
+		}
+	})
+
+	tst.Run("Create record", func(t *testing.T) {
+		w := request(http.MethodPut, "/zones/example.com./records/Mail", `{"ttl":300,"records":[{"type":"A","value":["192.168.0.2"]}]}`, nil)
+		if w.Code != http.StatusCreated || w.Header().Get("ETag") == "" {
+			t.Fatalf("Expected 201 with ETag, got %d: %s", w.Code, w.Body)
+		}
+
+		if record, _, _ := plug.Consul.GetZoneRecordForUpdateFromConsul("example.com", "mail"); record == nil {
+			t.Errorf("Expected record 'mail' to be written")
+		}
+
+		if s := serial(); s != 2 {
+			t.Errorf("Expected SOA serial 2, got %d", s)
+		}
+	})
+
+	tst.Run("Reject invalid record", func(t *testing.T) {
+		w := request(http.MethodPut, "/zones/example.com/records/www", `{"records":[{"type":"A","value":["192.168.0.256"]}]}`, nil)
+		if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "invalid address") {
+			t.Errorf("Expected 422 with issue, got %d: %s", w.Code, w.Body)
+		}
+
+		w = request(http.MethodPut, "/zones/example.com/records/www", `{"record":[]}`, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for unknown field, got %d", w.Code)
+		}
+
+		w = request(http.MethodDelete, "/zones/example.com/records/@", "", nil)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for deleting the zone apex, got %d", w.Code)
+		}
+	})
+
+	tst.Run("Check-and-set", func(t *testing.T) {
+		w := request(http.MethodGet, "/zones/example.com/records/www", "", nil)
+		etag := w.Header().Get("ETag")
+
+		// Any write increases the index of the record
+		request(http.MethodPatch, "/zones/example.com/records/www", `{"ttl":600}`, nil)
+
+		w = request(http.MethodPut, "/zones/example.com/records/www", `{"records":[{"type":"A","value":["192.168.0.3"]}]}`, map[string]string{"If-Match": etag})
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected 412 for outdated ETag, got %d: %s", w.Code, w.Body)
+		}
+
+		w = request(http.MethodPut, "/zones/example.com/records/www", `{"records":[]}`, map[string]string{"If-None-Match": "*"})
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected 412 for existing record, got %d", w.Code)
+		}
+	})
+
+	tst.Run("Patch record", func(t *testing.T) {
+		w := request(http.MethodPatch, "/zones/example.com/records/www", `{"records":[{"type":"TXT","value":["hello"]}]}`, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var result adminRecord
+		json.Unmarshal(w.Body.Bytes(), &result)
+
+		if len(result.Record.Records) != 2 || *result.Record.TTL != 600 {
+			t.Errorf("Expected A and TXT with ttl 600, got %+v", result.Record)
+		}
+
+		w = request(http.MethodPatch, "/zones/example.com/records/www", `{"records":[{"type":"A","value":null}]}`, nil)
+		json.Unmarshal(w.Body.Bytes(), &result)
+
+		if len(result.Record.Records) != 1 || result.Record.Records[0].Type != "TXT" {
+			t.Errorf("Expected only TXT to be left, got %+v", result.Record)
+		}
+
+		if w := request(http.MethodPatch, "/zones/example.com/records/missing", `{}`, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for missing record, got %d", w.Code)
+		}
+	})
+
+	tst.Run("Effective answer", func(t *testing.T) {
+		w := request(http.MethodGet, "/zones/example.com/answer/mail?type=a", "", nil)
+
+		var answer adminAnswer
+		json.Unmarshal(w.Body.Bytes(), &answer)
+
+		if answer.Rcode != "NOERROR" || len(answer.Answer) != 1 || !strings.Contains(answer.Answer[0], "192.168.0.2") {
+			t.Errorf("Expected answer for 'mail', got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	tst.Run("Delete record", func(t *testing.T) {
+		before := serial()
+
+		if w := request(http.MethodDelete, "/zones/example.com/records/mail", "", nil); w.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body)
+		}
+
+		if w := request(http.MethodGet, "/zones/example.com/records/mail", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 after delete, got %d", w.Code)
+		}
+
+		if s := serial(); s != before+1 {
+			t.Errorf("Expected SOA serial %d, got %d", before+1, s)
+		}
+	})
+}
+
+func TestMergeRecordEntries(tst *testing.T) {
+	entries := []records.RecordEntry{
+		{Type: "A", Value: json.RawMessage(`["192.168.0.1"]`)},
+		{Type: "TXT", Value: json.RawMessage(`["a"]`)},
+		{Type: "MX", Value: json.RawMessage(`[]`)},
+	}
+
+	merged := mergeRecordEntries(entries, []records.RecordEntry{
+		{Type: "txt", Value: json.RawMessage(`["b"]`)},
+		{Type: "MX", Value: json.RawMessage(`null`)},
+		{Type: "AAAA", Value: json.RawMessage(`["::1"]`)},
+	})
+
+	types := []string{}
+	for _, rec := range merged {
+		types = append(types, rec.Type+string(rec.Value))
+	}
+
+	if strings.Join(types, " ") != `A["192.168.0.1"] TXT["b"] AAAA["::1"]` {
+		tst.Errorf("Unexpected merge result: %v", types)
+	}
+}
+
+func TestAdminAPIConfig(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		admin_api 127.0.0.1:8181
+	}`)
+
+	if err := LoadConsulConfig(c, &ConsulConfig{}); err == nil {
+		tst.Errorf("Expected error for 'admin_api' without 'admin_token'")
+	}
+}
@@ -0,0 +1,107 @@
+package consulkv
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	backendConsul = "consul"
+	backendMemory = "memory"
+	backendFile   = "file"
+
+	backendDefaultWaitTime = 5 * time.Minute
+)
+
+var errBackendNotConsul = errors.New("only available with the consul backend")
+
+// Backend is the storage the KV layout ('<kv_prefix>/config', '<kv_prefix>/zones/<zone>/<name>', ...)
+// is read from and written to. Keys are always passed with the prefix.
+//
+// Keys can be watched with blocking queries the same way as with Consul:
+// If options.WaitIndex is set, the call blocks until the index of the result is
+// greater than WaitIndex, options.WaitTime has passed or the context of the options is done.
+type Backend interface {
+	// Get returns the pair stored under key, or nil if it doesn't exist.
+	Get(key string, options *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+	// List returns all pairs stored below prefix.
+	List(prefix string, options *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
+	// Keys returns all keys below prefix, up to the first separator after the prefix.
+	Keys(prefix, separator string, options *api.QueryOptions) ([]string, *api.QueryMeta, error)
+	// Txn applies all operations atomically. Returns false without an error
+	// if any check-and-set operation or check failed.
+	Txn(ops api.KVTxnOps) (bool, error)
+	// Ping returns an error if the backend is unreachable.
+	Ping() error
+	// Close stops everything the backend runs in the background.
+	Close() error
+}
+
+// CreateBackend creates the backend selected with the 'backend' option.
+func CreateBackend(consul *ConsulConfig) error {
+	switch consul.BackendType {
+	case "", backendConsul:
+		if err := CreateConsulClient(consul); err != nil {
+			return err
+		}
+		consul.Backend = consul
+
+	case backendMemory:
+		backend := CreateMemoryBackend()
+		if consul.BackendPath != "" {
+			if err := backend.Load(consul.BackendPath); err != nil {
+				return err
+			}
+		}
+		consul.Backend = backend
+
+	case backendFile:
+		backend, err := CreateFileBackend(consul.BackendPath, consul.BackendInterval)
+		if err != nil {
+			return err
+		}
+		consul.Backend = backend
+
+	default:
+		return fmt.Errorf("unknown backend '%s'", consul.BackendType)
+	}
+
+	return nil
+}
+
+func (consul *ConsulConfig) Get(key string, options *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	return consul.Client.KV().Get(key, options)
+}
+
+func (consul *ConsulConfig) List(prefix string, options *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	return consul.Client.KV().List(prefix, options)
+}
+
+func (consul *ConsulConfig) Keys(prefix, separator string, options *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	return consul.Client.KV().Keys(prefix, separator, options)
+}
+
+func (consul *ConsulConfig) Txn(ops api.KVTxnOps) (bool, error) {
+	ok, _, _, err := consul.Client.KV().Txn(ops, nil)
+	return ok, err
+}
+
+func (consul *ConsulConfig) Ping() error {
+	leader, err := consul.Client.Status().Leader()
+	if err != nil {
+		return err
+	}
+
+	if leader == "" {
+		return errors.New("consul has no leader")
+	}
+
+	return nil
+}
+
+func (consul *ConsulConfig) Close() error {
+	return nil
+}
@@ -0,0 +1,309 @@
+package consulkv
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+)
+
+const (
+	fileBackendExtension       = ".json"
+	fileBackendDefaultInterval = 5 * time.Second
+)
+
+// FileBackend stores every key as a JSON file within a directory,
+// e.g. 'dns/zones/example.com/www' as '<root>/dns/zones/example.com/www.json'.
+// The files are loaded into a MemoryBackend and the directory is rescanned periodically,
+// so files edited by hand are picked up by watches the same way as changes in Consul.
+type FileBackend struct {
+	memory *MemoryBackend
+	root   string
+	mu     sync.Mutex
+	files  map[string]fileState
+	stop   chan struct{}
+	once   sync.Once
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func CreateFileBackend(root string, interval time.Duration) (*FileBackend, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("backend path '%s' is not a directory", root)
+	}
+
+	if interval <= 0 {
+		interval = fileBackendDefaultInterval
+	}
+
+	backend := &FileBackend{
+		memory: CreateMemoryBackend(),
+		root:   root,
+		files:  make(map[string]fileState),
+		stop:   make(chan struct{}),
+	}
+
+	if err := backend.Sync(); err != nil {
+		return nil, err
+	}
+
+	go backend.run(interval)
+	logging.Log.Infof("Loaded %d keys from '%s'", len(backend.files), root)
+
+	return backend, nil
+}
+
+// Sync loads all files that have been added, changed or removed since the last call.
+func (backend *FileBackend) Sync() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	return backend.sync()
+}
+
+// sync is always called with the lock held.
+func (backend *FileBackend) sync() error {
+	found := make(map[string]fileState)
+	ops := api.KVTxnOps{}
+
+	err := filepath.WalkDir(backend.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || !strings.HasSuffix(path, fileBackendExtension) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		key, err := backend.getKey(path)
+		if err != nil {
+			return err
+		}
+
+		state := fileState{modTime: info.ModTime(), size: info.Size()}
+		found[key] = state
+
+		if backend.files[key] == state {
+			return nil
+		}
+
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: value})
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for key := range backend.files {
+		if _, exists := found[key]; !exists {
+			ops = append(ops, &api.KVTxnOp{Verb: api.KVDelete, Key: key})
+		}
+	}
+
+	backend.files = found
+	if len(ops) == 0 {
+		return nil
+	}
+
+	_, err = backend.memory.Txn(ops)
+	return err
+}
+
+func (backend *FileBackend) Get(key string, options *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	return backend.memory.Get(key, options)
+}
+
+func (backend *FileBackend) List(prefix string, options *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	return backend.memory.List(prefix, options)
+}
+
+func (backend *FileBackend) Keys(prefix, separator string, options *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	return backend.memory.Keys(prefix, separator, options)
+}
+
+// Txn writes the changed files and applies the operations to the loaded keys.
+// All values are written to temporary files before any file is replaced, and the loaded keys
+// are only changed once every file is in place. If replacing the files fails halfway,
+// the loaded keys are synced with the files again, so they never differ from the directory.
+func (backend *FileBackend) Txn(ops api.KVTxnOps) (bool, error) {
+	for _, op := range ops {
+		if !isValidFileKey(op.Key) {
+			return false, fmt.Errorf("key '%s' can't be stored as file", op.Key)
+		}
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	ok, err := backend.memory.checkTxn(ops)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	temps := make(map[string]string)
+	defer func() {
+		for _, tmp := range temps {
+			os.Remove(tmp)
+		}
+	}()
+
+	for _, op := range ops {
+		if op.Verb == api.KVSet || op.Verb == api.KVCAS {
+			tmp, err := writeTempFile(backend.getPath(op.Key), op.Value)
+			if err != nil {
+				return false, err
+			}
+			temps[op.Key] = tmp
+		}
+	}
+
+	for _, op := range ops {
+		path := backend.getPath(op.Key)
+
+		switch op.Verb {
+		case api.KVSet, api.KVCAS:
+			err = os.Rename(temps[op.Key], path)
+			if err == nil {
+				delete(temps, op.Key)
+			}
+
+		case api.KVDelete, api.KVDeleteCAS:
+			if err = os.Remove(path); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			if err := backend.sync(); err != nil {
+				logging.Log.Errorf("Error loading files from '%s': %v", backend.root, err)
+				IncrementMetricsPluginErrorsTotal("BACKEND_SYNC")
+			}
+
+			return false, err
+		}
+	}
+
+	if _, err := backend.memory.Txn(ops); err != nil {
+		return false, err
+	}
+
+	for _, op := range ops {
+		switch op.Verb {
+		case api.KVSet, api.KVCAS:
+			if info, err := os.Stat(backend.getPath(op.Key)); err == nil {
+				backend.files[op.Key] = fileState{modTime: info.ModTime(), size: info.Size()}
+			}
+
+		case api.KVDelete, api.KVDeleteCAS:
+			delete(backend.files, op.Key)
+		}
+	}
+
+	return true, nil
+}
+
+func (backend *FileBackend) Ping() error {
+	_, err := os.Stat(backend.root)
+	return err
+}
+
+func (backend *FileBackend) Close() error {
+	backend.once.Do(func() {
+		close(backend.stop)
+	})
+
+	return nil
+}
+
+func (backend *FileBackend) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-backend.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := backend.Sync(); err != nil {
+			logging.Log.Errorf("Error loading files from '%s': %v", backend.root, err)
+			IncrementMetricsPluginErrorsTotal("BACKEND_SYNC")
+		}
+	}
+}
+
+func (backend *FileBackend) getKey(path string) (string, error) {
+	rel, err := filepath.Rel(backend.root, path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(strings.TrimSuffix(rel, fileBackendExtension)), nil
+}
+
+func (backend *FileBackend) getPath(key string) string {
+	return filepath.Join(backend.root, filepath.FromSlash(key)+fileBackendExtension)
+}
+
+// isValidFileKey returns false for keys that would be written outside of the directory.
+func isValidFileKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.ContainsRune(segment, '\\') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeTempFile writes the value to a temporary file next to path and returns its name.
+// Temporary files don't use the extension of the backend, so they are never loaded.
+func writeTempFile(path string, value []byte) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
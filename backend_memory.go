@@ -0,0 +1,269 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// MemoryBackend keeps the KV layout in memory, e.g. for tests or to run the plugin without Consul.
+// Every write increments a single index; the index of a query is the highest index
+// of all matching keys, including deleted ones, just like the index of Consul.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	index   uint64
+	pairs   map[string]*api.KVPair
+	deleted map[string]uint64
+	changed chan struct{}
+}
+
+func CreateMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		pairs:   make(map[string]*api.KVPair),
+		deleted: make(map[string]uint64),
+		changed: make(chan struct{}),
+	}
+}
+
+// Put stores the value under key without any checks.
+func (backend *MemoryBackend) Put(key string, value []byte) {
+	backend.Txn(api.KVTxnOps{{Verb: api.KVSet, Key: key, Value: value}})
+}
+
+// Load stores all keys of a JSON file, e.g. '{"dns/config": {"zones": ["example.com"]}}'.
+// Objects and arrays are stored as JSON, strings are stored as they are.
+func (backend *MemoryBackend) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("unable to load keys from '%s': %w", path, err)
+	}
+
+	ops := api.KVTxnOps{}
+	for key, raw := range values {
+		value := []byte(raw)
+
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			value = []byte(s)
+		}
+
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: value})
+	}
+
+	_, err = backend.Txn(ops)
+	return err
+}
+
+func (backend *MemoryBackend) Get(key string, options *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	var pair *api.KVPair
+
+	meta, err := backend.query(options, func() uint64 {
+		pair = nil
+		if kv, exists := backend.pairs[key]; exists {
+			pair = copyKVPair(kv)
+			return kv.ModifyIndex
+		}
+
+		return backend.deleted[key]
+	})
+
+	return pair, meta, err
+}
+
+func (backend *MemoryBackend) List(prefix string, options *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	var pairs api.KVPairs
+
+	meta, err := backend.query(options, func() uint64 {
+		pairs = api.KVPairs{}
+		index := backend.getDeletedIndex(prefix)
+
+		for key, kv := range backend.pairs {
+			if strings.HasPrefix(key, prefix) {
+				pairs = append(pairs, copyKVPair(kv))
+				index = max(index, kv.ModifyIndex)
+			}
+		}
+
+		sort.Slice(pairs, func(i, j int) bool {
+			return pairs[i].Key < pairs[j].Key
+		})
+
+		return index
+	})
+
+	return pairs, meta, err
+}
+
+func (backend *MemoryBackend) Keys(prefix, separator string, options *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	var keys []string
+
+	meta, err := backend.query(options, func() uint64 {
+		unique := make(map[string]bool)
+		index := backend.getDeletedIndex(prefix)
+
+		for key, kv := range backend.pairs {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			index = max(index, kv.ModifyIndex)
+			if separator != "" {
+				if i := strings.Index(key[len(prefix):], separator); i >= 0 {
+					key = key[:len(prefix)+i+len(separator)]
+				}
+			}
+			unique[key] = true
+		}
+
+		keys = make([]string, 0, len(unique))
+		for key := range unique {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		return index
+	})
+
+	return keys, meta, err
+}
+
+func (backend *MemoryBackend) Txn(ops api.KVTxnOps) (bool, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if ok, err := backend.check(ops); err != nil || !ok {
+		return ok, err
+	}
+
+	backend.index++
+	for _, op := range ops {
+		switch op.Verb {
+		case api.KVSet, api.KVCAS:
+			kv := &api.KVPair{Key: op.Key, Value: append([]byte{}, op.Value...), Flags: op.Flags, ModifyIndex: backend.index}
+			if existing, exists := backend.pairs[op.Key]; exists {
+				kv.CreateIndex = existing.CreateIndex
+			} else {
+				kv.CreateIndex = backend.index
+			}
+
+			backend.pairs[op.Key] = kv
+			delete(backend.deleted, op.Key)
+
+		case api.KVDelete, api.KVDeleteCAS:
+			if _, exists := backend.pairs[op.Key]; exists {
+				delete(backend.pairs, op.Key)
+				backend.deleted[op.Key] = backend.index
+			}
+		}
+	}
+
+	close(backend.changed)
+	backend.changed = make(chan struct{})
+
+	return true, nil
+}
+
+// checkTxn returns false if any check-and-set operation or check of the transaction
+// would fail, without applying it.
+func (backend *MemoryBackend) checkTxn(ops api.KVTxnOps) (bool, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	return backend.check(ops)
+}
+
+// check evaluates the operations; it is always called with the lock held.
+func (backend *MemoryBackend) check(ops api.KVTxnOps) (bool, error) {
+	for _, op := range ops {
+		kv, exists := backend.pairs[op.Key]
+
+		switch op.Verb {
+		case api.KVSet, api.KVDelete:
+		case api.KVCAS, api.KVDeleteCAS, api.KVCheckIndex:
+			if op.Index == 0 && exists {
+				return false, nil
+			}
+			if op.Index != 0 && (!exists || kv.ModifyIndex != op.Index) {
+				return false, nil
+			}
+		case api.KVCheckNotExists:
+			if exists {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("unsupported transaction verb '%s'", op.Verb)
+		}
+	}
+
+	return true, nil
+}
+
+func (backend *MemoryBackend) Ping() error {
+	return nil
+}
+
+func (backend *MemoryBackend) Close() error {
+	return nil
+}
+
+// query runs fn until the index it returns is greater than options.WaitIndex.
+// fn is always called with the lock held.
+func (backend *MemoryBackend) query(options *api.QueryOptions, fn func() uint64) (*api.QueryMeta, error) {
+	var timeout <-chan time.Time
+	if options != nil && options.WaitIndex > 0 {
+		wait := options.WaitTime
+		if wait <= 0 {
+			wait = backendDefaultWaitTime
+		}
+		timeout = time.After(wait)
+	}
+
+	for {
+		backend.mu.Lock()
+		// Like Consul, never return 0 so the result can always be used as WaitIndex
+		index := max(fn(), 1)
+		changed := backend.changed
+		backend.mu.Unlock()
+
+		if options == nil || options.WaitIndex == 0 || index > options.WaitIndex {
+			return &api.QueryMeta{LastIndex: index}, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return &api.QueryMeta{LastIndex: index}, nil
+		case <-options.Context().Done():
+			return nil, options.Context().Err()
+		}
+	}
+}
+
+func (backend *MemoryBackend) getDeletedIndex(prefix string) uint64 {
+	var index uint64
+	for key, deleted := range backend.deleted {
+		if strings.HasPrefix(key, prefix) {
+			index = max(index, deleted)
+		}
+	}
+
+	return index
+}
+
+func copyKVPair(kv *api.KVPair) *api.KVPair {
+	copied := *kv
+	copied.Value = append([]byte{}, kv.Value...)
+
+	return &copied
+}
@@ -0,0 +1,295 @@
+package consulkv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+)
+
+// countingBackend records the reads of the wrapped backend.
+type countingBackend struct {
+	Backend
+	gets []string
+	keys int
+}
+
+func (backend *countingBackend) Get(key string, options *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	backend.gets = append(backend.gets, key)
+	return backend.Backend.Get(key, options)
+}
+
+func (backend *countingBackend) Keys(prefix, separator string, options *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	backend.keys++
+	return backend.Backend.Keys(prefix, separator, options)
+}
+
+func TestMemoryBackendTxn(tst *testing.T) {
+	backend := CreateMemoryBackend()
+	backend.Put("dns/zones/example.com/www", []byte(`{}`))
+
+	kv, _, err := backend.Get("dns/zones/example.com/www", nil)
+	if err != nil || kv == nil {
+		tst.Fatalf("Expected stored key, got %v (%v)", kv, err)
+	}
+
+	tests := []struct {
+		name     string
+		op       *api.KVTxnOp
+		expected bool
+	}{
+		{"cas with old index", &api.KVTxnOp{Verb: api.KVCAS, Key: kv.Key, Index: kv.ModifyIndex - 1}, false},
+		{"cas create existing", &api.KVTxnOp{Verb: api.KVCAS, Key: kv.Key, Index: 0}, false},
+		{"check not exists", &api.KVTxnOp{Verb: api.KVCheckNotExists, Key: kv.Key}, false},
+		{"cas create", &api.KVTxnOp{Verb: api.KVCAS, Key: "dns/zones/example.com/mail", Index: 0}, true},
+		{"cas with index", &api.KVTxnOp{Verb: api.KVCAS, Key: kv.Key, Index: kv.ModifyIndex}, true},
+	}
+
+	for _, tc := range tests {
+		ok, err := backend.Txn(api.KVTxnOps{tc.op})
+		if err != nil || ok != tc.expected {
+			tst.Errorf("Expected %v for '%s', got %v (%v)", tc.expected, tc.name, ok, err)
+		}
+	}
+
+	// A failed check rolls back the whole transaction
+	ok, _ := backend.Txn(api.KVTxnOps{
+		{Verb: api.KVSet, Key: "dns/zones/example.com/ftp"},
+		{Verb: api.KVCheckNotExists, Key: kv.Key},
+	})
+	if kv, _, _ := backend.Get("dns/zones/example.com/ftp", nil); ok || kv != nil {
+		tst.Errorf("Expected failed transaction not to write any key")
+	}
+
+	keys, _, _ := backend.Keys("dns/zones/", "/", nil)
+	if len(keys) != 1 || keys[0] != "dns/zones/example.com/" {
+		tst.Errorf("Expected folder 'dns/zones/example.com/', got %v", keys)
+	}
+}
+
+func TestMemoryBackendBlocking(tst *testing.T) {
+	backend := CreateMemoryBackend()
+	backend.Put("dns/zones/example.com/www", []byte(`{}`))
+
+	_, meta, _ := backend.List("dns/zones/example.com/", nil)
+	index := meta.LastIndex
+
+	// Changes to other prefixes don't change the index
+	backend.Put("dns/zones/example.org/www", []byte(`{}`))
+
+	_, meta, _ = backend.List("dns/zones/example.com/", &api.QueryOptions{WaitIndex: index, WaitTime: 10 * time.Millisecond})
+	if meta.LastIndex != index {
+		tst.Errorf("Expected index %d to be unchanged, got %d", index, meta.LastIndex)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		backend.Txn(api.KVTxnOps{{Verb: api.KVDelete, Key: "dns/zones/example.com/www"}})
+	}()
+
+	pairs, meta, err := backend.List("dns/zones/example.com/", &api.QueryOptions{WaitIndex: index, WaitTime: time.Second})
+	if err != nil || meta.LastIndex <= index || len(pairs) != 0 {
+		tst.Errorf("Expected blocking query to return after delete, got %v at index %d (%v)", pairs, meta.LastIndex, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	options := &api.QueryOptions{WaitIndex: meta.LastIndex}
+	if _, _, err := backend.List("dns/zones/example.com/", options.WithContext(ctx)); err == nil {
+		tst.Errorf("Expected blocking query to return with canceled context")
+	}
+}
+
+func TestMemoryBackendLoad(tst *testing.T) {
+	serve := func(plug *ConsulKVPlugin, qname string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+			tst.Fatalf("Unexpected error: %v", err)
+		}
+
+		return rec.Msg
+	}
+
+	// Without a config, no zones are served
+	plug, err := CreatePlugin(caddy.NewTestController("dns", "consulkv {\n backend memory\n}"))
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if _, err := plug.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req); err == nil {
+		tst.Errorf("Expected query to be passed to the next plugin without config")
+	}
+
+	path := filepath.Join(tst.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(`{
+		"dns/config": {"zones": ["example.com"]},
+		"dns/zones/example.com/www": {"records": [{"type": "A", "value": ["192.168.0.1"]}]},
+		"dns/plain": "value"
+	}`), 0o644)
+
+	plug, err = CreatePlugin(caddy.NewTestController("dns", "consulkv {\n backend memory "+path+"\n}"))
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	if m := serve(plug, "www.example.com."); len(m.Answer) != 1 {
+		tst.Errorf("Expected answer from loaded keys, got %v", m)
+	}
+
+	if kv, _, _ := plug.Consul.Backend.Get("dns/plain", nil); kv == nil || string(kv.Value) != "value" {
+		tst.Errorf("Expected string to be stored as it is, got %v", kv)
+	}
+}
+
+func TestFileBackend(tst *testing.T) {
+	root := tst.TempDir()
+	write := func(key, value string) {
+		path := filepath.Join(root, filepath.FromSlash(key)+".json")
+		os.MkdirAll(filepath.Dir(path), 0o755)
+
+		if err := os.WriteFile(path, []byte(value), 0o644); err != nil {
+			tst.Fatalf("Unable to write '%s': %v", path, err)
+		}
+	}
+
+	write("dns/config", `{"zones":["example.com"]}`)
+	write("dns/zones/example.com/@", `{"records":[{"type":"SOA","value":{"mname":"ns1.example.com","rname":"admin.example.com","serial":1,"refresh":3600,"retry":600,"expire":86400,"minimum":300}}]}`)
+	write("dns/zones/example.com/www", `{"records":[{"type":"A","value":["192.168.0.1"]}]}`)
+
+	c := caddy.NewTestController("dns", `consulkv {
+		backend file `+root+` 1h
+	}`)
+
+	plug, err := CreatePlugin(c)
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+	defer plug.Consul.Backend.Close()
+
+	serve := func(qname string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		plug.ServeDNS(context.Background(), rec, req)
+
+		return rec.Msg
+	}
+
+	m := serve("www.example.com.")
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.168.0.1" {
+		tst.Fatalf("Expected answer from file, got %v", m)
+	}
+
+	backend := plug.Consul.Backend.(*FileBackend)
+
+	// Files edited by hand are loaded with the next sync
+	os.Remove(filepath.Join(root, "dns/zones/example.com/www.json"))
+	write("dns/zones/example.com/mail", `{"records":[{"type":"A","value":["192.168.0.2"]}]}`)
+	if err := backend.Sync(); err != nil {
+		tst.Fatalf("Unable to sync files: %v", err)
+	}
+
+	if m := serve("www.example.com."); m.Rcode != dns.RcodeNameError {
+		tst.Errorf("Expected NXDOMAIN for removed file, got %v", m)
+	}
+
+	if m := serve("mail.example.com."); len(m.Answer) != 1 {
+		tst.Errorf("Expected answer from added file, got %v", m)
+	}
+
+	kv, _, _ := backend.Get("dns/zones/example.com/mail", nil)
+	ok, err := backend.Txn(api.KVTxnOps{
+		{Verb: api.KVCAS, Key: kv.Key, Value: []byte(`{"records":[]}`), Index: kv.ModifyIndex},
+		{Verb: api.KVSet, Key: "dns/zones/example.com/ftp", Value: []byte(`{"records":[]}`)},
+	})
+	if err != nil || !ok {
+		tst.Fatalf("Expected transaction to succeed, got %v (%v)", ok, err)
+	}
+
+	if value, _ := os.ReadFile(filepath.Join(root, "dns/zones/example.com/ftp.json")); string(value) != `{"records":[]}` {
+		tst.Errorf("Expected written file, got '%s'", value)
+	}
+
+	if _, err := backend.Txn(api.KVTxnOps{{Verb: api.KVSet, Key: "dns/../../etc/passwd"}}); err == nil {
+		tst.Errorf("Expected key outside of the directory to be rejected")
+	}
+
+	// A directory in place of a file fails the transaction after the first file has been replaced
+	write("dns/zones/example.com/broken.json/file", `{}`)
+	ok, err = backend.Txn(api.KVTxnOps{
+		{Verb: api.KVSet, Key: "dns/zones/example.com/ftp", Value: []byte(`{"ttl":60,"records":[]}`)},
+		{Verb: api.KVSet, Key: "dns/zones/example.com/broken", Value: []byte(`{"records":[]}`)},
+	})
+	if err == nil || ok {
+		tst.Fatalf("Expected transaction to fail, got %v (%v)", ok, err)
+	}
+
+	// The loaded keys still match the files
+	value, _ := os.ReadFile(filepath.Join(root, "dns/zones/example.com/ftp.json"))
+	if kv, _, _ := backend.Get("dns/zones/example.com/ftp", nil); kv == nil || string(kv.Value) != string(value) {
+		tst.Errorf("Expected loaded key to match file '%s', got %v", value, kv)
+	}
+
+	if kv, _, _ := backend.Get("dns/zones/example.com/broken", nil); kv != nil {
+		tst.Errorf("Expected key of failed file not to be loaded, got %v", kv)
+	}
+
+	temps, _ := filepath.Glob(filepath.Join(root, "dns/zones/example.com/.tmp-*"))
+	if len(temps) != 0 {
+		tst.Errorf("Expected temporary files to be removed, got %v", temps)
+	}
+}
+
+func TestWatchConsulKey(tst *testing.T) {
+	backend := CreateMemoryBackend()
+	backend.Put("dns/config", []byte(`{}`))
+
+	consul := ConsulConfig{KVPrefix: "dns", Backend: backend}
+	values := make(chan string, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	consul.WatchConsulKey(ctx, "config", func(kv *api.KVPair) error {
+		values <- string(kv.Value)
+		return nil
+	})
+
+	expect := func(value string) {
+		select {
+		case v := <-values:
+			if v != value {
+				tst.Errorf("Expected value '%s', got '%s'", value, v)
+			}
+		case <-time.After(time.Second):
+			tst.Fatalf("Expected value '%s' within 1s", value)
+		}
+	}
+
+	expect(`{}`)
+	backend.Put("dns/config", []byte(`{"zones":[]}`))
+	expect(`{"zones":[]}`)
+
+	// Changes after the watch has been cancelled are ignored
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	backend.Put("dns/config", []byte(`{"zones":["example.com"]}`))
+
+	select {
+	case v := <-values:
+		tst.Errorf("Expected no value after cancel, got '%s'", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+// exportEntry is a single key of the output of 'consul kv export'.
+type exportEntry struct {
+	Key   string `json:"key"`
+	Flags uint64 `json:"flags"`
+	Value string `json:"value"`
+}
+
+func runLint(args []string) error {
+	var global globalFlags
+
+	set := flag.NewFlagSet("lint", flag.ExitOnError)
+	global.register(set)
+	file := set.String("file", "", "Lint the output of 'consul kv export' instead of the live prefix")
+	minTTL := set.Int("min-ttl", 0, "Lowest TTL a record should have")
+	maxTTL := set.Int("max-ttl", records.MaxTTL, "Highest TTL a record should have")
+	strict := set.Bool("strict", false, "Also fail on warnings")
+	set.Parse(args)
+
+	var pairs api.KVPairs
+	var err error
+
+	if *file != "" {
+		pairs, err = readKVExport(*file)
+	} else {
+		pairs, err = readKVPrefix(global)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	zones := groupZonePairs(global.prefix+"/zones/", pairs)
+	if set.NArg() > 0 {
+		selected := make(map[string]map[string][]byte)
+		for _, zone := range set.Args() {
+			zone = strings.TrimSuffix(zone, ".")
+			if _, exists := zones[zone]; !exists {
+				return fmt.Errorf("zone '%s' not found under '%s/zones/'", zone, global.prefix)
+			}
+			selected[zone] = zones[zone]
+		}
+		zones = selected
+	}
+
+	options := records.ValidateOptions{MinTTL: *minTTL, MaxTTL: *maxTTL}
+	errs, warnings := lintZones(os.Stdout, zones, options)
+
+	fmt.Printf("%d zones checked, %d errors, %d warnings\n", len(zones), errs, warnings)
+	if errs > 0 || (*strict && warnings > 0) {
+		return errors.New("lint failed")
+	}
+
+	return nil
+}
+
+// lintZones writes the issues of every zone and returns the amount of errors and warnings.
+func lintZones(writer io.Writer, zones map[string]map[string][]byte, options records.ValidateOptions) (int, int) {
+	names := make([]string, 0, len(zones))
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+
+	errs, warnings := 0, 0
+	for _, zone := range names {
+		for _, issue := range records.ValidateZone(zone, zones[zone], options) {
+			fmt.Fprintf(writer, "%s/%s\n", zone, issue)
+
+			if issue.Severity == records.SeverityError {
+				errs++
+			} else {
+				warnings++
+			}
+		}
+	}
+
+	return errs, warnings
+}
+
+// groupZonePairs returns the values of all records below prefix, grouped by zone.
+func groupZonePairs(prefix string, pairs api.KVPairs) map[string]map[string][]byte {
+	zones := make(map[string]map[string][]byte)
+
+	for _, kv := range pairs {
+		parts := strings.Split(strings.TrimPrefix(kv.Key, prefix), "/")
+		if !strings.HasPrefix(kv.Key, prefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+
+		if zones[parts[0]] == nil {
+			zones[parts[0]] = make(map[string][]byte)
+		}
+		zones[parts[0]][parts[1]] = kv.Value
+	}
+
+	return zones
+}
+
+func readKVPrefix(global globalFlags) (api.KVPairs, error) {
+	client, err := global.client()
+	if err != nil {
+		return nil, err
+	}
+
+	pairs, _, err := client.KV().List(global.prefix+"/zones/", nil)
+	return pairs, err
+}
+
+func readKVExport(filename string) (api.KVPairs, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []exportEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("error converting json of '%s': %w", filename, err)
+	}
+
+	pairs := make(api.KVPairs, 0, len(entries))
+	for _, entry := range entries {
+		value, err := base64.StdEncoding.DecodeString(entry.Value)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding value of '%s': %w", entry.Key, err)
+		}
+
+		pairs = append(pairs, &api.KVPair{Key: entry.Key, Flags: entry.Flags, Value: value})
+	}
+
+	return pairs, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+func TestLintZones(tst *testing.T) {
+	filename := filepath.Join(tst.TempDir(), "export.json")
+	err := os.WriteFile(filename, []byte(`[
+	{"key":"dns/zones/example.com/@","flags":0,"value":"eyJyZWNvcmRzIjpbeyJ0eXBlIjoiTlMiLCJ2YWx1ZSI6WyJuczEuZXhhbXBsZS5uZXQiXX1dfQ=="},
+	{"key":"dns/zones/example.com/www","flags":0,"value":"eyJyZWNvcmRzIjpbeyJ0eXBlIjoiQSIsInZhbHVlIjpbIjE5Mi4xNjguMC4xIl19XX0="},
+	{"key":"dns/zones/example.com/nested/key","flags":0,"value":"e30="},
+	{"key":"dns/other","flags":0,"value":"e30="}
+]`), 0o644)
+	if err != nil {
+		tst.Fatal(err)
+	}
+
+	pairs, err := readKVExport(filename)
+	if err != nil {
+		tst.Fatalf("Unable to read export: %v", err)
+	}
+
+	zones := groupZonePairs("dns/zones/", pairs)
+	if len(zones) != 1 || len(zones["example.com"]) != 2 {
+		tst.Fatalf("Expected two records of 'example.com', got %v", zones)
+	}
+
+	var buf strings.Builder
+	errs, warnings := lintZones(&buf, zones, records.ValidateOptions{MinTTL: 60})
+
+	if errs != 1 || warnings != 0 || !strings.Contains(buf.String(), "example.com/@: error: missing SOA record") {
+		tst.Errorf("Expected a single missing SOA error, got %d errors, %d warnings:\n%s", errs, warnings, buf.String())
+	}
+}
@@ -0,0 +1,78 @@
+// Command consulkvctl manages the records of the consulkv plugin stored in Consul KV.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const usage = `Usage: consulkvctl <command> [options]
+
+Commands:
+  zone import [options] <zone> <file>   Import a RFC 1035 zone file into '<kv_prefix>/zones/<zone>/'
+  zone export [options] <zone>          Render '<kv_prefix>/zones/<zone>/' as zone file
+  lint [options] [zone...]              Check the records of all or the given zones
+
+Run 'consulkvctl <command> -h' for the options of a command.
+`
+
+type globalFlags struct {
+	address string
+	token   string
+	prefix  string
+}
+
+func (g *globalFlags) register(set *flag.FlagSet) {
+	set.StringVar(&g.address, "address", getEnv("CONSUL_HTTP_ADDR", "http://127.0.0.1:8500"), "Consul HTTP address")
+	set.StringVar(&g.token, "token", os.Getenv("CONSUL_HTTP_TOKEN"), "Consul ACL token")
+	set.StringVar(&g.prefix, "kv-prefix", getEnv("CONSUL_KV_PREFIX", "dns"), "Consul KV prefix of the plugin")
+}
+
+func (g *globalFlags) client() (*api.Client, error) {
+	config := api.DefaultConfig()
+	config.Address = g.address
+	config.Token = g.token
+
+	return api.NewClient(config)
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) > 0 && args[0] == "lint" {
+		return runLint(args[1:])
+	}
+
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch args[0] + " " + args[1] {
+	case "zone import":
+		return runZoneImport(args[2:])
+	case "zone export":
+		return runZoneExport(args[2:])
+	}
+
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
+
+	return nil
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+// Consul rejects transactions with more operations
+const maxTxnOps = 64
+
+type zoneChange struct {
+	Name    string
+	Key     string
+	Old     []byte // nil for new records
+	New     []byte // nil for deleted records
+	Index   uint64
+	Dropped []string // Types and views of the existing record that are lost
+}
+
+func runZoneImport(args []string) error {
+	var global globalFlags
+
+	set := flag.NewFlagSet("zone import", flag.ExitOnError)
+	global.register(set)
+	dryRun := set.Bool("dry-run", false, "Only print the changes without writing them")
+	txn := set.Bool("txn", false, "Write all changes within a single Consul transaction")
+	prune := set.Bool("prune", false, "Delete records of the zone that aren't part of the file")
+	force := set.Bool("force", false, "Replace existing records entirely, including views and entries without zone file representation")
+	set.Parse(args)
+
+	if set.NArg() != 2 {
+		return errors.New("zone import requires a zone and a file")
+	}
+
+	zone, filename := strings.TrimSuffix(set.Arg(0), "."), set.Arg(1)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	recs, err := records.ParseZoneFile(file, zone, filename)
+	if err != nil {
+		return err
+	}
+
+	client, err := global.client()
+	if err != nil {
+		return err
+	}
+
+	prefix := global.prefix + "/zones/" + zone + "/"
+	existing, _, err := client.KV().List(prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	changes, err := planZoneImport(prefix, recs, existing, *prune, *force)
+	if err != nil {
+		return err
+	}
+
+	writeZoneDiff(os.Stdout, changes)
+	if *dryRun || len(changes) == 0 {
+		return nil
+	}
+
+	if *txn {
+		return applyZoneChangesTxn(client, changes)
+	}
+
+	return applyZoneChanges(client, changes)
+}
+
+func runZoneExport(args []string) error {
+	var global globalFlags
+
+	set := flag.NewFlagSet("zone export", flag.ExitOnError)
+	global.register(set)
+	output := set.String("o", "", "Write the zone file to this file instead of stdout")
+	set.Parse(args)
+
+	if set.NArg() != 1 {
+		return errors.New("zone export requires a zone")
+	}
+
+	zone := strings.TrimSuffix(set.Arg(0), ".")
+
+	client, err := global.client()
+	if err != nil {
+		return err
+	}
+
+	prefix := global.prefix + "/zones/" + zone + "/"
+	pairs, _, err := client.KV().List(prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	recs, err := convertZonePairs(prefix, pairs)
+	if err != nil {
+		return err
+	}
+
+	if len(recs) == 0 {
+		return fmt.Errorf("no records found under '%s'", prefix)
+	}
+
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		writer = file
+	}
+
+	return records.RenderZoneFile(writer, zone, recs)
+}
+
+// convertZonePairs parses the values of all records directly below prefix.
+func convertZonePairs(prefix string, pairs api.KVPairs) (map[string]*records.Record, error) {
+	recs := make(map[string]*records.Record)
+
+	for _, kv := range pairs {
+		name := strings.TrimPrefix(kv.Key, prefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+
+		var record records.Record
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			return nil, fmt.Errorf("error converting json of '%s': %w", kv.Key, err)
+		}
+
+		recs[name] = &record
+	}
+
+	return recs, nil
+}
+
+// planZoneImport compares the records of the zone file with the existing keys
+// and returns every key that has to be written or deleted.
+// Unless force is set, the RRsets of the file are merged into the existing records,
+// so views and entries without zone file representation (e.g. ALIAS) are kept.
+func planZoneImport(prefix string, recs map[string]*records.Record, existing api.KVPairs, prune, force bool) ([]zoneChange, error) {
+	current := make(map[string]*api.KVPair)
+	for _, kv := range existing {
+		name := strings.TrimPrefix(kv.Key, prefix)
+		if name != "" && !strings.Contains(name, "/") {
+			current[name] = kv
+		}
+	}
+
+	changes := []zoneChange{}
+	add := func(name string, kv *api.KVPair, record *records.Record) error {
+		change := zoneChange{Name: name, Key: prefix + name}
+
+		var old *records.Record
+		if kv != nil {
+			change.Key = kv.Key
+			change.Old = kv.Value
+			change.Index = kv.ModifyIndex
+
+			if err := json.Unmarshal(kv.Value, &old); err != nil && !force {
+				return fmt.Errorf("unable to merge into '%s', use -force to replace it: %w", kv.Key, err)
+			}
+
+			if !force && old != nil {
+				record = mergeZoneRecord(old, record)
+			}
+		}
+
+		if record != nil {
+			value, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+
+			// Compare the parsed values, so formatting differences don't count as change
+			if old != nil {
+				if normalized, err := json.Marshal(old); err == nil && bytes.Equal(normalized, value) {
+					return nil
+				}
+			}
+
+			change.New = value
+		}
+
+		change.Dropped = getDroppedEntries(old, record)
+		changes = append(changes, change)
+		return nil
+	}
+
+	for name, record := range recs {
+		if err := add(name, current[name], record); err != nil {
+			return nil, err
+		}
+	}
+
+	if prune {
+		for name, kv := range current {
+			if _, exists := recs[name]; !exists {
+				if err := add(name, kv, nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes, nil
+}
+
+// mergeZoneRecord replaces the entries of the existing record with the imported ones,
+// keeping its views and entries that can't be expressed in a zone file.
+// Returns nil if nothing remains, i.e. the record can be deleted.
+func mergeZoneRecord(old, imported *records.Record) *records.Record {
+	merged := &records.Record{TTL: old.TTL, Views: old.Views}
+	if imported != nil {
+		merged.TTL = imported.TTL
+		merged.Records = append(merged.Records, imported.Records...)
+	}
+
+	for _, rec := range old.Records {
+		if !records.IsConvertibleType(rec.Type) {
+			merged.Records = append(merged.Records, rec)
+		}
+	}
+
+	if imported == nil && len(merged.Records) == 0 && len(merged.Views) == 0 {
+		return nil
+	}
+
+	return merged
+}
+
+// getDroppedEntries returns the types and views of the old record missing in the new one.
+func getDroppedEntries(old, new *records.Record) []string {
+	if old == nil {
+		return nil
+	}
+
+	types := make(map[string]bool)
+	views := make(map[string]bool)
+	if new != nil {
+		for _, rec := range new.Records {
+			types[rec.Type] = true
+		}
+		for view := range new.Views {
+			views[view] = true
+		}
+	}
+
+	dropped := []string{}
+	for _, rec := range old.Records {
+		if !types[rec.Type] {
+			dropped = append(dropped, rec.Type)
+			types[rec.Type] = true
+		}
+	}
+
+	names := make([]string, 0, len(old.Views))
+	for view := range old.Views {
+		if !views[view] {
+			names = append(names, view)
+		}
+	}
+	sort.Strings(names)
+
+	for _, view := range names {
+		dropped = append(dropped, "view '"+view+"'")
+	}
+
+	return dropped
+}
+
+func applyZoneChanges(client *api.Client, changes []zoneChange) error {
+	for _, change := range changes {
+		var ok bool
+		var err error
+
+		if change.New == nil {
+			ok, _, err = client.KV().DeleteCAS(&api.KVPair{Key: change.Key, ModifyIndex: change.Index}, nil)
+		} else {
+			ok, _, err = client.KV().CAS(&api.KVPair{Key: change.Key, Value: change.New, ModifyIndex: change.Index}, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return fmt.Errorf("key '%s' has been modified in the meantime", change.Key)
+		}
+	}
+
+	fmt.Printf("Applied %d changes\n", len(changes))
+	return nil
+}
+
+func applyZoneChangesTxn(client *api.Client, changes []zoneChange) error {
+	if len(changes) > maxTxnOps {
+		return fmt.Errorf("%d changes exceed the limit of %d operations per transaction", len(changes), maxTxnOps)
+	}
+
+	ops := make(api.KVTxnOps, 0, len(changes))
+	for _, change := range changes {
+		if change.New == nil {
+			ops = append(ops, &api.KVTxnOp{Verb: api.KVDeleteCAS, Key: change.Key, Index: change.Index})
+		} else {
+			ops = append(ops, &api.KVTxnOp{Verb: api.KVCAS, Key: change.Key, Value: change.New, Index: change.Index})
+		}
+	}
+
+	ok, response, _, err := client.KV().Txn(ops, nil)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		messages := []string{}
+		if response != nil {
+			for _, e := range response.Errors {
+				messages = append(messages, e.What)
+			}
+		}
+
+		return fmt.Errorf("transaction has been rolled back: %s", strings.Join(messages, "; "))
+	}
+
+	fmt.Printf("Applied %d changes within a single transaction\n", len(changes))
+	return nil
+}
+
+// writeZoneDiff prints every change as line based diff of the indented values.
+func writeZoneDiff(writer io.Writer, changes []zoneChange) {
+	if len(changes) == 0 {
+		fmt.Fprintln(writer, "No changes")
+		return
+	}
+
+	for _, change := range changes {
+		switch {
+		case change.Old == nil:
+			fmt.Fprintf(writer, "+ %s\n", change.Key)
+		case change.New == nil:
+			fmt.Fprintf(writer, "- %s\n", change.Key)
+		default:
+			fmt.Fprintf(writer, "~ %s\n", change.Key)
+		}
+
+		if len(change.Dropped) > 0 {
+			fmt.Fprintf(writer, "    ! drops %s\n", strings.Join(change.Dropped, ", "))
+		}
+
+		for _, line := range diffLines(indentJSON(change.Old), indentJSON(change.New)) {
+			fmt.Fprintf(writer, "    %s\n", line)
+		}
+	}
+}
+
+func indentJSON(value []byte) []string {
+	if value == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, value, "", "  "); err != nil {
+		return strings.Split(string(value), "\n")
+	}
+
+	return strings.Split(buf.String(), "\n")
+}
+
+// diffLines returns the lines of both sides prefixed with '-', '+' or ' '
+// based on their longest common subsequence.
+func diffLines(old, new []string) []string {
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		switch {
+		case old[i] == new[j]:
+			lines = append(lines, "  "+old[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "- "+old[i])
+			i++
+		default:
+			lines = append(lines, "+ "+new[j])
+			j++
+		}
+	}
+
+	for ; i < len(old); i++ {
+		lines = append(lines, "- "+old[i])
+	}
+	for ; j < len(new); j++ {
+		lines = append(lines, "+ "+new[j])
+	}
+
+	return lines
+}
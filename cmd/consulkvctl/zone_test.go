@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+func TestPlanZoneImport(tst *testing.T) {
+	recs, err := records.ParseZoneFile(strings.NewReader(`
+www  3600 IN A 192.168.0.1
+mail 3600 IN A 192.168.0.2
+ftp  3600 IN A 192.168.0.3
+`), "example.com", "test.zone")
+	if err != nil {
+		tst.Fatalf("Unable to parse zone file: %v", err)
+	}
+
+	existing := api.KVPairs{
+		{Key: "dns/zones/example.com/www", Value: []byte(`{ "ttl": 3600, "records": [ { "type": "A", "value": [ "192.168.0.1" ] } ] }`), ModifyIndex: 10},
+		{Key: "dns/zones/example.com/mail", Value: []byte(`{"ttl":3600,"records":[{"type":"A","value":["192.168.0.9"]}]}`), ModifyIndex: 11},
+		{Key: "dns/zones/example.com/old", Value: []byte(`{"ttl":3600,"records":[]}`), ModifyIndex: 12},
+		{Key: "dns/zones/example.com/nested/key", Value: []byte(`{}`), ModifyIndex: 13},
+	}
+
+	changes, err := planZoneImport("dns/zones/example.com/", recs, existing, false, false)
+	if err != nil {
+		tst.Fatalf("Unable to plan import: %v", err)
+	}
+
+	if len(changes) != 2 || changes[0].Name != "ftp" || changes[1].Name != "mail" {
+		tst.Fatalf("Expected changes for 'ftp' and 'mail', got %+v", changes)
+	}
+
+	if changes[0].Old != nil || changes[0].Index != 0 {
+		tst.Errorf("Expected 'ftp' to be created, got %+v", changes[0])
+	}
+
+	if changes[1].Index != 11 {
+		tst.Errorf("Expected 'mail' to be updated with CAS index 11, got %d", changes[1].Index)
+	}
+
+	changes, _ = planZoneImport("dns/zones/example.com/", recs, existing, true, false)
+	if len(changes) != 3 || changes[2].Name != "old" || changes[2].New != nil {
+		tst.Errorf("Expected 'old' to be deleted with prune, got %+v", changes)
+	}
+
+	var buf strings.Builder
+	writeZoneDiff(&buf, changes[1:2])
+
+	diff := buf.String()
+	if !strings.Contains(diff, "~ dns/zones/example.com/mail") || !strings.Contains(diff, `-         "192.168.0.9"`) || !strings.Contains(diff, `+         "192.168.0.2"`) {
+		tst.Errorf("Expected diff of changed address, got:\n%s", diff)
+	}
+}
+
+func TestPlanZoneImportMerge(tst *testing.T) {
+	recs, err := records.ParseZoneFile(strings.NewReader(`
+@    3600 IN A 192.168.0.1
+www  3600 IN A 192.168.0.2
+`), "example.com", "test.zone")
+	if err != nil {
+		tst.Fatalf("Unable to parse zone file: %v", err)
+	}
+
+	existing := api.KVPairs{
+		{Key: "dns/zones/example.com/@", Value: []byte(`{"ttl":300,"records":[{"type":"ALIAS","value":"lb.example.net"},{"type":"TXT","value":["text"]}]}`), ModifyIndex: 10},
+		{Key: "dns/zones/example.com/www", Value: []byte(`{"ttl":3600,"records":[{"type":"A","value":["192.168.0.9"]}],"views":{"internal":[{"type":"A","value":["10.0.0.2"]}]}}`), ModifyIndex: 11},
+		{Key: "dns/zones/example.com/api", Value: []byte(`{"ttl":30,"records":[{"type":"CONSUL_SERVICE","value":{"service":"api"}},{"type":"A","value":["192.168.0.3"]}]}`), ModifyIndex: 12},
+	}
+
+	changes, err := planZoneImport("dns/zones/example.com/", recs, existing, true, false)
+	if err != nil {
+		tst.Fatalf("Unable to plan import: %v", err)
+	}
+
+	if len(changes) != 3 || changes[0].Name != "@" || changes[1].Name != "api" || changes[2].Name != "www" {
+		tst.Fatalf("Expected changes for '@', 'api' and 'www', got %+v", changes)
+	}
+
+	expected := []string{
+		`{"ttl":3600,"records":[{"type":"A","value":["192.168.0.1"]},{"type":"ALIAS","value":"lb.example.net"}]}`,
+		`{"ttl":30,"records":[{"type":"CONSUL_SERVICE","value":{"service":"api"}}]}`,
+		`{"ttl":3600,"records":[{"type":"A","value":["192.168.0.2"]}],"views":{"internal":[{"type":"A","value":["10.0.0.2"]}]}}`,
+	}
+	for i, change := range changes {
+		if string(change.New) != expected[i] {
+			tst.Errorf("Expected '%s' to be merged into %s, got %s", change.Name, expected[i], change.New)
+		}
+	}
+
+	if len(changes[0].Dropped) != 1 || changes[0].Dropped[0] != "TXT" {
+		tst.Errorf("Expected TXT to be dropped from '@', got %v", changes[0].Dropped)
+	}
+
+	// Without merging, views and entries like ALIAS are replaced as well
+	changes, _ = planZoneImport("dns/zones/example.com/", recs, existing, true, true)
+	if len(changes) != 3 || changes[1].New != nil {
+		tst.Fatalf("Expected 'api' to be deleted with force, got %+v", changes)
+	}
+
+	var buf strings.Builder
+	writeZoneDiff(&buf, changes)
+
+	diff := buf.String()
+	if !strings.Contains(diff, "! drops ALIAS, TXT") || !strings.Contains(diff, "! drops view 'internal'") {
+		tst.Errorf("Expected diff to list dropped entries, got:\n%s", diff)
+	}
+}
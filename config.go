@@ -5,22 +5,36 @@ import (
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/plugin"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
 	"github.com/mwantia/coredns-consulkv-plugin/types"
 )
 
 type ConsulKVPlugin struct {
-	Next   plugin.Handler
-	Consul *ConsulConfig
-	Config *ConsulKVConfig
-	cfgMu  *sync.RWMutex
+	Next     plugin.Handler
+	Consul   *ConsulConfig
+	Config   *ConsulKVConfig
+	Mirror   *ZoneMirror
+	Discover *ZoneDiscovery
+	Cache    *ResponseCache
+	Lockdown *Lockdown
+	Admin    *AdminAPI
+	Webhook  *ExternalDNSWebhook
+	DNSSEC   *DNSSEC
+	Catalog  *ServiceCatalog
+	Aliases  *AliasCache
+	TSIGKeys map[string]*TSIGKey
+	cfgMu    *sync.RWMutex
 }
 
 type ConsulKVConfig struct {
-	ZonePrefix  string               `json:"zone_prefix"`
-	Zones       []string             `json:"zones"`
-	Flattening  types.FlatteningType `json:"flattening,omitempty"`
-	NoCache     bool                 `json:"no_cache,omitempty"`
-	ConsulCache *ConsulKVCache       `json:"consul_cache,omitempty"`
+	ZonePrefix  string                 `json:"zone_prefix"`
+	Zones       []string               `json:"zones"`
+	Flattening  types.FlatteningType   `json:"flattening,omitempty"`
+	NoCache     bool                   `json:"no_cache,omitempty"`
+	ConsulCache *ConsulKVCache         `json:"consul_cache,omitempty"`
+	Views       []ViewConfig           `json:"views,omitempty"`
+	Fallthrough FallthroughConfig      `json:"fallthrough,omitempty"`
+	ZoneConfigs map[string]*ZoneConfig `json:"-"`
 }
 
 type ConsulKVCache struct {
@@ -45,8 +59,65 @@ func CreatePlugin(c *caddy.Controller) (*ConsulKVPlugin, error) {
 		return nil, err
 	}
 
+	// Without a stored config, no zones are served until one is written
+	if config == nil {
+		logging.Log.Warningf("No config found at '%s/config', serving no zones until it is created", consul.KVPrefix)
+		config = &ConsulKVConfig{}
+	}
+
+	if consul.AutoZones {
+		plug.Discover = CreateZoneDiscovery(consul)
+
+		zones, _, err := consul.ListZonesFromConsul(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		plug.Discover.UpdateZones(zones)
+		config = plug.Discover.MergeConfig(config)
+	}
+
 	plug.Consul = consul
 	plug.Config = config
+	plug.Catalog = CreateServiceCatalog(consul)
+	plug.Aliases = CreateAliasCache()
+
+	if consul.Cache {
+		plug.Cache = CreateResponseCache(consul, !consul.ZoneMirror)
+		plug.Cache.SyncZones(config.Zones)
+	}
+
+	if consul.ZoneMirror {
+		plug.Mirror = CreateZoneMirror(consul)
+		if plug.Cache != nil {
+			plug.Mirror.OnUpdate(plug.Cache.InvalidateZone)
+		}
+		plug.Mirror.SyncZones(config.Zones)
+	}
+
+	if consul.DNSSEC {
+		plug.DNSSEC = CreateDNSSEC(consul)
+		plug.DNSSEC.SyncZones(config.Zones)
+	}
+
+	if consul.Update {
+		plug.TSIGKeys, err = consul.GetTSIGKeysFromConsul()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if consul.Lockdown {
+		plug.Lockdown = CreateLockdown(consul)
+	}
+
+	if consul.AdminAddress != "" {
+		plug.Admin = CreateAdminAPI(plug)
+	}
+
+	if consul.ExternalDNSAddress != "" {
+		plug.Webhook = CreateExternalDNSWebhook(plug)
+	}
 
 	return plug, nil
 }
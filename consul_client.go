@@ -2,10 +2,16 @@ package consulkv
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/hashicorp/consul/api"
 	"github.com/mwantia/coredns-consulkv-plugin/logging"
 	"github.com/mwantia/coredns-consulkv-plugin/records"
@@ -13,10 +19,33 @@ import (
 
 type ConsulConfig struct {
 	Client       *api.Client
+	Backend      Backend
 	KVPrefix     string
 	Address      string
 	Token        string
 	DisableWatch bool
+	ZoneMirror   bool
+	AutoZones    bool
+	Cache        bool
+	DNSSEC       bool
+	TransferACL  []*net.IPNet
+	ECSTrusted   []*net.IPNet
+	Update       bool
+	Fall         fall.F
+
+	BackendType     string
+	BackendPath     string
+	BackendInterval time.Duration
+
+	Lockdown            bool
+	LockdownFallthrough bool
+	LockdownInterval    time.Duration
+	LockdownStaleTTL    uint32
+
+	AdminAddress string
+	AdminTokens  []string
+
+	ExternalDNSAddress string
 }
 
 func GetConsulEnvConfig() ConsulConfig {
@@ -51,7 +80,7 @@ func CreateConsulConfig(c *caddy.Controller) (*ConsulConfig, error) {
 		consul.KVPrefix = env.KVPrefix
 	}
 
-	err = CreateConsulClient(consul)
+	err = CreateBackend(consul)
 	if err != nil {
 		return nil, err
 	}
@@ -100,10 +129,147 @@ func LoadConsulConfig(c *caddy.Controller, consul *ConsulConfig) error {
 
 			case "disable_watch":
 				consul.DisableWatch = true
+
+			case "zone_mirror":
+				consul.ZoneMirror = true
+
+			case "backend":
+				if len(args) < 1 {
+					return c.Errf("config 'backend' can't be empty")
+				}
+				switch args[0] {
+				case backendConsul:
+					if len(args) > 1 {
+						return c.Errf("backend '%s' doesn't take any arguments", args[0])
+					}
+				case backendMemory:
+					if len(args) > 2 {
+						return c.Errf("backend 'memory' takes only an optional file")
+					}
+					if len(args) == 2 {
+						consul.BackendPath = args[1]
+					}
+				case backendFile:
+					if len(args) < 2 || len(args) > 3 {
+						return c.Errf("backend 'file' requires a directory and an optional interval")
+					}
+					consul.BackendPath = args[1]
+					if len(args) == 3 {
+						interval, err := time.ParseDuration(args[2])
+						if err != nil || interval <= 0 {
+							return c.Errf("backend 'file' interval must be a positive duration: %s", args[2])
+						}
+						consul.BackendInterval = interval
+					}
+				default:
+					return c.Errf("unknown backend '%s'", args[0])
+				}
+				consul.BackendType = args[0]
+
+			case "auto_zones":
+				consul.AutoZones = true
+
+			case "response_cache":
+				consul.Cache = true
+
+			case "dnssec":
+				consul.DNSSEC = true
+
+			case "dynamic_update":
+				consul.Update = true
+
+			case "fallthrough":
+				consul.Fall.SetZonesFromArgs(args)
+
+			case "transfer_acl":
+				if len(args) < 1 {
+					return c.Errf("config 'transfer_acl' can't be empty")
+				}
+				for _, arg := range args {
+					_, subnet, err := net.ParseCIDR(arg)
+					if err != nil {
+						return c.Errf("config 'transfer_acl' contains invalid subnet '%s': %v", arg, err)
+					}
+					consul.TransferACL = append(consul.TransferACL, subnet)
+				}
+
+			case "ecs_trusted":
+				if len(args) < 1 {
+					return c.Errf("config 'ecs_trusted' can't be empty")
+				}
+				for _, arg := range args {
+					_, subnet, err := net.ParseCIDR(arg)
+					if err != nil {
+						return c.Errf("config 'ecs_trusted' contains invalid subnet '%s': %v", arg, err)
+					}
+					consul.ECSTrusted = append(consul.ECSTrusted, subnet)
+				}
+
+			case "lockdown":
+				consul.Lockdown = true
+				for _, arg := range args {
+					if arg != "fallthrough" {
+						return c.Errf("unknown argument '%s' for config 'lockdown'", arg)
+					}
+					consul.LockdownFallthrough = true
+				}
+
+			case "lockdown_interval":
+				if len(args) < 1 {
+					return c.Errf("config 'lockdown_interval' can't be empty")
+				}
+				interval, err := time.ParseDuration(args[0])
+				if err != nil || interval <= 0 {
+					return c.Errf("config 'lockdown_interval' must be a positive duration: %s", args[0])
+				}
+				consul.LockdownInterval = interval
+
+			case "lockdown_stale_ttl":
+				if len(args) < 1 {
+					return c.Errf("config 'lockdown_stale_ttl' can't be empty")
+				}
+				ttl, err := strconv.ParseUint(args[0], 10, 32)
+				if err != nil || ttl == 0 {
+					return c.Errf("config 'lockdown_stale_ttl' must be a positive number: %s", args[0])
+				}
+				consul.LockdownStaleTTL = uint32(ttl)
+
+			case "admin_api":
+				if len(args) < 1 {
+					return c.Errf("config 'admin_api' can't be empty")
+				}
+				if _, _, err := net.SplitHostPort(args[0]); err != nil {
+					return c.Errf("config 'admin_api' must be an address with port: %s", args[0])
+				}
+				consul.AdminAddress = args[0]
+
+			case "admin_token":
+				if len(args) < 1 {
+					return c.Errf("config 'admin_token' can't be empty")
+				}
+				consul.AdminTokens = append(consul.AdminTokens, args...)
+
+			case "external_dns":
+				if len(args) < 1 {
+					return c.Errf("config 'external_dns' can't be empty")
+				}
+				host, _, err := net.SplitHostPort(args[0])
+				if err != nil {
+					return c.Errf("config 'external_dns' must be an address with port: %s", args[0])
+				}
+				// ExternalDNS can't authenticate against a webhook, so it has to run as sidecar
+				if !isLoopbackHost(host) {
+					return c.Errf("config 'external_dns' must be a loopback address: %s", args[0])
+				}
+				consul.ExternalDNSAddress = args[0]
 			}
 		}
 	}
 
+	if consul.AdminAddress != "" && len(consul.AdminTokens) == 0 {
+		return c.Errf("config 'admin_api' requires at least one 'admin_token'")
+	}
+
 	return nil
 }
 
@@ -126,12 +292,29 @@ func (consul *ConsulConfig) GetConsulKeyValue(key string, cache *ConsulKVCache)
 
 	start := time.Now()
 	options := CreateQueryOptions(cache)
-	kv, _, err := consul.Client.KV().Get(consul.KVPrefix+"/"+key, options)
+	kv, _, err := consul.Backend.Get(consul.KVPrefix+"/"+key, options)
 	duration := time.Since(start).Seconds()
 
 	return kv, duration, err
 }
 
+func (consul *ConsulConfig) GetConsulKeyValues(prefix string, cache *ConsulKVCache) (api.KVPairs, error) {
+	logging.Log.Debugf("Constructed prefix: '%s'", consul.KVPrefix+"/"+prefix)
+
+	start := time.Now()
+	options := CreateQueryOptions(cache)
+	pairs, _, err := consul.Backend.List(consul.KVPrefix+"/"+prefix, options)
+	duration := time.Since(start).Seconds()
+
+	if err != nil {
+		IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
+		return nil, err
+	}
+
+	IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
+	return pairs, nil
+}
+
 func (consul *ConsulConfig) GetConfigFromConsul() (*ConsulKVConfig, error) {
 	kv, duration, err := consul.GetConsulKeyValue("config", nil)
 
@@ -174,9 +357,10 @@ func (consul ConsulConfig) GetZoneRecordFromConsul(zone, name string, cache *Con
 	var record records.Record
 	err = json.Unmarshal(kv.Value, &record)
 	if err != nil {
-		logging.Log.Errorf("Error converting json: %v", kv.Value)
-		IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
-		return nil, err
+		logging.Log.Errorf("Error converting json for key '%s': %v", kv.Key, err)
+		IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+		IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
+		return nil, fmt.Errorf("%w '%s': %v", errInvalidRecord, kv.Key, err)
 	}
 
 	IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
@@ -185,22 +369,214 @@ func (consul ConsulConfig) GetZoneRecordFromConsul(zone, name string, cache *Con
 
 func (consul ConsulConfig) GetSOARecordFromConsul(zone string, cache *ConsulKVCache) (*records.SOARecord, error) {
 	record, err := consul.GetZoneRecordFromConsul(zone, "@", cache)
+	if err != nil {
+		return GetDefaultSOA(zone), err
+	}
 
-	if record != nil {
-		for _, rec := range record.Records {
-			if rec.Type == "SOA" {
-				var soa records.SOARecord
-				err = json.Unmarshal(rec.Value, &soa)
-				if err != nil {
-					return nil, err
-				}
+	return GetSOAFromRecord(zone, record)
+}
 
-				return &soa, nil
+// GetZoneRecordForUpdateFromConsul performs a consistent read of the record,
+// returning its ModifyIndex to be used for a later CAS write.
+func (consul ConsulConfig) GetZoneRecordForUpdateFromConsul(zone, name string) (*records.Record, uint64, error) {
+	consistent := true
+	useCache := false
+
+	kv, duration, err := consul.GetConsulKeyValue("zones/"+zone+"/"+name, &ConsulKVCache{
+		UseCache:   &useCache,
+		Consistent: &consistent,
+	})
+
+	if err != nil {
+		IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
+		return nil, 0, err
+	}
+
+	if kv == nil {
+		IncrementMetricsConsulRequestDurationSeconds("NODATA", duration)
+		return nil, 0, nil
+	}
+
+	var record records.Record
+	if err := json.Unmarshal(kv.Value, &record); err != nil {
+		IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
+		return nil, 0, err
+	}
+
+	IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
+	return &record, kv.ModifyIndex, nil
+}
+
+type ZoneRecordWrite struct {
+	Name        string
+	Record      *records.Record // nil deletes the record
+	ModifyIndex uint64
+}
+
+// WriteZoneRecordsToConsul writes all records within a single transaction using check-and-set.
+// Returns false without an error if any of the records has been modified in the meantime.
+func (consul ConsulConfig) WriteZoneRecordsToConsul(zone string, writes []ZoneRecordWrite) (bool, error) {
+	ops := make(api.KVTxnOps, 0, len(writes))
+
+	for _, write := range writes {
+		key := consul.KVPrefix + "/zones/" + zone + "/" + write.Name
+
+		if write.Record == nil {
+			if write.ModifyIndex == 0 {
+				ops = append(ops, &api.KVTxnOp{Verb: api.KVCheckNotExists, Key: key})
+			} else {
+				ops = append(ops, &api.KVTxnOp{Verb: api.KVDeleteCAS, Key: key, Index: write.ModifyIndex})
 			}
+			continue
 		}
+
+		value, err := json.Marshal(write.Record)
+		if err != nil {
+			return false, err
+		}
+
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVCAS, Key: key, Value: value, Index: write.ModifyIndex})
 	}
 
-	return GetDefaultSOA(zone), err
+	start := time.Now()
+	ok, err := consul.Backend.Txn(ops)
+	duration := time.Since(start).Seconds()
+
+	if err != nil {
+		IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
+		return false, err
+	}
+
+	IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
+	return ok, nil
+}
+
+func (consul ConsulConfig) ListZoneRecordsFromConsul(zone string, options *api.QueryOptions) (map[string]*records.Record, *api.QueryMeta, error) {
+	recs, _, meta, err := consul.listZoneRecords(zone, options)
+	return recs, meta, err
+}
+
+// listZoneRecords also returns the names of all records that couldn't be converted.
+func (consul ConsulConfig) listZoneRecords(zone string, options *api.QueryOptions) (map[string]*records.Record, []string, *api.QueryMeta, error) {
+	prefix := consul.KVPrefix + "/zones/" + zone + "/"
+
+	start := time.Now()
+	pairs, meta, err := consul.Backend.List(prefix, options)
+	duration := time.Since(start).Seconds()
+
+	if err != nil {
+		if options == nil || options.WaitIndex == 0 {
+			IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
+		}
+		return nil, nil, meta, err
+	}
+
+	if options == nil || options.WaitIndex == 0 {
+		IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
+	}
+
+	recs, invalid := convertZoneRecords(prefix, pairs)
+	return recs, invalid, meta, nil
+}
+
+// ListZoneRecordNamesFromConsul returns the names of all records within the zone
+// without loading their values. Keys in folders below the zone are collapsed by Consul.
+func (consul ConsulConfig) ListZoneRecordNamesFromConsul(zone string, cache *ConsulKVCache) ([]string, error) {
+	prefix := consul.KVPrefix + "/zones/" + zone + "/"
+
+	start := time.Now()
+	keys, _, err := consul.Backend.Keys(prefix, "/", CreateQueryOptions(cache))
+	duration := time.Since(start).Seconds()
+
+	if err != nil {
+		IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
+		return nil, err
+	}
+
+	IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
+
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// ListZonesFromConsul returns the name of every key folder below '<kv_prefix>/zones/'.
+func (consul ConsulConfig) ListZonesFromConsul(options *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	prefix := consul.KVPrefix + "/zones/"
+
+	start := time.Now()
+	keys, meta, err := consul.Backend.Keys(prefix, "/", options)
+	duration := time.Since(start).Seconds()
+
+	if err != nil {
+		if options == nil || options.WaitIndex == 0 {
+			IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
+		}
+		return nil, meta, err
+	}
+
+	if options == nil || options.WaitIndex == 0 {
+		IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
+	}
+
+	return ConvertZoneFolders(prefix, keys), meta, nil
+}
+
+// ConvertZoneFolders extracts the zone names from the folder keys returned
+// by listing the zones prefix with '/' as separator.
+func ConvertZoneFolders(prefix string, keys []string) []string {
+	zones := make([]string, 0, len(keys))
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if !strings.HasSuffix(name, "/") {
+			continue
+		}
+
+		name = strings.TrimSuffix(name, "/")
+		if name != "" && !strings.Contains(name, "/") {
+			zones = append(zones, name)
+		}
+	}
+
+	sort.Strings(zones)
+	return zones
+}
+
+func ConvertZoneRecords(prefix string, pairs api.KVPairs) map[string]*records.Record {
+	recs, _ := convertZoneRecords(prefix, pairs)
+	return recs
+}
+
+// convertZoneRecords also returns the names of all records that couldn't be converted.
+func convertZoneRecords(prefix string, pairs api.KVPairs) (map[string]*records.Record, []string) {
+	result := make(map[string]*records.Record, len(pairs))
+	invalid := []string{}
+
+	for _, kv := range pairs {
+		name := strings.TrimPrefix(kv.Key, prefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+
+		var record records.Record
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			logging.Log.Errorf("Error converting json for key '%s': %v", kv.Key, err)
+			IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+
+			invalid = append(invalid, name)
+			continue
+		}
+
+		result[name] = &record
+	}
+
+	return result, invalid
 }
 
 func CreateQueryOptions(cache *ConsulKVCache) *api.QueryOptions {
@@ -217,7 +593,7 @@ func CreateQueryOptions(cache *ConsulKVCache) *api.QueryOptions {
 			options.UseCache = *cache.UseCache
 		}
 		if cache.MaxAge != nil {
-			options.MaxAge = time.Duration(*cache.MaxAge)
+			options.MaxAge = time.Duration(*cache.MaxAge) * time.Second
 		}
 		if cache.Consistent != nil {
 			options.RequireConsistent = *cache.Consistent
@@ -229,3 +605,58 @@ func CreateQueryOptions(cache *ConsulKVCache) *api.QueryOptions {
 
 	return options
 }
+
+// GetServiceInstancesFromConsul returns the instances of a service from the Consul health endpoint.
+// Instances without a service address use the address of their node.
+func (consul ConsulConfig) GetServiceInstancesFromConsul(service records.ConsulServiceRecord, options *api.QueryOptions) ([]records.ServiceInstance, *api.QueryMeta, error) {
+	var tags []string
+	if service.Tag != "" {
+		tags = []string{service.Tag}
+	}
+
+	// Service instances are only known by Consul itself
+	if consul.Client == nil {
+		return nil, nil, errBackendNotConsul
+	}
+
+	if options == nil {
+		options = &api.QueryOptions{}
+	}
+	options.Datacenter = service.Datacenter
+
+	start := time.Now()
+	entries, meta, err := consul.Client.Health().ServiceMultipleTags(service.Service, tags, service.PassingOnly, options)
+	duration := time.Since(start).Seconds()
+
+	if err != nil {
+		if options.WaitIndex == 0 {
+			IncrementMetricsConsulRequestDurationSeconds("ERROR", duration)
+		}
+		return nil, meta, err
+	}
+
+	if options.WaitIndex == 0 {
+		IncrementMetricsConsulRequestDurationSeconds("NOERROR", duration)
+	}
+
+	instances := make([]records.ServiceInstance, 0, len(entries))
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" && entry.Node != nil {
+			address = entry.Node.Address
+		}
+
+		node := ""
+		if entry.Node != nil {
+			node = entry.Node.Node
+		}
+
+		instances = append(instances, records.ServiceInstance{
+			Node:    node,
+			Address: address,
+			Port:    uint16(entry.Service.Port),
+		})
+	}
+
+	return instances, meta, nil
+}
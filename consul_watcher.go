@@ -1,43 +1,65 @@
 package consulkv
 
 import (
+	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
 	"github.com/mwantia/coredns-consulkv-plugin/logging"
 )
 
 type handler func(*api.KVPair) error
 
-func (consul ConsulConfig) WatchConsulKey(key string, fn handler) error {
-	params := map[string]interface{}{
-		"type":  "key",
-		"key":   consul.KVPrefix + "/" + key,
-		"token": consul.Token,
-	}
+const (
+	watchWaitTime     = 5 * time.Minute
+	watchRetryBackoff = 5 * time.Second
+)
 
-	watcher, err := watch.Parse(params)
-	if err != nil {
-		return err
-	}
+// WatchConsulKey calls fn with the current value of the key and again every time it changes.
+// The key is watched with blocking queries, so this works with every backend.
+// Watching stops once ctx is cancelled.
+func (consul ConsulConfig) WatchConsulKey(ctx context.Context, key string, fn handler) error {
+	go func() {
+		var index uint64
 
-	watcher.Handler = func(idx uint64, raw interface{}) {
-		if raw == nil {
-			return
-		}
+		for ctx.Err() == nil {
+			options := &api.QueryOptions{
+				WaitIndex: index,
+				WaitTime:  watchWaitTime,
+			}
 
-		kv, ok := raw.(*api.KVPair)
-		if !ok || kv == nil {
-			return
-		}
+			kv, meta, err := consul.Backend.Get(consul.KVPrefix+"/"+key, options.WithContext(ctx))
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				logging.Log.Errorf("Error watching key '%s/%s': %v", consul.KVPrefix, key, err)
+				IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchRetryBackoff):
+				}
+				continue
+			}
 
-		fn(kv)
-	}
+			if index != 0 && meta.LastIndex == index {
+				continue
+			}
 
-	go func() {
-		if err := watcher.Run(consul.Address); err != nil {
-			logging.Log.Errorf("Error running watch plan: %v", err)
+			// The index went backwards, e.g. after a snapshot restore; start over.
+			if meta.LastIndex < index {
+				index = 0
+				continue
+			}
+
+			index = meta.LastIndex
+			if kv != nil {
+				fn(kv)
+			}
 		}
 	}()
 
@@ -48,9 +70,9 @@ func (consul ConsulConfig) WatchConsulKey(key string, fn handler) error {
 
 type cfgHandler func(*ConsulKVConfig)
 
-func (consul ConsulConfig) WatchConsulConfig(f cfgHandler) error {
+func (consul ConsulConfig) WatchConsulConfig(ctx context.Context, f cfgHandler) error {
 	i := 0
-	err := consul.WatchConsulKey("config", func(kv *api.KVPair) error {
+	err := consul.WatchConsulKey(ctx, "config", func(kv *api.KVPair) error {
 		if i > 0 {
 			config := ConsulKVConfig{}
 			if err := json.Unmarshal(kv.Value, &config); err != nil {
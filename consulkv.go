@@ -2,6 +2,7 @@ package consulkv
 
 import (
 	"context"
+	"errors"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
@@ -32,13 +33,72 @@ func (plug ConsulKVPlugin) ServeDNS(ctx context.Context, writer dns.ResponseWrit
 	logging.Log.Debugf("Received new request for zone '%s' and record '%s' with code '%s", zname, rname, dns.TypeToString[qtype])
 	IncrementMetricsQueryRequestsTotal(zname, qtype)
 
-	record, err := plug.Consul.GetZoneRecordFromConsul(zname, rname, plug.Config.ConsulCache)
+	ip, subnet := GetClientAddress(state, plug.Consul.ECSTrusted)
+	if view := plug.Config.SelectView(ip); view != "" {
+		logging.Log.Debugf("Using view '%s' for request from %s", view, state.IP())
+		ctx = WithView(ctx, view)
+	}
+
+	if subnet != nil {
+		// Answers only depend on the client subnet if views are configured
+		scope := uint8(0)
+		if len(plug.Config.Views) > 0 {
+			scope = subnet.SourceNetmask
+		}
+
+		writer = &ClientSubnetResponseWriter{ResponseWriter: writer, subnet: subnet, scope: scope}
+	}
+
+	if r.Opcode == dns.OpcodeUpdate {
+		return plug.HandleUpdate(zname, rname, writer, r)
+	}
+
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		if rname != "@" {
+			return HandleError(r, dns.RcodeNotAuth, writer, nil)
+		}
+
+		return plug.HandleTransfer(state, zname)
+	}
+
+	if plug.DNSSEC != nil {
+		if signer := plug.DNSSEC.GetZoneSigner(zname); signer != nil {
+			if qtype == dns.TypeDNSKEY && rname == "@" {
+				return plug.HandleDNSKEY(zname, signer, state, writer, r)
+			}
+
+			if state.Do() {
+				writer = &DNSSECResponseWriter{ResponseWriter: writer, ctx: ctx, plug: plug, signer: signer, zname: zname, rname: rname}
+			}
+		}
+	}
+
+	if plug.Cache != nil {
+		if msg := plug.Cache.Get(ctx, zname, rname, qtype, r, state.Size()); msg != nil {
+			return SendDNSResponse(zname, qtype, msg, writer)
+		}
+
+		ctx = plug.Cache.Track(ctx)
+	}
+
+	if plug.Lockdown != nil && plug.Lockdown.IsActive() && (plug.Mirror == nil || !plug.Mirror.IsLoaded(zname)) {
+		return plug.HandleLockdown(ctx, zname, writer, r, nil)
+	}
+
+	ctx = WithZoneNames(ctx)
+
+	cut, delegation, record, err := plug.GetDelegation(ctx, zname, rname)
 	if err != nil {
 		logging.Log.Errorf("Error receiving value for zone '%s' and name '%s': %v", zname, rname, err)
 		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
 		IncrementMetricsResponsesFailedTotal(zname, qtype, "ERROR")
 
-		return HandleConsulError(r, writer, err)
+		return plug.HandleConsulError(ctx, zname, writer, r, err)
+	}
+
+	// DS records are served by the parent side of the delegation
+	if delegation != nil && (qtype != dns.TypeDS || cut != rname) {
+		return plug.HandleDelegation(ctx, zname, cut, delegation, state, writer)
 	}
 
 	if record == nil {
@@ -49,7 +109,7 @@ func (plug ConsulKVPlugin) ServeDNS(ctx context.Context, writer dns.ResponseWrit
 }
 
 func (plug ConsulKVPlugin) HandleMissingRecord(qname string, qtype uint16, zname string, rname string, ctx context.Context, writer dns.ResponseWriter, r *dns.Msg) (int, error) {
-	soa, err := plug.Consul.GetSOARecordFromConsul(zname, plug.Config.ConsulCache)
+	soa, err := plug.GetSOARecord(zname)
 	if err != nil {
 		logging.Log.Errorf("Error loading SOA record: %v", err)
 
@@ -60,28 +120,90 @@ func (plug ConsulKVPlugin) HandleMissingRecord(qname string, qtype uint16, zname
 
 	if rname == "@" {
 		logging.Log.Warning("No root entry found in Consul")
-		IncrementMetricsResponsesFailedTotal(zname, qtype, "NXDOMAIN")
+		return plug.HandleNameError(ctx, zname, qname, qtype, soa, writer, r)
+	}
 
-		return HandleNXDomain(qname, soa, r, writer)
+	// SRV targets of CONSUL_SERVICE records only exist while their instance is registered
+	instance, err := plug.GetConsulServiceInstanceRecord(ctx, zname, rname)
+	if err != nil {
+		logging.Log.Errorf("Error receiving value for zone '%s' and name '%s': %v", zname, rname, err)
+
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+		IncrementMetricsResponsesFailedTotal(zname, qtype, "ERROR")
+		return plug.HandleConsulError(ctx, zname, writer, r, err)
+	}
+
+	if instance != nil {
+		return plug.CreateDNSResponse(qname, qtype, instance, ctx, r, writer)
 	}
 
-	record, err := plug.Consul.GetZoneRecordFromConsul(zname, "*", plug.Config.ConsulCache)
+	ent, err := plug.IsEmptyNonTerminal(ctx, zname, rname)
 	if err != nil {
-		logging.Log.Errorf("Error receiving value for zone '%s' and name '*': %v", zname, err)
+		logging.Log.Errorf("Error listing names for zone '%s': %v", zname, err)
 
 		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
 		IncrementMetricsResponsesFailedTotal(zname, qtype, "ERROR")
-		return HandleConsulError(r, writer, err)
+		return plug.HandleConsulError(ctx, zname, writer, r, err)
+	}
+
+	if ent {
+		logging.Log.Debugf("Name '%s' in zone '%s' is an empty non-terminal", rname, zname)
+		IncrementMetricsResponsesFailedTotal(zname, qtype, "NODATA")
+
+		return plug.HandleNegativeResponse(ctx, qname, qtype, dns.RcodeSuccess, soa, r, writer)
+	}
+
+	record, err := plug.GetWildcardRecord(ctx, zname, rname)
+	if err != nil {
+		logging.Log.Errorf("Error receiving wildcard for zone '%s' and name '%s': %v", zname, rname, err)
+
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+		IncrementMetricsResponsesFailedTotal(zname, qtype, "ERROR")
+		return plug.HandleConsulError(ctx, zname, writer, r, err)
 	}
 
 	if record == nil {
 		logging.Log.Warningf("No record found for zone '%s' and record '%s'", zname, rname)
-		IncrementMetricsResponsesFailedTotal(zname, qtype, "NXDOMAIN")
+		return plug.HandleNameError(ctx, zname, qname, qtype, soa, writer, r)
+	}
 
+	return plug.CreateDNSResponse(qname, qtype, record, ctx, r, writer)
+}
+
+// HandleNameError answers a query for a name that doesn't exist within the zone,
+// or passes it to the next plugin if fallthrough is enabled for the zone.
+func (plug ConsulKVPlugin) HandleNameError(ctx context.Context, zname, qname string, qtype uint16, soa *records.SOARecord, writer dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if plug.IsFallthrough(zname, qname) {
+		logging.Log.Debugf("Name %s not found in zone '%s', passing to next plugin", qname, zname)
+
+		// Answers of other plugins aren't signed with the keys of this zone
+		if w, ok := writer.(*DNSSECResponseWriter); ok {
+			writer = w.ResponseWriter
+		}
+
+		return plugin.NextOrFailure(plug.Name(), plug.Next, ctx, writer, r)
+	}
+
+	IncrementMetricsResponsesFailedTotal(zname, qtype, "NXDOMAIN")
+	return plug.HandleNegativeResponse(ctx, qname, qtype, dns.RcodeNameError, soa, r, writer)
+}
+
+// HandleNegativeResponse answers with NXDOMAIN or NODATA and caches the answer,
+// so it is dropped together with the other answers of the zone once the zone changes.
+func (plug ConsulKVPlugin) HandleNegativeResponse(ctx context.Context, qname string, qtype uint16, rcode int, soa *records.SOARecord, r *dns.Msg, writer dns.ResponseWriter) (int, error) {
+	if plug.Cache != nil {
+		zname, rname := GetZoneAndRecord(plug.Config.Zones, qname)
+
+		msg := PrepareResponseRcode(r, rcode, false)
+		records.AppendSOAToAuthority(msg, qname, soa)
+		plug.Cache.Set(ctx, zname, rname, qtype, msg)
+	}
+
+	if rcode == dns.RcodeNameError {
 		return HandleNXDomain(qname, soa, r, writer)
 	}
 
-	return plug.CreateDNSResponse(qname, qtype, record, ctx, r, writer)
+	return HandleNoData(qname, soa, r, writer)
 }
 
 func (plug ConsulKVPlugin) CreateDNSResponse(qname string, qtype uint16, record *records.Record, ctx context.Context, r *dns.Msg, writer dns.ResponseWriter) (int, error) {
@@ -89,16 +211,56 @@ func (plug ConsulKVPlugin) CreateDNSResponse(qname string, qtype uint16, record
 
 	logging.Log.Debugf("Creating DNS response for %s", qname)
 
-	handled := plug.HandleRecord(ctx, msg, qname, qtype, record)
-	zname, _ := GetZoneAndRecord(plug.Config.Zones, qname)
+	handled, err := plug.HandleRecord(ctx, msg, qname, qtype, record)
+	zname, rname := GetZoneAndRecord(plug.Config.Zones, qname)
+
+	if err != nil {
+		logging.Log.Errorf("Error creating DNS response for %s: %v", qname, err)
+		IncrementMetricsResponsesFailedTotal(zname, qtype, "ERROR")
+
+		if errors.Is(err, errCNAMELoop) || errors.Is(err, errCNAMEDepth) {
+			return HandleError(r, dns.RcodeServerFailure, writer, nil)
+		}
+
+		// Anything else failed to be read from Consul, which must not be answered with NODATA
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+		return plug.HandleConsulError(ctx, zname, writer, r, err)
+	}
 
 	if handled && len(msg.Answer) > 0 {
+		state := request.Request{W: writer, Req: r}
+		plug.AppendAdditionalRecords(ctx, msg, state.Size())
+
+		if plug.Lockdown != nil {
+			plug.Lockdown.Remember(GetView(ctx), msg)
+		}
+
+		if plug.Cache != nil {
+			plug.Cache.Set(ctx, zname, rname, qtype, msg)
+		}
+
 		return SendDNSResponse(zname, qtype, msg, writer)
 	}
 
 	return plug.HandleNoMatchingRecords(qname, qtype, ctx, r, writer)
 }
 
+func (plug ConsulKVPlugin) HandleDNSKEY(zname string, signer *ZoneSigner, state request.Request, writer dns.ResponseWriter, r *dns.Msg) (int, error) {
+	ttl := uint32(3600)
+	if soa, err := plug.GetSOARecord(zname); err == nil && soa != nil {
+		ttl = soa.MINIMUM
+	}
+
+	msg := PrepareResponseReply(r, false)
+	msg.Answer = signer.GetDNSKEYRecords(ttl)
+
+	if state.Do() {
+		msg.Answer = signer.SignSection(msg.Answer)
+	}
+
+	return SendDNSResponse(zname, dns.TypeDNSKEY, msg, writer)
+}
+
 func SendDNSResponse(zname string, qtype uint16, msg *dns.Msg, writer dns.ResponseWriter) (int, error) {
 	logging.Log.Debugf("Sending DNS response with %d answers", len(msg.Answer))
 	err := writer.WriteMsg(msg)
@@ -124,7 +286,7 @@ func (plug ConsulKVPlugin) HandleNoMatchingRecords(qname string, qtype uint16, c
 	logging.Log.Infof("No matching record was found for zone '%s' and record '%s' with code '%s'",
 		zname, rname, dns.TypeToString[qtype])
 
-	soa, err := plug.Consul.GetSOARecordFromConsul(zname, plug.Config.ConsulCache)
+	soa, err := plug.GetSOARecord(zname)
 	if err != nil {
 		logging.Log.Errorf("Error loading SOA record: %v", err)
 
@@ -135,15 +297,35 @@ func (plug ConsulKVPlugin) HandleNoMatchingRecords(qname string, qtype uint16, c
 
 	if soa != nil {
 		IncrementMetricsResponsesFailedTotal(zname, qtype, "NODATA")
-		return HandleNoData(qname, soa, request, writer)
+		return plug.HandleNegativeResponse(ctx, qname, qtype, dns.RcodeSuccess, soa, request, writer)
 	}
 
 	IncrementMetricsResponsesFailedTotal(zname, qtype, "NXDOMAIN")
-	return HandleNXDomain(qname, soa, request, writer)
+	return plug.HandleNegativeResponse(ctx, qname, qtype, dns.RcodeNameError, soa, request, writer)
 }
 
 func (plug *ConsulKVPlugin) UpdateConsulConfig(cfg *ConsulKVConfig) {
+	// Discovered zones are served in addition to the ones listed in the config
+	if plug.Discover != nil {
+		cfg = plug.Discover.MergeConfig(cfg)
+	}
+
+	// Keys are loaded from Consul, so don't hold the lock while waiting for them
+	if plug.DNSSEC != nil {
+		plug.DNSSEC.SyncZones(cfg.Zones)
+	}
+
 	plug.cfgMu.Lock()
 	defer plug.cfgMu.Unlock()
 	plug.Config = cfg
+
+	// TTLs, views and flattening may have changed, so none of the answers can be kept
+	if plug.Cache != nil {
+		plug.Cache.SyncZones(cfg.Zones)
+		plug.Cache.Flush()
+	}
+
+	if plug.Mirror != nil {
+		plug.Mirror.SyncZones(cfg.Zones)
+	}
 }
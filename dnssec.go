@@ -0,0 +1,577 @@
+package consulkv
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+)
+
+const (
+	dnssecSignatureInception  = 3 * time.Hour      // Backdate signatures to cope with clock skew
+	dnssecSignatureValidity   = 8 * 24 * time.Hour // Sign for 8 days
+	dnssecSignatureRefresh    = 2 * 24 * time.Hour // Re-sign once less than 2 days are left
+	dnssecSignatureCacheLimit = 10000
+
+	dnssecKeysWaitTime     = 5 * time.Minute
+	dnssecKeysRetryBackoff = 5 * time.Second
+)
+
+// Types of the answers synthesized for entries that aren't resource records themselves.
+var dnssecSynthesizedTypes = map[string][]uint16{
+	"ALIAS":          {dns.TypeA, dns.TypeAAAA},
+	"CONSUL_SERVICE": {dns.TypeA, dns.TypeAAAA, dns.TypeSRV},
+}
+
+// SigningKey is a DNSKEY together with its private key,
+// loaded from '<kv_prefix>/keys/<zone>/<name>'.
+type SigningKey struct {
+	Key    *dns.DNSKEY
+	Signer crypto.Signer
+	Tag    uint16
+}
+
+type SigningKeyValue struct {
+	Public  string `json:"public"`
+	Private string `json:"private"`
+}
+
+func (key *SigningKey) IsKSK() bool {
+	return key.Key.Flags&dns.SEP != 0
+}
+
+// ZoneSigner signs RRsets for a single zone and caches the signatures.
+type ZoneSigner struct {
+	Zone string
+	Keys []*SigningKey
+
+	mu    sync.Mutex
+	cache map[uint64][]dns.RR
+}
+
+// DNSSEC holds the zone signers of all configured zones that have keys in Consul.
+// '<kv_prefix>/keys/' is watched with a blocking query, so keys can be added and rotated at runtime.
+type DNSSEC struct {
+	consul  *ConsulConfig
+	mu      sync.RWMutex
+	signers map[string]*ZoneSigner
+	syncMu  sync.Mutex
+	zones   []string
+	cancel  context.CancelFunc
+}
+
+func CreateDNSSEC(consul *ConsulConfig) *DNSSEC {
+	return &DNSSEC{
+		consul:  consul,
+		signers: make(map[string]*ZoneSigner),
+	}
+}
+
+// SyncZones (re)loads the signing keys for every zone in the list.
+// Zones without any keys are served unsigned.
+func (dnssec *DNSSEC) SyncZones(zones []string) {
+	dnssec.syncMu.Lock()
+	defer dnssec.syncMu.Unlock()
+
+	dnssec.zones = zones
+	signers := make(map[string]*ZoneSigner, len(zones))
+
+	for _, zone := range zones {
+		keys, err := dnssec.consul.GetSigningKeysFromConsul(zone)
+		if err != nil {
+			logging.Log.Errorf("Error loading DNSSEC keys for zone '%s': %v", zone, err)
+			IncrementMetricsPluginErrorsTotal("DNSSEC_KEY")
+
+			// Keep signing with the keys we already have
+			if signer := dnssec.GetZoneSigner(zone); signer != nil {
+				signers[zone] = signer
+			}
+			continue
+		}
+
+		if len(keys) == 0 {
+			continue
+		}
+
+		if signer := dnssec.GetZoneSigner(zone); signer != nil && signer.hasSameKeys(keys) {
+			signers[zone] = signer
+			continue
+		}
+
+		signers[zone] = &ZoneSigner{
+			Zone:  dns.Fqdn(zone),
+			Keys:  keys,
+			cache: make(map[uint64][]dns.RR),
+		}
+		logging.Log.Infof("Loaded %d DNSSEC keys for zone '%s'", len(keys), zone)
+	}
+
+	dnssec.mu.Lock()
+	defer dnssec.mu.Unlock()
+	dnssec.signers = signers
+}
+
+// Start watches '<kv_prefix>/keys/' and reloads the keys of the synced zones every time they change.
+func (dnssec *DNSSEC) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	dnssec.syncMu.Lock()
+	dnssec.cancel = cancel
+	dnssec.syncMu.Unlock()
+
+	go dnssec.watchKeys(ctx)
+	logging.Log.Infof("Started watching DNSSEC keys at '%s/keys/'", dnssec.consul.KVPrefix)
+}
+
+func (dnssec *DNSSEC) Stop() error {
+	dnssec.syncMu.Lock()
+	defer dnssec.syncMu.Unlock()
+
+	if dnssec.cancel != nil {
+		dnssec.cancel()
+		dnssec.cancel = nil
+	}
+
+	return nil
+}
+
+func (dnssec *DNSSEC) watchKeys(ctx context.Context) {
+	prefix := dnssec.consul.KVPrefix + "/keys/"
+	var index uint64
+
+	for ctx.Err() == nil {
+		options := &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  dnssecKeysWaitTime,
+		}
+
+		_, meta, err := dnssec.consul.Backend.Keys(prefix, "", options.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logging.Log.Errorf("Error watching DNSSEC keys at '%s': %v", prefix, err)
+			IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(dnssecKeysRetryBackoff):
+			}
+			continue
+		}
+
+		if index != 0 && meta.LastIndex == index {
+			continue
+		}
+
+		// The index went backwards, e.g. after a snapshot restore; start over.
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+
+		index = meta.LastIndex
+
+		dnssec.syncMu.Lock()
+		zones := dnssec.zones
+		dnssec.syncMu.Unlock()
+
+		dnssec.SyncZones(zones)
+	}
+}
+
+func (dnssec *DNSSEC) GetZoneSigner(zone string) *ZoneSigner {
+	dnssec.mu.RLock()
+	defer dnssec.mu.RUnlock()
+
+	return dnssec.signers[zone]
+}
+
+func (consul ConsulConfig) GetSigningKeysFromConsul(zone string) ([]*SigningKey, error) {
+	pairs, err := consul.GetConsulKeyValues("keys/"+zone+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*SigningKey, 0, len(pairs))
+	for _, kv := range pairs {
+		if strings.HasSuffix(kv.Key, "/") {
+			continue
+		}
+
+		var value SigningKeyValue
+		if err := json.Unmarshal(kv.Value, &value); err != nil {
+			return nil, fmt.Errorf("error converting json for key '%s': %w", kv.Key, err)
+		}
+
+		key, err := ParseSigningKey(zone, value)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key '%s': %w", kv.Key, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// ParseSigningKey parses a key pair in the format written by 'dnssec-keygen',
+// i.e. the DNSKEY record of the '.key' file and the content of the '.private' file.
+func ParseSigningKey(zone string, value SigningKeyValue) (*SigningKey, error) {
+	rr, err := dns.NewRR(value.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("public key is not a DNSKEY record")
+	}
+
+	if !strings.EqualFold(dnskey.Hdr.Name, dns.Fqdn(zone)) {
+		return nil, fmt.Errorf("DNSKEY owner '%s' doesn't match zone '%s'", dnskey.Hdr.Name, zone)
+	}
+
+	private, err := dnskey.ReadPrivateKey(strings.NewReader(value.Private), zone)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key can't be used for signing")
+	}
+
+	return &SigningKey{
+		Key:    dnskey,
+		Signer: signer,
+		Tag:    dnskey.KeyTag(),
+	}, nil
+}
+
+func (signer *ZoneSigner) hasSameKeys(keys []*SigningKey) bool {
+	if len(signer.Keys) != len(keys) {
+		return false
+	}
+
+	for i := range keys {
+		if signer.Keys[i].Key.String() != keys[i].Key.String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetDNSKEYRecords returns the DNSKEY RRset served at the zone apex.
+func (signer *ZoneSigner) GetDNSKEYRecords(ttl uint32) []dns.RR {
+	rrs := make([]dns.RR, 0, len(signer.Keys))
+	for _, key := range signer.Keys {
+		rr := dns.Copy(key.Key).(*dns.DNSKEY)
+		rr.Hdr.Name = signer.Zone
+		rr.Hdr.Ttl = ttl
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+// Sign returns the RRSIGs covering the RRset; DNSKEY RRsets are signed with
+// the KSKs, everything else with the ZSKs. If a zone only has KSKs (or only ZSKs),
+// those keys are used for everything.
+func (signer *ZoneSigner) Sign(rrset []dns.RR) ([]dns.RR, error) {
+	if len(rrset) == 0 {
+		return nil, nil
+	}
+
+	key := hashRRset(rrset)
+	now := time.Now().UTC()
+
+	signer.mu.Lock()
+	sigs, exists := signer.cache[key]
+	signer.mu.Unlock()
+
+	if exists && isSignatureValid(sigs, now.Add(dnssecSignatureRefresh)) {
+		return sigs, nil
+	}
+
+	ksk := rrset[0].Header().Rrtype == dns.TypeDNSKEY
+	keys := signer.getKeys(ksk)
+
+	sigs = make([]dns.RR, 0, len(keys))
+	for _, k := range keys {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.Key.Algorithm,
+			KeyTag:     k.Tag,
+			SignerName: signer.Zone,
+			Inception:  uint32(now.Add(-dnssecSignatureInception).Unix()),
+			Expiration: uint32(now.Add(dnssecSignatureValidity).Unix()),
+		}
+
+		if err := sig.Sign(k.Signer, rrset); err != nil {
+			return nil, err
+		}
+
+		sigs = append(sigs, sig)
+	}
+
+	signer.mu.Lock()
+	defer signer.mu.Unlock()
+
+	if len(signer.cache) >= dnssecSignatureCacheLimit {
+		signer.cache = make(map[uint64][]dns.RR)
+	}
+	signer.cache[key] = sigs
+
+	return sigs, nil
+}
+
+func (signer *ZoneSigner) getKeys(ksk bool) []*SigningKey {
+	keys := make([]*SigningKey, 0, len(signer.Keys))
+	for _, key := range signer.Keys {
+		if key.IsKSK() == ksk {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return signer.Keys
+	}
+
+	return keys
+}
+
+// SignSection appends signatures for every RRset in the section that belongs to the zone.
+func (signer *ZoneSigner) SignSection(section []dns.RR) []dns.RR {
+	signed := section
+	for _, rrset := range splitRRsets(section) {
+		if !dns.IsSubDomain(signer.Zone, rrset[0].Header().Name) {
+			continue
+		}
+
+		sigs, err := signer.Sign(rrset)
+		if err != nil {
+			logging.Log.Errorf("Error signing %s RRset for '%s': %v", dns.TypeToString[rrset[0].Header().Rrtype], rrset[0].Header().Name, err)
+			IncrementMetricsPluginErrorsTotal("DNSSEC_SIGN")
+			continue
+		}
+
+		signed = append(signed, sigs...)
+	}
+
+	return signed
+}
+
+// CreateNSEC returns a minimally covering NSEC record for the name,
+// following the "black lies" approach (draft-valsorda-dnsop-black-lies).
+func (signer *ZoneSigner) CreateNSEC(qname string, ttl uint32, types []uint16) *dns.NSEC {
+	owner := dns.Fqdn(strings.ToLower(qname))
+
+	bitmap := append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	if owner == strings.ToLower(signer.Zone) {
+		bitmap = append(bitmap, dns.TypeDNSKEY)
+	}
+
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + owner,
+		TypeBitMap: sortTypeBitmap(bitmap),
+	}
+}
+
+func sortTypeBitmap(types []uint16) []uint16 {
+	seen := make(map[uint16]bool, len(types))
+	bitmap := make([]uint16, 0, len(types))
+
+	for _, t := range types {
+		if !seen[t] {
+			seen[t] = true
+			bitmap = append(bitmap, t)
+		}
+	}
+
+	for i := 1; i < len(bitmap); i++ {
+		for j := i; j > 0 && bitmap[j-1] > bitmap[j]; j-- {
+			bitmap[j-1], bitmap[j] = bitmap[j], bitmap[j-1]
+		}
+	}
+
+	return bitmap
+}
+
+func isSignatureValid(sigs []dns.RR, at time.Time) bool {
+	for _, rr := range sigs {
+		if !rr.(*dns.RRSIG).ValidityPeriod(at) {
+			return false
+		}
+	}
+
+	return len(sigs) > 0
+}
+
+func splitRRsets(section []dns.RR) [][]dns.RR {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+
+	index := make(map[rrsetKey]int)
+	rrsets := make([][]dns.RR, 0)
+
+	for _, rr := range section {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		key := rrsetKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+		if i, exists := index[key]; exists {
+			rrsets[i] = append(rrsets[i], rr)
+			continue
+		}
+
+		index[key] = len(rrsets)
+		rrsets = append(rrsets, []dns.RR{rr})
+	}
+
+	return rrsets
+}
+
+func hashRRset(rrset []dns.RR) uint64 {
+	h := fnv.New64()
+	for _, rr := range rrset {
+		io.WriteString(h, rr.String())
+	}
+
+	return h.Sum64()
+}
+
+// DNSSECResponseWriter signs every response of a zone before it is written,
+// turning NXDOMAIN and NODATA responses into signed NSEC denials.
+type DNSSECResponseWriter struct {
+	dns.ResponseWriter
+	ctx    context.Context
+	plug   ConsulKVPlugin
+	signer *ZoneSigner
+	zname  string
+	rname  string
+}
+
+func (w *DNSSECResponseWriter) WriteMsg(res *dns.Msg) error {
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return w.ResponseWriter.WriteMsg(res)
+	}
+
+	if len(res.Answer) == 0 && len(res.Ns) > 0 && res.Ns[0].Header().Rrtype == dns.TypeSOA {
+		w.signDenial(res)
+		return w.ResponseWriter.WriteMsg(res)
+	}
+
+	if !res.Authoritative && len(res.Answer) == 0 && len(res.Ns) > 0 && res.Ns[0].Header().Rrtype == dns.TypeNS {
+		w.signReferral(res)
+		return w.ResponseWriter.WriteMsg(res)
+	}
+
+	res.Answer = w.signer.SignSection(res.Answer)
+	res.Ns = w.signer.SignSection(res.Ns)
+	res.Extra = w.signer.SignSection(res.Extra)
+
+	return w.ResponseWriter.WriteMsg(res)
+}
+
+func (w *DNSSECResponseWriter) signDenial(res *dns.Msg) {
+	qname := res.Question[0].Name
+	qtype := res.Question[0].Qtype
+	ttl := res.Ns[0].Header().Ttl
+
+	// Black lies: every NXDOMAIN becomes a NODATA response for a name without any types
+	types := []uint16{}
+	if res.Rcode == dns.RcodeSuccess {
+		types = w.getExistingTypes(qtype)
+	}
+
+	res.Rcode = dns.RcodeSuccess
+	res.Ns = w.signer.SignSection(res.Ns)
+
+	nsec := w.signer.CreateNSEC(qname, ttl, types)
+	sigs, err := w.signer.Sign([]dns.RR{nsec})
+	if err != nil {
+		logging.Log.Errorf("Error signing NSEC record for '%s': %v", qname, err)
+		IncrementMetricsPluginErrorsTotal("DNSSEC_SIGN")
+		return
+	}
+
+	if qtype == dns.TypeNSEC {
+		res.Answer = append([]dns.RR{nsec}, sigs...)
+		res.Ns = nil
+		return
+	}
+
+	res.Ns = append(res.Ns, nsec)
+	res.Ns = append(res.Ns, sigs...)
+}
+
+// signReferral signs the DS records of a delegation, or proves their absence with a NSEC record.
+// NS records and glue at the delegation point aren't authoritative and stay unsigned.
+func (w *DNSSECResponseWriter) signReferral(res *dns.Msg) {
+	cut := res.Ns[0].Header().Name
+	ttl := res.Ns[0].Header().Ttl
+
+	ds := []dns.RR{}
+	for _, rr := range res.Ns {
+		if rr.Header().Rrtype == dns.TypeDS {
+			ds = append(ds, rr)
+		}
+	}
+
+	if len(ds) == 0 {
+		nsec := w.signer.CreateNSEC(cut, ttl, []uint16{dns.TypeNS})
+		res.Ns = append(res.Ns, nsec)
+		ds = []dns.RR{nsec}
+	}
+
+	sigs, err := w.signer.Sign(ds)
+	if err != nil {
+		logging.Log.Errorf("Error signing referral for '%s': %v", cut, err)
+		IncrementMetricsPluginErrorsTotal("DNSSEC_SIGN")
+		return
+	}
+
+	res.Ns = append(res.Ns, sigs...)
+}
+
+// getExistingTypes returns the types stored for the queried name, except the queried type.
+func (w *DNSSECResponseWriter) getExistingTypes(qtype uint16) []uint16 {
+	record, err := w.plug.GetZoneRecord(w.ctx, w.zname, w.rname)
+	if err != nil || record == nil {
+		return []uint16{}
+	}
+
+	types := make([]uint16, 0, len(record.Records))
+	for _, rec := range record.Records {
+		if t, exists := dns.StringToType[rec.Type]; exists && t != qtype {
+			types = append(types, t)
+		}
+
+		// Entries resolved at query time are served as the types they expand into
+		for _, t := range dnssecSynthesizedTypes[rec.Type] {
+			if t != qtype {
+				types = append(types, t)
+			}
+		}
+	}
+
+	return types
+}
@@ -0,0 +1,178 @@
+package consulkv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+)
+
+func CreateTestSigningKey(tst *testing.T, zone string, flags uint16) SigningKeyValue {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	private, err := key.Generate(256)
+	if err != nil {
+		tst.Fatalf("Unable to generate key: %v", err)
+	}
+
+	return SigningKeyValue{
+		Public:  key.String(),
+		Private: key.PrivateKeyString(private.(*ecdsa.PrivateKey)),
+	}
+}
+
+func TestZoneSignerSign(tst *testing.T) {
+	ksk, err := ParseSigningKey("example.com", CreateTestSigningKey(tst, "example.com", dns.ZONE|dns.SEP))
+	if err != nil {
+		tst.Fatalf("Unable to parse KSK: %v", err)
+	}
+
+	zsk, err := ParseSigningKey("example.com", CreateTestSigningKey(tst, "example.com", dns.ZONE))
+	if err != nil {
+		tst.Fatalf("Unable to parse ZSK: %v", err)
+	}
+
+	signer := &ZoneSigner{
+		Zone:  "example.com.",
+		Keys:  []*SigningKey{ksk, zsk},
+		cache: make(map[uint64][]dns.RR),
+	}
+
+	a, _ := dns.NewRR("www.example.com. 3600 IN A 192.168.0.3")
+	sigs, err := signer.Sign([]dns.RR{a})
+	if err != nil || len(sigs) != 1 {
+		tst.Fatalf("Expected one signature, but got %v (error: %v)", sigs, err)
+	}
+
+	sig := sigs[0].(*dns.RRSIG)
+	if sig.KeyTag != zsk.Tag {
+		tst.Errorf("Expected A RRset to be signed by the ZSK")
+	}
+
+	if err := sig.Verify(zsk.Key, []dns.RR{a}); err != nil {
+		tst.Errorf("Expected valid signature, but got: %v", err)
+	}
+
+	cached, _ := signer.Sign([]dns.RR{a})
+	if cached[0] != sigs[0] {
+		tst.Errorf("Expected signature to be served from the cache")
+	}
+
+	dnskeys := signer.GetDNSKEYRecords(3600)
+	sigs, err = signer.Sign(dnskeys)
+	if err != nil || len(sigs) != 1 || sigs[0].(*dns.RRSIG).KeyTag != ksk.Tag {
+		tst.Fatalf("Expected DNSKEY RRset to be signed by the KSK, but got %v (error: %v)", sigs, err)
+	}
+
+	if err := sigs[0].(*dns.RRSIG).Verify(ksk.Key, dnskeys); err != nil {
+		tst.Errorf("Expected valid DNSKEY signature, but got: %v", err)
+	}
+
+	outside, _ := dns.NewRR("www.example.org. 3600 IN A 192.168.0.3")
+	if section := signer.SignSection([]dns.RR{outside}); len(section) != 1 {
+		tst.Errorf("Expected records outside of the zone to stay unsigned, but got %v", section)
+	}
+}
+
+func TestZoneSignerNSEC(tst *testing.T) {
+	signer := &ZoneSigner{Zone: "example.com."}
+
+	nsec := signer.CreateNSEC("Missing.example.com.", 300, nil)
+	if nsec.NextDomain != "\\000.missing.example.com." {
+		tst.Errorf("Expected minimally covering next domain, but got %s", nsec.NextDomain)
+	}
+
+	if len(nsec.TypeBitMap) != 2 || nsec.TypeBitMap[0] != dns.TypeRRSIG || nsec.TypeBitMap[1] != dns.TypeNSEC {
+		tst.Errorf("Expected bitmap with RRSIG and NSEC, but got %v", nsec.TypeBitMap)
+	}
+
+	nsec = signer.CreateNSEC("example.com.", 300, []uint16{dns.TypeTXT, dns.TypeA, dns.TypeA})
+	expected := []uint16{dns.TypeA, dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}
+	if len(nsec.TypeBitMap) != len(expected) {
+		tst.Fatalf("Expected bitmap %v, but got %v", expected, nsec.TypeBitMap)
+	}
+
+	for i := range expected {
+		if nsec.TypeBitMap[i] != expected[i] {
+			tst.Errorf("Expected bitmap %v, but got %v", expected, nsec.TypeBitMap)
+			break
+		}
+	}
+}
+
+func TestDNSSECExistingTypes(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"www": `{"records":[{"type":"ALIAS","value":"lb.example.net"},{"type":"TXT","value":["text"]}]}`,
+			"api": `{"records":[{"type":"CONSUL_SERVICE","value":{"service":"api"}}]}`,
+		},
+	})
+
+	tests := []struct {
+		rname    string
+		qtype    uint16
+		expected []uint16
+	}{
+		{"www", dns.TypeMX, []uint16{dns.TypeTXT, dns.TypeA, dns.TypeAAAA}},
+		{"www", dns.TypeA, []uint16{dns.TypeTXT, dns.TypeAAAA}},
+		{"api", dns.TypeTXT, []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV}},
+	}
+
+	for _, tc := range tests {
+		w := &DNSSECResponseWriter{ctx: context.Background(), plug: *plug, zname: "example.com", rname: tc.rname}
+
+		types := w.getExistingTypes(tc.qtype)
+		slices.Sort(types)
+		slices.Sort(tc.expected)
+
+		if !slices.Equal(types, tc.expected) {
+			tst.Errorf("Expected types %v for '%s', got %v", tc.expected, tc.rname, types)
+		}
+	}
+}
+
+func TestDNSSECKeyWatch(tst *testing.T) {
+	backend := CreateMemoryBackend()
+	dnssec := CreateDNSSEC(&ConsulConfig{KVPrefix: "dns", Backend: backend})
+	dnssec.SyncZones([]string{"example.com"})
+
+	dnssec.Start()
+	defer dnssec.Stop()
+
+	put := func(name string, value SigningKeyValue) {
+		raw, _ := json.Marshal(value)
+		backend.Put("dns/keys/example.com/"+name, raw)
+	}
+
+	expect := func(keys int) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if signer := dnssec.GetZoneSigner("example.com"); signer != nil && len(signer.Keys) == keys {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		tst.Fatalf("Expected %d keys for 'example.com' within 1s, got %v", keys, dnssec.GetZoneSigner("example.com"))
+	}
+
+	// Keys are picked up without a change of the config
+	put("ksk", CreateTestSigningKey(tst, "example.com", dns.ZONE|dns.SEP))
+	expect(1)
+
+	put("zsk", CreateTestSigningKey(tst, "example.com", dns.ZONE))
+	expect(2)
+
+	backend.Txn(api.KVTxnOps{{Verb: api.KVDelete, Key: "dns/keys/example.com/zsk"}})
+	expect(1)
+}
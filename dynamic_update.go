@@ -0,0 +1,586 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+const dynamicUpdateAttempts = 3
+
+// TSIGKey is loaded from '<kv_prefix>/tsig/<name>' and
+// authorizes dynamic updates for the listed zones.
+type TSIGKey struct {
+	Name      string   `json:"-"`
+	Algorithm string   `json:"algorithm"`
+	Secret    string   `json:"secret"`
+	Zones     []string `json:"zones"`
+}
+
+func (key *TSIGKey) IsAllowed(zone string) bool {
+	for _, z := range key.Zones {
+		if strings.EqualFold(dns.Fqdn(z), dns.Fqdn(zone)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (consul ConsulConfig) GetTSIGKeysFromConsul() (map[string]*TSIGKey, error) {
+	pairs, err := consul.GetConsulKeyValues("tsig/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*TSIGKey, len(pairs))
+	for _, kv := range pairs {
+		if strings.HasSuffix(kv.Key, "/") {
+			continue
+		}
+
+		var key TSIGKey
+		if err := json.Unmarshal(kv.Value, &key); err != nil {
+			return nil, fmt.Errorf("error converting json for key '%s': %w", kv.Key, err)
+		}
+
+		if key.Algorithm == "" {
+			key.Algorithm = dns.HmacSHA256
+		}
+
+		key.Name = dns.CanonicalName(path.Base(kv.Key))
+		key.Algorithm = dns.CanonicalName(key.Algorithm)
+		keys[key.Name] = &key
+	}
+
+	return keys, nil
+}
+
+// errUpdateConflict is returned if a record was modified between reading and writing it.
+var errUpdateConflict = fmt.Errorf("record was modified concurrently")
+
+// updateRecord is the state of a single name while an update is applied.
+type updateRecord struct {
+	owner   string
+	record  *records.Record
+	index   uint64
+	changed bool
+}
+
+func (u *updateRecord) inUse() bool {
+	return u.record != nil && len(u.record.Records) > 0
+}
+
+func (u *updateRecord) rrset(rtype uint16) ([]dns.RR, error) {
+	if u.record == nil {
+		return nil, nil
+	}
+
+	return u.record.GetRRset(u.owner, rtype)
+}
+
+func (u *updateRecord) hasType(rtype string) bool {
+	if u.record == nil {
+		return false
+	}
+
+	for _, rec := range u.record.Records {
+		if rec.Type == rtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *updateRecord) setRRset(rtype uint16, rrs []dns.RR) error {
+	if u.record == nil {
+		u.record = &records.Record{}
+	}
+
+	u.changed = true
+	return u.record.SetRRset(rtype, rrs)
+}
+
+// HandleUpdate processes a dynamic update (RFC 2136) for a zone managed by this plugin.
+// Updates have to be signed with a TSIG key allowed for the zone; changes are written
+// back into Consul with check-and-set, together with an increased SOA serial.
+func (plug ConsulKVPlugin) HandleUpdate(zname, rname string, writer dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return plug.SendUpdateResponse(zname, writer, r, dns.RcodeFormatError)
+	}
+
+	// The zone section has to name the zone itself, not a name within it (RFC 2136 section 3.1.1)
+	if rname != "@" {
+		logging.Log.Warningf("Refused dynamic update for '%s', zone '%s' is not authoritative for it", r.Question[0].Name, zname)
+		return plug.SendUpdateResponse(zname, writer, r, dns.RcodeNotAuth)
+	}
+
+	if !plug.Consul.Update {
+		logging.Log.Warningf("Refused dynamic update for zone '%s', updates are disabled", zname)
+		return plug.SendUpdateResponse(zname, writer, r, dns.RcodeRefused)
+	}
+
+	if err := plug.AuthenticateUpdate(zname, writer, r); err != nil {
+		logging.Log.Warningf("Refused dynamic update for zone '%s' from %s: %v", zname, writer.RemoteAddr(), err)
+		return plug.SendUpdateResponse(zname, writer, r, dns.RcodeNotAuth)
+	}
+
+	for attempt := 1; attempt <= dynamicUpdateAttempts; attempt++ {
+		rcode, err := plug.ApplyUpdate(zname, r)
+		if err == errUpdateConflict {
+			logging.Log.Debugf("Retrying dynamic update for zone '%s' after conflict (attempt %d)", zname, attempt)
+			continue
+		}
+
+		if err != nil {
+			logging.Log.Errorf("Error applying dynamic update for zone '%s': %v", zname, err)
+			IncrementMetricsPluginErrorsTotal("CONSUL_PUT")
+
+			return plug.SendUpdateResponse(zname, writer, r, dns.RcodeServerFailure)
+		}
+
+		return plug.SendUpdateResponse(zname, writer, r, rcode)
+	}
+
+	logging.Log.Errorf("Giving up dynamic update for zone '%s' after %d conflicts", zname, dynamicUpdateAttempts)
+	return plug.SendUpdateResponse(zname, writer, r, dns.RcodeServerFailure)
+}
+
+func (plug ConsulKVPlugin) AuthenticateUpdate(zname string, writer dns.ResponseWriter, r *dns.Msg) error {
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return fmt.Errorf("update is not signed")
+	}
+
+	if err := writer.TsigStatus(); err != nil {
+		return fmt.Errorf("invalid TSIG signature: %w", err)
+	}
+
+	key, exists := plug.TSIGKeys[dns.CanonicalName(tsig.Hdr.Name)]
+	if !exists || !key.IsAllowed(zname) {
+		return fmt.Errorf("key '%s' is not allowed to update zone", tsig.Hdr.Name)
+	}
+
+	if dns.CanonicalName(tsig.Algorithm) != key.Algorithm {
+		return fmt.Errorf("key '%s' is not configured for algorithm '%s'", tsig.Hdr.Name, tsig.Algorithm)
+	}
+
+	return nil
+}
+
+func (plug ConsulKVPlugin) SendUpdateResponse(zname string, writer dns.ResponseWriter, r *dns.Msg, rcode int) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+
+	if tsig := r.IsTsig(); tsig != nil && writer.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+
+	IncrementMetricsDynamicUpdatesTotal(zname, dns.RcodeToString[rcode])
+
+	if err := writer.WriteMsg(m); err != nil {
+		logging.Log.Errorf("Error writing UPDATE response: %v", err)
+		IncrementMetricsPluginErrorsTotal("WRITE_MSG")
+
+		return dns.RcodeServerFailure, err
+	}
+
+	return rcode, nil
+}
+
+// ApplyUpdate evaluates the prerequisites against the current values in Consul
+// and applies the update section (RFC 2136 section 3.2 to 3.4).
+func (plug ConsulKVPlugin) ApplyUpdate(zname string, r *dns.Msg) (int, error) {
+	zclass := r.Question[0].Qclass
+	names := map[string]*updateRecord{}
+
+	load := func(rr dns.RR) (*updateRecord, int, error) {
+		z, rname := GetZoneAndRecord([]string{zname}, rr.Header().Name)
+		if z == "" {
+			return nil, dns.RcodeNotZone, nil
+		}
+
+		if u, exists := names[rname]; exists {
+			return u, dns.RcodeSuccess, nil
+		}
+
+		record, index, err := plug.Consul.GetZoneRecordForUpdateFromConsul(zname, rname)
+		if err != nil {
+			return nil, dns.RcodeServerFailure, err
+		}
+
+		if record != nil {
+			record = record.Clone()
+		}
+
+		u := &updateRecord{owner: GetRecordOwnerName(zname, rname), record: record, index: index}
+		names[rname] = u
+
+		return u, dns.RcodeSuccess, nil
+	}
+
+	// Prerequisite section (RFC 2136 section 3.2)
+	required := map[string][]dns.RR{}
+	for _, rr := range r.Answer {
+		hdr := rr.Header()
+
+		u, rcode, err := load(rr)
+		if rcode != dns.RcodeSuccess {
+			return rcode, err
+		}
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, nil
+			}
+
+			if hdr.Rrtype == dns.TypeANY {
+				if !u.inUse() {
+					return dns.RcodeNameError, nil
+				}
+			} else if !u.hasType(dns.TypeToString[hdr.Rrtype]) {
+				return dns.RcodeNXRrset, nil
+			}
+
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, nil
+			}
+
+			if hdr.Rrtype == dns.TypeANY {
+				if u.inUse() {
+					return dns.RcodeYXDomain, nil
+				}
+			} else if u.hasType(dns.TypeToString[hdr.Rrtype]) {
+				return dns.RcodeYXRrset, nil
+			}
+
+		case zclass:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError, nil
+			}
+
+			key := dns.CanonicalName(hdr.Name) + "/" + dns.TypeToString[hdr.Rrtype]
+			required[key] = append(required[key], rr)
+
+		default:
+			return dns.RcodeFormatError, nil
+		}
+	}
+
+	for _, rrs := range required {
+		u, _, _ := load(rrs[0])
+
+		existing, err := u.rrset(rrs[0].Header().Rrtype)
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+
+		if !isSameRRset(existing, rrs) {
+			return dns.RcodeNXRrset, nil
+		}
+	}
+
+	// Update section prescan (RFC 2136 section 3.4.1)
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+
+		if _, rcode, err := load(rr); rcode != dns.RcodeSuccess {
+			return rcode, err
+		}
+
+		switch hdr.Class {
+		case zclass:
+			switch hdr.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError, nil
+			}
+
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError, nil
+			}
+
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError, nil
+			}
+
+		default:
+			return dns.RcodeFormatError, nil
+		}
+	}
+
+	// Update section (RFC 2136 section 3.4.2)
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		_, rname := GetZoneAndRecord([]string{zname}, hdr.Name)
+		u := names[rname]
+
+		var err error
+		switch hdr.Class {
+		case zclass:
+			err = applyUpdateAdd(u, rname == "@", rr)
+		case dns.ClassANY:
+			err = applyUpdateDeleteRRset(u, rname == "@", hdr.Rrtype)
+		case dns.ClassNONE:
+			err = applyUpdateDeleteRR(u, rname == "@", rr)
+		}
+
+		if err != nil {
+			logging.Log.Warningf("Refused dynamic update of '%s' in zone '%s': %v", hdr.Name, zname, err)
+			return dns.RcodeRefused, nil
+		}
+	}
+
+	writes := []ZoneRecordWrite{}
+	for rname, u := range names {
+		if u.changed {
+			writes = append(writes, ZoneRecordWrite{Name: rname, Record: u.record, ModifyIndex: u.index})
+		}
+	}
+
+	if len(writes) == 0 {
+		return dns.RcodeSuccess, nil
+	}
+
+	if err := plug.bumpUpdateSerial(zname, names, &writes); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+
+	for i := range writes {
+		if writes[i].Record != nil && len(writes[i].Record.Records) == 0 {
+			writes[i].Record = nil
+		}
+	}
+
+	ok, err := plug.Consul.WriteZoneRecordsToConsul(zname, writes)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+
+	if !ok {
+		return dns.RcodeServerFailure, errUpdateConflict
+	}
+
+	logging.Log.Infof("Applied dynamic update with %d changes to zone '%s'", len(writes), zname)
+	return dns.RcodeSuccess, nil
+}
+
+// bumpUpdateSerial increases the SOA serial of the zone as part of the same transaction.
+// Zones without a SOA record in '@' are served with the default SOA, so it is written
+// into '@' with an increased serial to let secondaries notice the change.
+func (plug ConsulKVPlugin) bumpUpdateSerial(zname string, names map[string]*updateRecord, writes *[]ZoneRecordWrite) error {
+	apex, exists := names["@"]
+	if !exists {
+		record, index, err := plug.Consul.GetZoneRecordForUpdateFromConsul(zname, "@")
+		if err != nil {
+			return err
+		}
+
+		if record != nil {
+			record = record.Clone()
+		}
+
+		apex = &updateRecord{record: record, index: index}
+	}
+
+	if apex.record == nil {
+		// The apex itself is being deleted
+		if apex.changed {
+			return nil
+		}
+
+		apex.record = &records.Record{}
+	}
+
+	bumped, err := records.BumpSOASerial(apex.record)
+	if err != nil {
+		return err
+	}
+
+	if !bumped {
+		soa := GetDefaultSOA(zname)
+		soa.SERIAL++
+
+		value, err := json.Marshal(soa)
+		if err != nil {
+			return err
+		}
+
+		apex.record.Records = append(apex.record.Records, records.RecordEntry{Type: "SOA", Value: value})
+	}
+
+	if !apex.changed {
+		apex.changed = true
+		*writes = append(*writes, ZoneRecordWrite{Name: "@", Record: apex.record, ModifyIndex: apex.index})
+	}
+
+	return nil
+}
+
+func applyUpdateAdd(u *updateRecord, apex bool, rr dns.RR) error {
+	rtype := rr.Header().Rrtype
+
+	if rtype == dns.TypeSOA {
+		if !apex {
+			return fmt.Errorf("SOA record is only allowed at the zone apex")
+		}
+
+		existing, err := u.rrset(dns.TypeSOA)
+		if err != nil {
+			return err
+		}
+
+		// Replace the SOA only if the serial is newer (RFC 2136 section 3.4.2.2)
+		if len(existing) > 0 && !isSerialLess(existing[0].(*dns.SOA).Serial, rr.(*dns.SOA).Serial) {
+			return nil
+		}
+
+		return u.setRRset(dns.TypeSOA, []dns.RR{rr})
+	}
+
+	if rtype == dns.TypeCNAME {
+		for _, rec := range u.recordTypes() {
+			if rec != "CNAME" {
+				// CNAME can't coexist with other data, ignore it silently
+				return nil
+			}
+		}
+
+		return u.setRRset(dns.TypeCNAME, []dns.RR{rr})
+	}
+
+	if u.hasType("CNAME") {
+		return nil
+	}
+
+	existing, err := u.rrset(rtype)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range existing {
+		if dns.IsDuplicate(e, rr) {
+			return nil
+		}
+	}
+
+	return u.setRRset(rtype, append(existing, rr))
+}
+
+func applyUpdateDeleteRRset(u *updateRecord, apex bool, rtype uint16) error {
+	if !u.inUse() {
+		return nil
+	}
+
+	if rtype != dns.TypeANY {
+		if apex && (rtype == dns.TypeSOA || rtype == dns.TypeNS) {
+			return nil
+		}
+
+		if !u.hasType(dns.TypeToString[rtype]) {
+			return nil
+		}
+
+		return u.setRRset(rtype, nil)
+	}
+
+	kept := make([]records.RecordEntry, 0, len(u.record.Records))
+	for _, rec := range u.record.Records {
+		if apex && (rec.Type == "SOA" || rec.Type == "NS") {
+			kept = append(kept, rec)
+		}
+	}
+
+	if len(kept) != len(u.record.Records) {
+		u.record.Records = kept
+		u.changed = true
+	}
+
+	return nil
+}
+
+func applyUpdateDeleteRR(u *updateRecord, apex bool, rr dns.RR) error {
+	rtype := rr.Header().Rrtype
+	if rtype == dns.TypeSOA {
+		return nil
+	}
+
+	existing, err := u.rrset(rtype)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]dns.RR, 0, len(existing))
+	for _, e := range existing {
+		if !isSameRecord(e, rr) {
+			kept = append(kept, e)
+		}
+	}
+
+	if len(kept) == len(existing) {
+		return nil
+	}
+
+	// The last NS record at the zone apex can't be deleted (RFC 2136 section 3.4.2.4)
+	if apex && rtype == dns.TypeNS && len(kept) == 0 {
+		return nil
+	}
+
+	return u.setRRset(rtype, kept)
+}
+
+func (u *updateRecord) recordTypes() []string {
+	if u.record == nil {
+		return nil
+	}
+
+	types := make([]string, 0, len(u.record.Records))
+	for _, rec := range u.record.Records {
+		types = append(types, rec.Type)
+	}
+
+	return types
+}
+
+// isSameRecord compares two records ignoring their TTL and class.
+func isSameRecord(a, b dns.RR) bool {
+	a = dns.Copy(a)
+	b = dns.Copy(b)
+	a.Header().Class, b.Header().Class = dns.ClassINET, dns.ClassINET
+	a.Header().Ttl, b.Header().Ttl = 0, 0
+
+	return dns.IsDuplicate(a, b)
+}
+
+// isSameRRset compares two RRsets ignoring order and TTLs.
+func isSameRRset(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, x := range b {
+		found := false
+		for _, y := range a {
+			if isSameRecord(x, y) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,237 @@
+package consulkv
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+func CreateTestUpdateRecord(tst *testing.T, owner string, value string) *updateRecord {
+	var record records.Record
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		tst.Fatalf("Unable to parse record: %v", err)
+	}
+
+	return &updateRecord{owner: owner, record: &record}
+}
+
+func TestApplyUpdate(tst *testing.T) {
+	apex := `{"ttl":3600,"records":[` +
+		`{"type":"SOA","value":{"mname":"ns1.example.com","rname":"admin.example.com","serial":10,"refresh":3600,"retry":600,"expire":86400,"minimum":300}},` +
+		`{"type":"NS","value":["ns1.example.com"]}]}`
+	host := `{"ttl":300,"records":[{"type":"A","value":["192.168.0.1","192.168.0.2"]},{"type":"TXT","value":["v=spf1 -all"]}]}`
+
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			tst.Fatalf("Unable to parse '%s': %v", s, err)
+		}
+		return r
+	}
+
+	tst.Run("Add A record", func(t *testing.T) {
+		u := CreateTestUpdateRecord(t, "www.example.com.", host)
+		if err := applyUpdateAdd(u, false, rr("www.example.com. 300 IN A 192.168.0.3")); err != nil {
+			t.Fatal(err)
+		}
+
+		rrs, _ := u.rrset(dns.TypeA)
+		if !u.changed || len(rrs) != 3 {
+			t.Errorf("Expected 3 A records, got %d", len(rrs))
+		}
+	})
+
+	tst.Run("Add duplicate", func(t *testing.T) {
+		u := CreateTestUpdateRecord(t, "www.example.com.", host)
+		if err := applyUpdateAdd(u, false, rr("www.example.com. 300 IN A 192.168.0.1")); err != nil {
+			t.Fatal(err)
+		}
+
+		if u.changed {
+			t.Errorf("Expected duplicate record to be ignored")
+		}
+	})
+
+	tst.Run("CNAME conflicts with data", func(t *testing.T) {
+		u := CreateTestUpdateRecord(t, "www.example.com.", host)
+		if err := applyUpdateAdd(u, false, rr("www.example.com. 300 IN CNAME other.example.com.")); err != nil {
+			t.Fatal(err)
+		}
+
+		if u.changed || u.hasType("CNAME") {
+			t.Errorf("Expected CNAME to be ignored")
+		}
+	})
+
+	tst.Run("Delete single RR", func(t *testing.T) {
+		u := CreateTestUpdateRecord(t, "www.example.com.", host)
+		if err := applyUpdateDeleteRR(u, false, rr("www.example.com. 0 NONE A 192.168.0.2")); err != nil {
+			t.Fatal(err)
+		}
+
+		rrs, _ := u.rrset(dns.TypeA)
+		if len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "192.168.0.1" {
+			t.Errorf("Expected only 192.168.0.1 to remain, got %v", rrs)
+		}
+	})
+
+	tst.Run("Delete all RRsets", func(t *testing.T) {
+		u := CreateTestUpdateRecord(t, "www.example.com.", host)
+		if err := applyUpdateDeleteRRset(u, false, dns.TypeANY); err != nil {
+			t.Fatal(err)
+		}
+
+		if u.inUse() {
+			t.Errorf("Expected all records to be deleted, got %v", u.recordTypes())
+		}
+	})
+
+	tst.Run("Apex SOA and NS are protected", func(t *testing.T) {
+		u := CreateTestUpdateRecord(t, "example.com.", apex)
+		if err := applyUpdateDeleteRRset(u, true, dns.TypeANY); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyUpdateDeleteRR(u, true, rr("example.com. 0 NONE NS ns1.example.com.")); err != nil {
+			t.Fatal(err)
+		}
+
+		if !u.hasType("SOA") || !u.hasType("NS") {
+			t.Errorf("Expected SOA and NS to remain at the apex, got %v", u.recordTypes())
+		}
+	})
+
+	tst.Run("SOA replaced only with newer serial", func(t *testing.T) {
+		u := CreateTestUpdateRecord(t, "example.com.", apex)
+		if err := applyUpdateAdd(u, true, rr("example.com. 3600 IN SOA ns1.example.com. admin.example.com. 5 3600 600 86400 300")); err != nil {
+			t.Fatal(err)
+		}
+		if u.changed {
+			t.Errorf("Expected older SOA serial to be ignored")
+		}
+
+		if err := applyUpdateAdd(u, true, rr("example.com. 3600 IN SOA ns1.example.com. admin.example.com. 11 3600 600 86400 300")); err != nil {
+			t.Fatal(err)
+		}
+
+		rrs, _ := u.rrset(dns.TypeSOA)
+		if len(rrs) != 1 || rrs[0].(*dns.SOA).Serial != 11 {
+			t.Errorf("Expected SOA serial 11, got %v", rrs)
+		}
+	})
+}
+
+func TestIsSameRRset(tst *testing.T) {
+	a1, _ := dns.NewRR("www.example.com. 300 IN A 192.168.0.1")
+	a2, _ := dns.NewRR("www.example.com. 300 IN A 192.168.0.2")
+	p1, _ := dns.NewRR("www.example.com. 0 IN A 192.168.0.2")
+	p2, _ := dns.NewRR("www.example.com. 0 IN A 192.168.0.1")
+
+	if !isSameRRset([]dns.RR{a1, a2}, []dns.RR{p1, p2}) {
+		tst.Errorf("Expected RRsets to match regardless of order and TTL")
+	}
+
+	if isSameRRset([]dns.RR{a1, a2}, []dns.RR{p1}) {
+		tst.Errorf("Expected RRsets of different size not to match")
+	}
+}
+
+func TestHandleUpdate(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		backend memory
+		dynamic_update
+	}`)
+
+	plug, err := CreatePlugin(c)
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/@", []byte(`{"records":[`+
+		`{"type":"SOA","value":{"mname":"ns1.example.com","rname":"admin.example.com","serial":1,"refresh":3600,"retry":600,"expire":86400,"minimum":300}},`+
+		`{"type":"NS","value":["ns1.example.com"]}]}`))
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+	plug.TSIGKeys = map[string]*TSIGKey{
+		"update.": {Name: "update.", Algorithm: dns.HmacSHA256, Zones: []string{"example.com"}},
+	}
+
+	update := func(zone, algorithm string) int {
+		req := new(dns.Msg)
+		req.SetUpdate(zone)
+
+		rr, _ := dns.NewRR("www.example.com. 300 IN A 192.168.0.1")
+		req.Insert([]dns.RR{rr})
+		req.SetTsig("update.", algorithm, 300, time.Now().Unix())
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+			tst.Fatalf("Unexpected error: %v", err)
+		}
+
+		return rec.Msg.Rcode
+	}
+
+	if rcode := update("www.example.com.", dns.HmacSHA256); rcode != dns.RcodeNotAuth {
+		tst.Errorf("Expected NOTAUTH for a zone section below the apex, got %s", dns.RcodeToString[rcode])
+	}
+
+	if rcode := update("example.com.", dns.HmacSHA512); rcode != dns.RcodeNotAuth {
+		tst.Errorf("Expected NOTAUTH for a different TSIG algorithm, got %s", dns.RcodeToString[rcode])
+	}
+
+	if rcode := update("example.com.", dns.HmacSHA256); rcode != dns.RcodeSuccess {
+		tst.Errorf("Expected update to succeed, got %s", dns.RcodeToString[rcode])
+	}
+}
+
+func TestUpdateSerialWithoutSOA(tst *testing.T) {
+	plug, err := CreatePlugin(caddy.NewTestController("dns", "consulkv {\n backend memory\n}"))
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/@", []byte(`{"records":[{"type":"NS","value":["ns1.example.com"]}]}`))
+
+	serial := func() uint32 {
+		record, _, err := plug.Consul.GetZoneRecordForUpdateFromConsul("example.com", "@")
+		if err != nil {
+			tst.Fatalf("Unable to read apex: %v", err)
+		}
+
+		soa, err := GetSOAFromRecord("example.com", record)
+		if err != nil {
+			tst.Fatalf("Unable to read SOA: %v", err)
+		}
+
+		return soa.SERIAL
+	}
+
+	for i := uint32(1); i <= 2; i++ {
+		writes := []ZoneRecordWrite{}
+		if err := plug.bumpUpdateSerial("example.com", map[string]*updateRecord{}, &writes); err != nil {
+			tst.Fatalf("Unable to increase serial: %v", err)
+		}
+
+		if ok, err := plug.Consul.WriteZoneRecordsToConsul("example.com", writes); err != nil || !ok {
+			tst.Fatalf("Unable to write apex: %v (%v)", ok, err)
+		}
+
+		// The default SOA is written with a serial newer than the one served before
+		if s := serial(); s != soaSerial+i {
+			tst.Errorf("Expected serial %d after update %d, got %d", soaSerial+i, i, s)
+		}
+	}
+
+	record, _, _ := plug.Consul.GetZoneRecordForUpdateFromConsul("example.com", "@")
+	if len(record.Records) != 2 {
+		tst.Errorf("Expected NS to be kept next to the written SOA, got %v", record.Records)
+	}
+}
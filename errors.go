@@ -1,11 +1,18 @@
 package consulkv
 
 import (
+	"context"
+	"errors"
+
 	"github.com/miekg/dns"
 	"github.com/mwantia/coredns-consulkv-plugin/logging"
 	"github.com/mwantia/coredns-consulkv-plugin/records"
 )
 
+// errInvalidRecord is returned for records that can't be decoded. They only affect
+// the name they are stored under, so they never switch into lockdown mode.
+var errInvalidRecord = errors.New("invalid record")
+
 func HandleError(request *dns.Msg, rcode int, writer dns.ResponseWriter, e error) (int, error) {
 	m := PrepareResponseRcode(request, rcode, true)
 
@@ -66,3 +73,16 @@ func HandleConsulError(r *dns.Msg, w dns.ResponseWriter, e error) (int, error) {
 
 	return dns.RcodeServerFailure, e
 }
+
+// HandleConsulError switches into lockdown mode if it is enabled,
+// otherwise it answers the request with SERVFAIL.
+// Invalid records and requests the backend can't answer are always answered with SERVFAIL,
+// since the backend itself is reachable.
+func (plug ConsulKVPlugin) HandleConsulError(ctx context.Context, zname string, writer dns.ResponseWriter, r *dns.Msg, e error) (int, error) {
+	if plug.Lockdown == nil || errors.Is(e, errInvalidRecord) || errors.Is(e, errBackendNotConsul) {
+		return HandleConsulError(r, writer, e)
+	}
+
+	plug.Lockdown.Enter(e)
+	return plug.HandleLockdown(ctx, zname, writer, r, e)
+}
@@ -0,0 +1,532 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+// Media type of the ExternalDNS webhook provider protocol
+const externalDNSMediaType = "application/external.dns.webhook+json;version=1"
+
+// Record types managed by ExternalDNS; SOA and the NS records at the zone apex are never exposed,
+// so ExternalDNS can't remove the delegation of a zone.
+var externalDNSTypes = []string{"A", "AAAA", "CNAME", "TXT", "MX", "SRV", "NS", "PTR", "CAA"}
+
+// ExternalDNSWebhook implements the webhook provider protocol of ExternalDNS,
+// so endpoints within the configured zones are written into the records of the plugin.
+type ExternalDNSWebhook struct {
+	*HTTPServer
+	plug *ConsulKVPlugin
+}
+
+// ExternalDNSEndpoint is the JSON representation of an endpoint used by ExternalDNS.
+type ExternalDNSEndpoint struct {
+	DNSName          string                        `json:"dnsName"`
+	Targets          []string                      `json:"targets"`
+	RecordType       string                        `json:"recordType"`
+	SetIdentifier    string                        `json:"setIdentifier,omitempty"`
+	RecordTTL        int64                         `json:"recordTTL,omitempty"`
+	Labels           map[string]string             `json:"labels,omitempty"`
+	ProviderSpecific []ExternalDNSProviderProperty `json:"providerSpecific,omitempty"`
+}
+
+type ExternalDNSProviderProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ExternalDNSChanges contains the changes planned by ExternalDNS.
+type ExternalDNSChanges struct {
+	Create    []*ExternalDNSEndpoint `json:"Create"`
+	UpdateOld []*ExternalDNSEndpoint `json:"UpdateOld"`
+	UpdateNew []*ExternalDNSEndpoint `json:"UpdateNew"`
+	Delete    []*ExternalDNSEndpoint `json:"Delete"`
+}
+
+type externalDNSDomainFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// externalDNSChange replaces or removes the RRset of a single endpoint.
+type externalDNSChange struct {
+	name     string
+	endpoint *ExternalDNSEndpoint
+	remove   bool
+}
+
+func CreateExternalDNSWebhook(plug *ConsulKVPlugin) *ExternalDNSWebhook {
+	webhook := &ExternalDNSWebhook{plug: plug}
+	webhook.HTTPServer = CreateHTTPServer("ExternalDNS webhook", plug.Consul.ExternalDNSAddress, webhook.Handler())
+
+	return webhook
+}
+
+func (webhook *ExternalDNSWebhook) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", webhook.handleNegotiate)
+	mux.HandleFunc("GET /healthz", webhook.handleHealth)
+	mux.HandleFunc("GET /records", webhook.handleGetRecords)
+	mux.HandleFunc("POST /records", webhook.handleApplyChanges)
+	mux.HandleFunc("POST /adjustendpoints", webhook.handleAdjustEndpoints)
+
+	return mux
+}
+
+func (webhook *ExternalDNSWebhook) handleNegotiate(writer http.ResponseWriter, r *http.Request) {
+	zones := []string{}
+	for _, zone := range webhook.getZones() {
+		zones = append(zones, strings.TrimSuffix(zone, "."))
+	}
+
+	writeExternalDNSJSON(writer, http.StatusOK, &externalDNSDomainFilter{Include: zones})
+}
+
+func (webhook *ExternalDNSWebhook) handleHealth(writer http.ResponseWriter, r *http.Request) {
+	if err := webhook.plug.Consul.Backend.Ping(); err != nil {
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (webhook *ExternalDNSWebhook) handleGetRecords(writer http.ResponseWriter, r *http.Request) {
+	endpoints, err := webhook.GetEndpoints()
+	if err != nil {
+		logging.Log.Errorf("Error listing endpoints for ExternalDNS: %v", err)
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeExternalDNSJSON(writer, http.StatusOK, endpoints)
+}
+
+func (webhook *ExternalDNSWebhook) handleApplyChanges(writer http.ResponseWriter, r *http.Request) {
+	var changes ExternalDNSChanges
+	if err := readExternalDNSBody(r, &changes); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := webhook.ApplyChanges(&changes); err != nil {
+		logging.Log.Errorf("Error applying changes of ExternalDNS: %v", err)
+		IncrementMetricsPluginErrorsTotal("CONSUL_PUT")
+
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (webhook *ExternalDNSWebhook) handleAdjustEndpoints(writer http.ResponseWriter, r *http.Request) {
+	var endpoints []*ExternalDNSEndpoint
+	if err := readExternalDNSBody(r, &endpoints); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	adjusted, err := webhook.AdjustEndpoints(endpoints)
+	if err != nil {
+		logging.Log.Errorf("Error adjusting endpoints for ExternalDNS: %v", err)
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeExternalDNSJSON(writer, http.StatusOK, adjusted)
+}
+
+func (webhook *ExternalDNSWebhook) getZones() []string {
+	webhook.plug.cfgMu.RLock()
+	defer webhook.plug.cfgMu.RUnlock()
+
+	if webhook.plug.Config == nil {
+		return nil
+	}
+
+	return append([]string(nil), webhook.plug.Config.Zones...)
+}
+
+// GetEndpoints returns one endpoint for every RRset of a managed type within the configured zones.
+// Entries of views and entries that are resolved at query time (e.g. ALIAS) aren't exposed.
+func (webhook *ExternalDNSWebhook) GetEndpoints() ([]*ExternalDNSEndpoint, error) {
+	endpoints := []*ExternalDNSEndpoint{}
+
+	for _, zone := range webhook.getZones() {
+		recs, _, err := webhook.plug.Consul.ListZoneRecordsFromConsul(zone, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, record := range recs {
+			owner := GetRecordOwnerName(zone, name)
+
+			for _, rtype := range externalDNSTypes {
+				if name == "@" && rtype == "NS" {
+					continue
+				}
+
+				rrs, err := record.GetRRset(owner, dns.StringToType[rtype])
+				if err != nil {
+					logging.Log.Warningf("Skipping %s records of '%s' for ExternalDNS: %v", rtype, owner, err)
+					continue
+				}
+
+				if len(rrs) == 0 {
+					continue
+				}
+
+				endpoints = append(endpoints, createExternalDNSEndpoint(owner, rtype, record.TTL, rrs))
+			}
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].DNSName != endpoints[j].DNSName {
+			return endpoints[i].DNSName < endpoints[j].DNSName
+		}
+		return endpoints[i].RecordType < endpoints[j].RecordType
+	})
+
+	return endpoints, nil
+}
+
+// ApplyChanges writes the changes of every zone within a single transaction together with an
+// increased SOA serial. Concurrent changes are retried like dynamic updates.
+func (webhook *ExternalDNSWebhook) ApplyChanges(changes *ExternalDNSChanges) error {
+	zones := webhook.getZones()
+	byZone := make(map[string][]externalDNSChange)
+	order := []string{}
+
+	add := func(endpoints []*ExternalDNSEndpoint, remove bool) error {
+		for _, endpoint := range endpoints {
+			zone, name := GetZoneAndRecord(zones, endpoint.DNSName)
+			if zone == "" {
+				return fmt.Errorf("endpoint '%s' isn't within any configured zone", endpoint.DNSName)
+			}
+
+			if !isExternalDNSType(endpoint.RecordType) || (name == "@" && endpoint.RecordType == "NS") {
+				return fmt.Errorf("record type '%s' of endpoint '%s' can't be managed", endpoint.RecordType, endpoint.DNSName)
+			}
+
+			if _, exists := byZone[zone]; !exists {
+				order = append(order, zone)
+			}
+			byZone[zone] = append(byZone[zone], externalDNSChange{name: name, endpoint: endpoint, remove: remove})
+		}
+
+		return nil
+	}
+
+	// UpdateOld only describes the previous state, UpdateNew replaces the same RRsets
+	if err := add(changes.Delete, true); err != nil {
+		return err
+	}
+	if err := add(changes.UpdateNew, false); err != nil {
+		return err
+	}
+	if err := add(changes.Create, false); err != nil {
+		return err
+	}
+
+	for _, zone := range order {
+		err := errUpdateConflict
+		for attempt := 1; attempt <= dynamicUpdateAttempts && err == errUpdateConflict; attempt++ {
+			err = webhook.applyZoneChanges(zone, byZone[zone])
+		}
+
+		if err != nil {
+			return fmt.Errorf("error applying changes to zone '%s': %w", zone, err)
+		}
+	}
+
+	return nil
+}
+
+func (webhook *ExternalDNSWebhook) applyZoneChanges(zone string, changes []externalDNSChange) error {
+	names := map[string]*updateRecord{}
+
+	for _, change := range changes {
+		u, exists := names[change.name]
+		if !exists {
+			record, index, err := webhook.plug.Consul.GetZoneRecordForUpdateFromConsul(zone, change.name)
+			if err != nil {
+				return err
+			}
+
+			if record != nil {
+				record = record.Clone()
+			}
+
+			u = &updateRecord{owner: GetRecordOwnerName(zone, change.name), record: record, index: index}
+			names[change.name] = u
+		}
+
+		rtype := dns.StringToType[change.endpoint.RecordType]
+		if change.remove {
+			if u.hasType(change.endpoint.RecordType) {
+				if err := u.setRRset(rtype, nil); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if u.record == nil {
+			u.record = &records.Record{}
+		}
+
+		ttl := getExternalDNSTTL(u.record, change.endpoint.RecordType, change.endpoint.RecordTTL)
+		if change.endpoint.RecordTTL > 0 && (ttl == nil || int64(*ttl) != change.endpoint.RecordTTL) {
+			logging.Log.Warningf("Ignoring TTL %d of endpoint '%s' (%s), the TTL of the record is shared with other entries",
+				change.endpoint.RecordTTL, u.owner, change.endpoint.RecordType)
+		}
+
+		u.record.TTL = ttl
+		rrs, err := createExternalDNSRRs(u.owner, change.endpoint, uint32(GetDefaultTTL(u.record)))
+		if err != nil {
+			return err
+		}
+
+		if err := u.setRRset(rtype, rrs); err != nil {
+			return err
+		}
+	}
+
+	writes := []ZoneRecordWrite{}
+	for name, u := range names {
+		if !u.changed {
+			continue
+		}
+
+		write := ZoneRecordWrite{Name: name, Record: u.record, ModifyIndex: u.index}
+		if len(u.record.Records) == 0 && len(u.record.Views) == 0 {
+			write.Record = nil
+		}
+
+		if write.Record != nil {
+			value, err := json.Marshal(write.Record)
+			if err != nil {
+				return err
+			}
+
+			_, issues := records.ValidateRecord(name, value, records.ValidateOptions{})
+			for _, issue := range issues {
+				if issue.Severity == records.SeverityError {
+					return fmt.Errorf("invalid record '%s': %s", u.owner, issue.Message)
+				}
+			}
+		}
+
+		writes = append(writes, write)
+	}
+
+	if len(writes) == 0 {
+		return nil
+	}
+
+	if err := webhook.plug.bumpUpdateSerial(zone, names, &writes); err != nil {
+		return err
+	}
+
+	ok, err := webhook.plug.Consul.WriteZoneRecordsToConsul(zone, writes)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errUpdateConflict
+	}
+
+	logging.Log.Infof("Applied %d changes of ExternalDNS to zone '%s'", len(writes), zone)
+	return nil
+}
+
+// AdjustEndpoints returns the endpoints the way they are returned after being written,
+// so ExternalDNS doesn't plan updates for differences in notation (e.g. trailing dots)
+// or for TTLs that can't be applied to the record of the endpoint.
+func (webhook *ExternalDNSWebhook) AdjustEndpoints(endpoints []*ExternalDNSEndpoint) ([]*ExternalDNSEndpoint, error) {
+	zones := webhook.getZones()
+	adjusted := make([]*ExternalDNSEndpoint, 0, len(endpoints))
+
+	for _, endpoint := range endpoints {
+		if !isExternalDNSType(endpoint.RecordType) {
+			adjusted = append(adjusted, endpoint)
+			continue
+		}
+
+		owner := dns.Fqdn(strings.ToLower(endpoint.DNSName))
+		rrs, err := createExternalDNSRRs(owner, endpoint, uint32(endpoint.RecordTTL))
+		if err != nil {
+			adjusted = append(adjusted, endpoint)
+			continue
+		}
+
+		ttl := int(endpoint.RecordTTL)
+		e := createExternalDNSEndpoint(owner, endpoint.RecordType, &ttl, rrs)
+		e.SetIdentifier = endpoint.SetIdentifier
+		e.Labels = endpoint.Labels
+		e.ProviderSpecific = endpoint.ProviderSpecific
+
+		if zone, name := GetZoneAndRecord(zones, owner); zone != "" {
+			record, _, err := webhook.plug.Consul.GetZoneRecordForUpdateFromConsul(zone, name)
+			if err != nil {
+				return nil, err
+			}
+
+			e.RecordTTL = 0
+			if ttl := getExternalDNSTTL(record, endpoint.RecordType, endpoint.RecordTTL); ttl != nil {
+				e.RecordTTL = int64(*ttl)
+			}
+		}
+
+		adjusted = append(adjusted, e)
+	}
+
+	return adjusted, nil
+}
+
+// getExternalDNSTTL returns the TTL of the record after an endpoint of rtype has been written into it.
+// The TTL is shared by all entries of the record, so the TTL of the endpoint is only used
+// if the record doesn't contain any other entries; otherwise the TTL of the record is kept.
+func getExternalDNSTTL(record *records.Record, rtype string, ttl int64) *int {
+	if record != nil {
+		for _, rec := range record.Records {
+			if rec.Type != rtype {
+				return record.TTL
+			}
+		}
+
+		if len(record.Views) > 0 || ttl <= 0 {
+			return record.TTL
+		}
+	}
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	t := int(ttl)
+	return &t
+}
+
+func createExternalDNSEndpoint(owner, rtype string, ttl *int, rrs []dns.RR) *ExternalDNSEndpoint {
+	endpoint := &ExternalDNSEndpoint{
+		DNSName:    strings.TrimSuffix(owner, "."),
+		RecordType: rtype,
+		Targets:    make([]string, 0, len(rrs)),
+	}
+
+	if ttl != nil {
+		endpoint.RecordTTL = int64(*ttl)
+	}
+
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			// Ownership records of the TXT registry are compared including their quotes
+			endpoint.Targets = append(endpoint.Targets, `"`+strings.Join(txt.Txt, "")+`"`)
+			continue
+		}
+
+		target := strings.TrimPrefix(rr.String(), rr.Header().String())
+		endpoint.Targets = append(endpoint.Targets, strings.TrimSuffix(target, "."))
+	}
+
+	sort.Strings(endpoint.Targets)
+	return endpoint
+}
+
+// createExternalDNSRRs converts the targets of the endpoint into resource records owned by owner.
+func createExternalDNSRRs(owner string, endpoint *ExternalDNSEndpoint, ttl uint32) ([]dns.RR, error) {
+	rtype := dns.StringToType[endpoint.RecordType]
+	hdr := dns.RR_Header{Name: owner, Rrtype: rtype, Class: dns.ClassINET, Ttl: ttl}
+
+	rrs := make([]dns.RR, 0, len(endpoint.Targets))
+	for _, target := range endpoint.Targets {
+		if rtype == dns.TypeTXT {
+			rrs = append(rrs, &dns.TXT{Hdr: hdr, Txt: splitTXT(strings.TrimSuffix(strings.TrimPrefix(target, `"`), `"`))})
+			continue
+		}
+
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", owner, ttl, endpoint.RecordType, target))
+		if err != nil {
+			return nil, fmt.Errorf("invalid target '%s' of endpoint '%s': %w", target, endpoint.DNSName, err)
+		}
+
+		if rr == nil {
+			return nil, fmt.Errorf("empty target of endpoint '%s'", endpoint.DNSName)
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, nil
+}
+
+// splitTXT splits the value into strings of at most 255 characters (RFC 1035 section 3.3.14).
+func splitTXT(value string) []string {
+	parts := []string{}
+	for len(value) > 255 {
+		parts = append(parts, value[:255])
+		value = value[255:]
+	}
+
+	return append(parts, value)
+}
+
+func isExternalDNSType(rtype string) bool {
+	for _, t := range externalDNSTypes {
+		if t == rtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+func readExternalDNSBody(r *http.Request, value interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, adminMaxBodySize))
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("error converting json: %w", err)
+	}
+
+	return nil
+}
+
+func writeExternalDNSJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", externalDNSMediaType)
+	writer.Header().Set("Vary", "Content-Type")
+	writer.WriteHeader(status)
+
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		logging.Log.Errorf("Error writing ExternalDNS response: %v", err)
+	}
+}
+
+// isLoopbackHost reports whether host only accepts connections from the local machine.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
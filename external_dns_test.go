@@ -0,0 +1,192 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func TestExternalDNSWebhook(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		backend memory
+		external_dns 127.0.0.1:0
+	}`)
+
+	plug, err := CreatePlugin(c)
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/@", []byte(`{"records":[`+
+		`{"type":"SOA","value":{"mname":"ns1.example.com","rname":"admin.example.com","serial":1,"refresh":3600,"retry":600,"expire":86400,"minimum":300}},`+
+		`{"type":"NS","value":["ns1.example.com"]}]}`))
+	backend.Put("dns/zones/example.com/legacy", []byte(`{"ttl":600,"records":[{"type":"A","value":["192.168.0.9"]},{"type":"ALIAS","value":"www.example.com"}]}`))
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+
+	handler := plug.Webhook.Handler()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Accept", externalDNSMediaType)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	endpoints := func() map[string]*ExternalDNSEndpoint {
+		w := request(http.MethodGet, "/records", "")
+		if w.Code != http.StatusOK {
+			tst.Fatalf("Expected 200 for records, got %d: %s", w.Code, w.Body)
+		}
+
+		var list []*ExternalDNSEndpoint
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			tst.Fatalf("Unable to parse endpoints: %v", err)
+		}
+
+		result := make(map[string]*ExternalDNSEndpoint)
+		for _, e := range list {
+			result[e.DNSName+"/"+e.RecordType] = e
+		}
+		return result
+	}
+
+	serial := func() uint32 {
+		record, _, _ := plug.Consul.GetZoneRecordForUpdateFromConsul("example.com", "@")
+		soa, _ := GetSOAFromRecord("example.com", record)
+		return soa.SERIAL
+	}
+
+	owner := `"heritage=external-dns,external-dns/owner=default,external-dns/resource=service/default/www"`
+
+	w := request(http.MethodGet, "/", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != externalDNSMediaType || !strings.Contains(w.Body.String(), `"include":["example.com"]`) {
+		tst.Fatalf("Expected domain filter, got %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	w = request(http.MethodPost, "/records", `{"Create":[
+		{"dnsName":"www.example.com","targets":["192.168.0.1"],"recordType":"A","recordTTL":300},
+		{"dnsName":"a-www.example.com","targets":[`+jsonString(owner)+`],"recordType":"TXT"},
+		{"dnsName":"app.example.com","targets":["www.example.com"],"recordType":"CNAME"}
+	]}`)
+	if w.Code != http.StatusNoContent {
+		tst.Fatalf("Expected 204 for changes, got %d: %s", w.Code, w.Body)
+	}
+
+	if s := serial(); s != 2 {
+		tst.Errorf("Expected a single increase of the SOA serial, got %d", s)
+	}
+
+	current := endpoints()
+	if e := current["www.example.com/A"]; e == nil || e.RecordTTL != 300 || len(e.Targets) != 1 || e.Targets[0] != "192.168.0.1" {
+		tst.Errorf("Expected A endpoint for 'www', got %+v", e)
+	}
+	if e := current["a-www.example.com/TXT"]; e == nil || e.Targets[0] != owner {
+		tst.Errorf("Expected ownership record to be preserved, got %+v", e)
+	}
+	if e := current["app.example.com/CNAME"]; e == nil || e.Targets[0] != "www.example.com" {
+		tst.Errorf("Expected CNAME endpoint without trailing dot, got %+v", e)
+	}
+	if e := current["legacy.example.com/A"]; e == nil || e.RecordTTL != 600 {
+		tst.Errorf("Expected existing record to be listed, got %+v", e)
+	}
+	if current["example.com/NS"] != nil || current["example.com/SOA"] != nil {
+		tst.Errorf("Expected zone apex NS and SOA not to be exposed")
+	}
+
+	w = request(http.MethodPost, "/records", `{
+		"UpdateOld":[{"dnsName":"www.example.com","targets":["192.168.0.1"],"recordType":"A","recordTTL":300}],
+		"UpdateNew":[{"dnsName":"www.example.com","targets":["192.168.0.2","192.168.0.3"],"recordType":"A","recordTTL":300}],
+		"Delete":[{"dnsName":"app.example.com","targets":["www.example.com"],"recordType":"CNAME"}]
+	}`)
+	if w.Code != http.StatusNoContent {
+		tst.Fatalf("Expected 204 for update, got %d: %s", w.Code, w.Body)
+	}
+
+	current = endpoints()
+	if e := current["www.example.com/A"]; e == nil || len(e.Targets) != 2 {
+		tst.Errorf("Expected updated A endpoint, got %+v", e)
+	}
+	if current["app.example.com/CNAME"] != nil {
+		tst.Errorf("Expected CNAME endpoint to be deleted")
+	}
+	if record, _, _ := plug.Consul.GetZoneRecordForUpdateFromConsul("example.com", "app"); record != nil {
+		tst.Errorf("Expected empty record 'app' to be removed, got %+v", record)
+	}
+
+	w = request(http.MethodPost, "/records", `{"Create":[{"dnsName":"www.example.org","targets":["192.168.0.1"],"recordType":"A"}]}`)
+	if w.Code != http.StatusInternalServerError {
+		tst.Errorf("Expected endpoint outside of the zones to be rejected, got %d", w.Code)
+	}
+
+	w = request(http.MethodPost, "/records", `{"Delete":[{"dnsName":"example.com","targets":["ns1.example.com"],"recordType":"NS"}]}`)
+	if w.Code != http.StatusInternalServerError {
+		tst.Errorf("Expected zone apex NS to be rejected, got %d", w.Code)
+	}
+
+	w = request(http.MethodPost, "/adjustendpoints", `[
+		{"dnsName":"App.example.com.","targets":["www.example.com."],"recordType":"CNAME"},
+		{"dnsName":"example.com","targets":["10 mail.example.com."],"recordType":"MX"}
+	]`)
+
+	var adjusted []*ExternalDNSEndpoint
+	json.Unmarshal(w.Body.Bytes(), &adjusted)
+
+	if len(adjusted) != 2 || adjusted[0].DNSName != "app.example.com" || adjusted[0].Targets[0] != "www.example.com" || adjusted[1].Targets[0] != "10 mail.example.com" {
+		tst.Errorf("Expected normalized endpoints, got %s", w.Body)
+	}
+
+	// Endpoints of the same name share the TTL of the record, so the TTL of the first one is kept
+	sync := `[
+		{"dnsName":"mail.example.com","targets":["192.168.0.5"],"recordType":"A","recordTTL":300},
+		{"dnsName":"mail.example.com","targets":["\"v=spf1 -all\""],"recordType":"TXT","recordTTL":60}
+	]`
+	w = request(http.MethodPost, "/records", `{"Create":`+sync+`}`)
+	if w.Code != http.StatusNoContent {
+		tst.Fatalf("Expected 204 for changes, got %d: %s", w.Code, w.Body)
+	}
+
+	current = endpoints()
+	if a, txt := current["mail.example.com/A"], current["mail.example.com/TXT"]; a == nil || txt == nil || a.RecordTTL != 300 || txt.RecordTTL != 300 {
+		tst.Errorf("Expected both endpoints with TTL 300, got %+v and %+v", a, txt)
+	}
+
+	// The adjusted endpoints match the stored ones, so ExternalDNS doesn't plan the TTL change again
+	w = request(http.MethodPost, "/adjustendpoints", sync)
+	adjusted = nil
+	json.Unmarshal(w.Body.Bytes(), &adjusted)
+
+	if len(adjusted) != 2 || adjusted[0].RecordTTL != 300 || adjusted[1].RecordTTL != 300 {
+		tst.Errorf("Expected adjusted endpoints with TTL 300, got %s", w.Body)
+	}
+}
+
+func jsonString(value string) string {
+	raw, _ := json.Marshal(value)
+	return string(raw)
+}
+
+func TestExternalDNSConfig(tst *testing.T) {
+	for address, valid := range map[string]bool{
+		"127.0.0.1:8888": true,
+		"[::1]:8888":     true,
+		"localhost:8888": true,
+		":8888":          false,
+		"0.0.0.0:8888":   false,
+		"10.0.0.1:8888":  false,
+	} {
+		c := caddy.NewTestController("dns", `consulkv {
+			external_dns `+address+`
+		}`)
+
+		if err := LoadConsulConfig(c, &ConsulConfig{}); (err == nil) != valid {
+			tst.Errorf("Expected address '%s' to be valid: %v, got %v", address, valid, err)
+		}
+	}
+}
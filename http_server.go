@@ -0,0 +1,79 @@
+package consulkv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// HTTPServer serves a handler on an address and can be started again after it was stopped,
+// since the listener has to be released before a reload of CoreDNS binds it again.
+type HTTPServer struct {
+	name    string
+	address string
+	handler http.Handler
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+func CreateHTTPServer(name, address string, handler http.Handler) *HTTPServer {
+	return &HTTPServer{
+		name:    name,
+		address: address,
+		handler: handler,
+	}
+}
+
+func (s *HTTPServer) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server != nil {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("unable to start %s on '%s': %w", s.name, s.address, err)
+	}
+
+	server := &http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.server = server
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logging.Log.Errorf("Error serving %s on '%s': %v", s.name, s.address, err)
+		}
+	}()
+
+	logging.Log.Infof("Started %s on '%s'", s.name, listener.Addr())
+	return nil
+}
+
+func (s *HTTPServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+
+	err := s.server.Shutdown(ctx)
+	s.server = nil
+
+	return err
+}
@@ -0,0 +1,209 @@
+package consulkv
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+)
+
+const (
+	lockdownDefaultInterval = 10 * time.Second
+	lockdownDefaultStaleTTL = 30             // RFC 8767 section 4 recommends 30 seconds
+	lockdownMaxStaleAge     = 72 * time.Hour // RFC 8767 section 5 suggests 1 to 3 days
+	lockdownMaxEntries      = 10000
+)
+
+// Lockdown keeps the last known good answer of every name served by the plugin.
+// Once Consul becomes unreachable these answers are served stale (RFC 8767)
+// until a background checker is able to reach Consul again.
+type Lockdown struct {
+	consul      *ConsulConfig
+	Interval    time.Duration
+	StaleTTL    uint32
+	Fallthrough bool
+
+	mu      sync.RWMutex
+	active  bool
+	since   time.Time
+	answers map[string]*staleAnswer
+}
+
+type staleAnswer struct {
+	msg    *dns.Msg
+	stored time.Time
+}
+
+func CreateLockdown(consul *ConsulConfig) *Lockdown {
+	lockdown := &Lockdown{
+		consul:      consul,
+		Interval:    consul.LockdownInterval,
+		StaleTTL:    consul.LockdownStaleTTL,
+		Fallthrough: consul.LockdownFallthrough,
+		answers:     make(map[string]*staleAnswer),
+	}
+
+	if lockdown.Interval <= 0 {
+		lockdown.Interval = lockdownDefaultInterval
+	}
+	if lockdown.StaleTTL == 0 {
+		lockdown.StaleTTL = lockdownDefaultStaleTTL
+	}
+
+	return lockdown
+}
+
+func (lockdown *Lockdown) IsActive() bool {
+	lockdown.mu.RLock()
+	defer lockdown.mu.RUnlock()
+
+	return lockdown.active
+}
+
+// Enter switches into lockdown mode and starts the checker,
+// unless lockdown mode is already active.
+func (lockdown *Lockdown) Enter(reason error) {
+	lockdown.mu.Lock()
+	defer lockdown.mu.Unlock()
+
+	if lockdown.active {
+		return
+	}
+
+	lockdown.active = true
+	lockdown.since = time.Now()
+	SetMetricsLockdownActive(true)
+
+	logging.Log.Warningf("Consul is unreachable, entering lockdown mode: %v", reason)
+
+	go lockdown.runChecker()
+}
+
+func (lockdown *Lockdown) Exit() {
+	lockdown.mu.Lock()
+	defer lockdown.mu.Unlock()
+
+	if !lockdown.active {
+		return
+	}
+
+	lockdown.active = false
+	SetMetricsLockdownActive(false)
+
+	logging.Log.Infof("Consul is reachable again, leaving lockdown mode after %s", time.Since(lockdown.since).Round(time.Second))
+}
+
+// Remember stores a copy of a successful response as last known good answer.
+func (lockdown *Lockdown) Remember(view string, msg *dns.Msg) {
+	if len(msg.Question) == 0 || len(msg.Answer) == 0 {
+		return
+	}
+
+	key := getLockdownKey(view, msg.Question[0])
+
+	lockdown.mu.Lock()
+	defer lockdown.mu.Unlock()
+
+	if _, exists := lockdown.answers[key]; !exists && len(lockdown.answers) >= lockdownMaxEntries {
+		for k := range lockdown.answers {
+			delete(lockdown.answers, k)
+			break
+		}
+	}
+
+	lockdown.answers[key] = &staleAnswer{
+		msg:    msg.Copy(),
+		stored: time.Now(),
+	}
+}
+
+// GetStaleAnswer returns the last known good answer for the request
+// with every TTL capped to the configured stale TTL.
+func (lockdown *Lockdown) GetStaleAnswer(view string, r *dns.Msg) *dns.Msg {
+	if len(r.Question) == 0 {
+		return nil
+	}
+
+	lockdown.mu.RLock()
+	stale, exists := lockdown.answers[getLockdownKey(view, r.Question[0])]
+	lockdown.mu.RUnlock()
+
+	if !exists || time.Since(stale.stored) > lockdownMaxStaleAge {
+		return nil
+	}
+
+	m := stale.msg.Copy()
+	m.SetReply(r)
+	m.Authoritative = true
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > lockdown.StaleTTL {
+				rr.Header().Ttl = lockdown.StaleTTL
+			}
+		}
+	}
+
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EDE{
+			InfoCode: dns.ExtendedErrorCodeStaleAnswer,
+		})
+	}
+
+	return m
+}
+
+func (lockdown *Lockdown) runChecker() {
+	ticker := time.NewTicker(lockdown.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !lockdown.IsActive() {
+			return
+		}
+
+		err := lockdown.consul.Backend.Ping()
+		if err != nil {
+			logging.Log.Debugf("Consul is still unreachable: %v", err)
+			continue
+		}
+
+		lockdown.Exit()
+		return
+	}
+}
+
+func getLockdownKey(view string, q dns.Question) string {
+	return view + "/" + strings.ToLower(dns.Fqdn(q.Name)) + "/" + dns.TypeToString[q.Qtype]
+}
+
+// HandleLockdown answers a request while Consul is unreachable:
+// first with a stale answer, then by falling through to the next plugin if configured.
+func (plug ConsulKVPlugin) HandleLockdown(ctx context.Context, zname string, writer dns.ResponseWriter, r *dns.Msg, e error) (int, error) {
+	qtype := dns.TypeNone
+	if len(r.Question) > 0 {
+		qtype = r.Question[0].Qtype
+	}
+
+	if m := plug.Lockdown.GetStaleAnswer(GetView(ctx), r); m != nil {
+		logging.Log.Debugf("Serving stale answer for zone '%s' during lockdown", zname)
+		IncrementMetricsLockdownResponsesTotal("STALE")
+
+		return SendDNSResponse(zname, qtype, m, writer)
+	}
+
+	if plug.Lockdown.Fallthrough {
+		logging.Log.Debugf("No stale answer available for zone '%s', passing to next plugin", zname)
+		IncrementMetricsLockdownResponsesTotal("FALLTHROUGH")
+
+		return plugin.NextOrFailure(plug.Name(), plug.Next, ctx, writer, r)
+	}
+
+	IncrementMetricsLockdownResponsesTotal("SERVFAIL")
+	return HandleConsulError(r, writer, e)
+}
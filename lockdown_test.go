@@ -0,0 +1,88 @@
+package consulkv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestLockdownStaleAnswer(tst *testing.T) {
+	lockdown := CreateLockdown(&ConsulConfig{})
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	if m := lockdown.GetStaleAnswer("", req); m != nil {
+		tst.Fatalf("Expected no stale answer before anything was remembered")
+	}
+
+	msg := PrepareResponseReply(req, false)
+	rr, _ := dns.NewRR("www.example.com. 3600 IN A 192.168.0.3")
+	msg.Answer = append(msg.Answer, rr)
+	lockdown.Remember("", msg)
+
+	stale := new(dns.Msg)
+	stale.SetQuestion("WWW.example.com.", dns.TypeA)
+	stale.SetEdns0(1232, false)
+
+	m := lockdown.GetStaleAnswer("", stale)
+	if m == nil {
+		tst.Fatalf("Expected stale answer for remembered name")
+	}
+
+	if m.Id != stale.Id {
+		tst.Errorf("Expected stale answer to carry request id %d, but got %d", stale.Id, m.Id)
+	}
+
+	if len(m.Answer) != 1 || m.Answer[0].Header().Ttl != lockdownDefaultStaleTTL {
+		tst.Errorf("Expected one answer with ttl %d, but got %v", lockdownDefaultStaleTTL, m.Answer)
+	}
+
+	if msg.Answer[0].Header().Ttl != 3600 {
+		tst.Errorf("Expected remembered answer to keep its original ttl, but got %d", msg.Answer[0].Header().Ttl)
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		tst.Fatalf("Expected stale answer to carry an extended DNS error")
+	}
+
+	if ede, ok := opt.Option[0].(*dns.EDNS0_EDE); !ok || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		tst.Errorf("Expected extended DNS error 'Stale Answer', but got %v", opt.Option[0])
+	}
+}
+
+func TestLockdownInvalidRecord(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		backend memory
+		lockdown
+	}`)
+
+	plug, err := CreatePlugin(c)
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/www", []byte(`{"records":[`))
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	plug.ServeDNS(context.Background(), rec, req)
+
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeServerFailure {
+		tst.Errorf("Expected SERVFAIL for invalid record, got %v", rec.Msg)
+	}
+
+	// Consul is still reachable, so a single invalid record doesn't affect other names
+	if plug.Lockdown.IsActive() {
+		tst.Errorf("Expected invalid record not to switch into lockdown mode")
+	}
+}
@@ -1,6 +1,7 @@
 package consulkv
 
 import (
+	"strconv"
 	"sync"
 
 	"github.com/coredns/coredns/plugin"
@@ -81,4 +82,85 @@ func IncrementMetricsResponsesFailedTotal(zone string, qtype uint16, err string)
 	metricsQueryResponsesFailedTotal.WithLabelValues(dns.Fqdn(zone), t, err).Inc()
 }
 
+var metricsZoneMirrorUpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: metricsSubsystem,
+	Name:      "zone_mirror_updates_total",
+	Help:      "Count the amount of times a mirrored zone was reloaded from Consul.",
+}, []string{"zone", "error"})
+
+func IncrementMetricsZoneMirrorUpdatesTotal(zone string, err string) {
+	metricsZoneMirrorUpdatesTotal.WithLabelValues(dns.Fqdn(zone), err).Inc()
+}
+
+var metricsLockdownActive = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: metricsSubsystem,
+	Name:      "lockdown_active",
+	Help:      "Whether the plugin is currently in lockdown mode because Consul is unreachable.",
+})
+
+func SetMetricsLockdownActive(active bool) {
+	if active {
+		metricsLockdownActive.Set(1)
+	} else {
+		metricsLockdownActive.Set(0)
+	}
+}
+
+var metricsLockdownResponsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: metricsSubsystem,
+	Name:      "lockdown_responses_total",
+	Help:      "Count the amount of queries answered while the plugin was in lockdown mode.",
+}, []string{"result"})
+
+func IncrementMetricsLockdownResponsesTotal(result string) {
+	metricsLockdownResponsesTotal.WithLabelValues(result).Inc()
+}
+
+var metricsDynamicUpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: metricsSubsystem,
+	Name:      "dynamic_updates_total",
+	Help:      "Count the amount of dynamic updates received per zone and response code.",
+}, []string{"zone", "result"})
+
+func IncrementMetricsDynamicUpdatesTotal(zone string, result string) {
+	metricsDynamicUpdatesTotal.WithLabelValues(dns.Fqdn(zone), result).Inc()
+}
+
+var metricsResponseCacheHitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: metricsSubsystem,
+	Name:      "response_cache_hits_total",
+	Help:      "Count the amount of queries answered from the response cache.",
+}, []string{"zone"})
+
+func IncrementMetricsResponseCacheHitsTotal(zone string) {
+	metricsResponseCacheHitsTotal.WithLabelValues(dns.Fqdn(zone)).Inc()
+}
+
+var metricsResponseCacheMissesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: metricsSubsystem,
+	Name:      "response_cache_misses_total",
+	Help:      "Count the amount of queries that couldn't be answered from the response cache.",
+}, []string{"zone"})
+
+func IncrementMetricsResponseCacheMissesTotal(zone string) {
+	metricsResponseCacheMissesTotal.WithLabelValues(dns.Fqdn(zone)).Inc()
+}
+
+var metricsAdminRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: metricsSubsystem,
+	Name:      "admin_requests_total",
+	Help:      "Count the amount of requests received by the admin API per method and status code.",
+}, []string{"method", "code"})
+
+func IncrementMetricsAdminRequestsTotal(method string, code int) {
+	metricsAdminRequestsTotal.WithLabelValues(method, strconv.Itoa(code)).Inc()
+}
+
 var _ sync.Once
@@ -1,22 +1,18 @@
 package consulkv
 
-import (
-	"time"
-
-	"github.com/hashicorp/consul/api"
-)
-
 func (config ConsulKVPlugin) Ready() bool {
 	if config.Consul == nil {
 		return false
 	}
 
-	_, _, err := config.Consul.Client.Health().Service("consul", "", false, &api.QueryOptions{
-		AllowStale:        true,
-		UseCache:          true,
-		MaxAge:            1 * time.Second,
-		RequireConsistent: false,
-	})
+	if config.Lockdown != nil && config.Lockdown.IsActive() {
+		return false
+	}
+
+	err := config.Consul.Backend.Ping()
+	if err != nil && config.Lockdown != nil {
+		config.Lockdown.Enter(err)
+	}
 
 	return err == nil
 }
@@ -0,0 +1,108 @@
+package consulkv
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+// AppendAdditionalRecords adds the addresses of every target referenced in the answer section
+// (SRV, MX, NS, SVCB and HTTPS) to the additional section, if the target lives in a configured zone.
+// Targets are only added once and only as long as the response stays within size bytes.
+func (plug *ConsulKVPlugin) AppendAdditionalRecords(ctx context.Context, msg *dns.Msg, size int) {
+	seen := make(map[string]bool)
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
+			seen[strings.ToLower(rr.Header().Name)] = true
+		}
+	}
+
+	for _, rr := range msg.Answer {
+		target := getAdditionalTarget(rr)
+		if target == "" || target == "." || seen[strings.ToLower(target)] {
+			continue
+		}
+		seen[strings.ToLower(target)] = true
+
+		extra := plug.GetAdditionalAddresses(ctx, target)
+		if len(extra) == 0 {
+			continue
+		}
+
+		msg.Extra = append(msg.Extra, extra...)
+		if msg.Len() > size {
+			logging.Log.Debugf("Additional records for '%s' exceed the response size of %d bytes", target, size)
+			msg.Extra = msg.Extra[:len(msg.Extra)-len(extra)]
+
+			return
+		}
+	}
+}
+
+func getAdditionalTarget(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.SRV:
+		return rr.Target
+	case *dns.MX:
+		return rr.Mx
+	case *dns.NS:
+		return rr.Ns
+	case *dns.SVCB:
+		return rr.Target
+	case *dns.HTTPS:
+		return rr.Target
+	}
+
+	return ""
+}
+
+// AppendAdditionalAddresses adds the A and AAAA records of a target
+// to the additional section, if the target lives in a configured zone.
+func (plug *ConsulKVPlugin) AppendAdditionalAddresses(ctx context.Context, msg *dns.Msg, target string) {
+	msg.Extra = append(msg.Extra, plug.GetAdditionalAddresses(ctx, target)...)
+}
+
+// GetAdditionalAddresses returns the A and AAAA records of a target,
+// if the target lives in a configured zone.
+func (plug *ConsulKVPlugin) GetAdditionalAddresses(ctx context.Context, target string) []dns.RR {
+	zname, rname := GetZoneAndRecord(plug.Config.Zones, target)
+	if zname == "" {
+		return nil
+	}
+
+	record, err := plug.GetZoneRecord(ctx, zname, rname)
+	if err != nil {
+		logging.Log.Errorf("Error receiving value for zone '%s' and name '%s': %v", zname, rname, err)
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+		return nil
+	}
+
+	if record == nil {
+		return nil
+	}
+
+	ttl := plug.Config.GetRecordTTL(zname, record)
+	extra := new(dns.Msg)
+
+	for _, rec := range record.Records {
+		var err error
+
+		switch rec.Type {
+		case "A":
+			_, err = records.AppendARecords(extra, target, ttl, rec.Value)
+		case "AAAA":
+			_, err = records.AppendAAAARecords(extra, target, ttl, rec.Value)
+		}
+
+		if err != nil {
+			logging.Log.Errorf("Error parsing JSON for %s record: %v", rec.Type, err)
+			IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+		}
+	}
+
+	return extra.Answer
+}
@@ -0,0 +1,110 @@
+package consulkv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+func TestMXRecords(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"@": `{"ttl":300,"records":[{"type":"MX","value":[` +
+				`{"preference":10,"exchange":"mail.example.com"},{"preference":20,"exchange":"mx.example.net"}]}]}`,
+			"mail": `{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]},{"type":"AAAA","value":["fd00::1"]}]}`,
+		},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeMX)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+		tst.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 2 {
+		tst.Fatalf("Expected 2 MX records, got %v", rec.Msg.Answer)
+	}
+
+	// Only the exchange within the zone has glue, the external one is left to the resolver
+	if len(rec.Msg.Extra) != 2 {
+		tst.Fatalf("Expected A and AAAA of 'mail.example.com' in additional section, got %v", rec.Msg.Extra)
+	}
+
+	for _, rr := range rec.Msg.Extra {
+		if rr.Header().Name != "mail.example.com." {
+			tst.Errorf("Expected glue for 'mail.example.com.', got %v", rr)
+		}
+	}
+
+	// Invalid entries don't leave a partial RRset behind
+	msg := new(dns.Msg)
+	_, err := records.AppendMXRecords(msg, "example.com.", 300, json.RawMessage(`[{"preference":10,"exchange":"mail.example.com"},{"preference":20}]`))
+	if err == nil || len(msg.Answer) != 0 {
+		tst.Errorf("Expected error without any appended MX record, got %v (%v)", msg.Answer, err)
+	}
+}
+
+func TestAdditionalRecords(tst *testing.T) {
+	values := map[string]string{
+		"_sip._tcp": `{"ttl":300,"records":[{"type":"SRV","value":[` +
+			`{"target":"sip1.example.com","port":5060,"priority":10,"weight":10},` +
+			`{"target":"sip1.example.com","port":5061,"priority":10,"weight":10},` +
+			`{"target":"sip2.example.com","port":5060,"priority":20,"weight":10},` +
+			`{"target":"sip.example.net","port":5060,"priority":30,"weight":10}]}]}`,
+		"sip1":    `{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]},{"type":"AAAA","value":["fd00::1"]}]}`,
+		"sip2":    `{"ttl":300,"records":[{"type":"A","value":["192.168.0.2"]}]}`,
+		"service": `{"ttl":300,"records":[{"type":"HTTPS","value":[{"priority":1,"target":"sip2.example.com"}]}]}`,
+	}
+
+	targets := ""
+	for i := 0; i < 10; i++ {
+		if i > 0 {
+			targets += ","
+		}
+		targets += fmt.Sprintf(`{"target":"host%d.example.com","port":80}`, i)
+		values[fmt.Sprintf("host%d", i)] = fmt.Sprintf(`{"ttl":300,"records":[{"type":"AAAA","value":["fd00::%d","fd00::1:%d"]}]}`, i, i)
+	}
+	values["_http._tcp"] = `{"ttl":300,"records":[{"type":"SRV","value":[` + targets + `]}]}`
+
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{"example.com": values})
+
+	serve := func(qname string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, qtype)
+		req.SetEdns0(1232, false)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+			tst.Fatalf("Unexpected error: %v", err)
+		}
+
+		return rec.Msg
+	}
+
+	m := serve("_sip._tcp.example.com.", dns.TypeSRV)
+	if len(m.Answer) != 4 || len(m.Extra) != 3 {
+		tst.Errorf("Expected 4 SRV records with 3 additional addresses, got %v and %v", m.Answer, m.Extra)
+	}
+
+	m = serve("service.example.com.", dns.TypeHTTPS)
+	if len(m.Extra) != 1 || m.Extra[0].Header().Name != "sip2.example.com." {
+		tst.Errorf("Expected address of HTTPS target in additional section, got %v", m.Extra)
+	}
+
+	m = serve("_http._tcp.example.com.", dns.TypeSRV)
+	if len(m.Answer) != 10 || len(m.Extra) <= 1 || len(m.Extra) >= 20 {
+		tst.Errorf("Expected additional section to be cut, got %d records", len(m.Extra))
+	}
+
+	if m.Truncated || m.Len() > 1232 {
+		tst.Errorf("Expected response to fit into 1232 bytes without truncation, got %d", m.Len())
+	}
+}
@@ -0,0 +1,199 @@
+package consulkv
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+)
+
+const (
+	aliasCacheMaxEntries  = 10000
+	aliasCacheNegativeTTL = 30
+)
+
+// AliasCache keeps the addresses of ALIAS targets outside of the configured zones
+// for the TTL they were resolved with.
+type AliasCache struct {
+	mu      sync.Mutex
+	entries map[string]*aliasCacheEntry
+}
+
+type aliasCacheEntry struct {
+	rrs     []dns.RR
+	expires time.Time
+}
+
+func CreateAliasCache() *AliasCache {
+	return &AliasCache{
+		entries: make(map[string]*aliasCacheEntry),
+	}
+}
+
+func (cache *AliasCache) Get(target string, qtype uint16) ([]dns.RR, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, exists := cache.entries[getAliasCacheKey(target, qtype)]
+	if !exists || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	return entry.rrs, true
+}
+
+func (cache *AliasCache) Set(target string, qtype uint16, rrs []dns.RR, ttl uint32) {
+	key := getAliasCacheKey(target, qtype)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if _, exists := cache.entries[key]; !exists && len(cache.entries) >= aliasCacheMaxEntries {
+		for k := range cache.entries {
+			delete(cache.entries, k)
+			break
+		}
+	}
+
+	cache.entries[key] = &aliasCacheEntry{
+		rrs:     rrs,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+func getAliasCacheKey(target string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(target)) + "/" + dns.TypeToString[qtype]
+}
+
+// AppendALIASRecords resolves the target of an ALIAS record and adds its A or AAAA records
+// under the queried name. Targets within the configured zones are resolved internally,
+// all other targets are resolved by the next plugin and cached.
+// The TTL of every record is the minimum of the ALIAS TTL and the TTLs seen while resolving.
+func (plug *ConsulKVPlugin) AppendALIASRecords(ctx context.Context, msg *dns.Msg, qname string, qtype uint16, ttl int, value json.RawMessage) (bool, error) {
+	var target string
+	if err := json.Unmarshal(value, &target); err != nil {
+		logging.Log.Errorf("Error parsing JSON for ALIAS record: %v", err)
+		IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+
+		return false, nil
+	}
+
+	target = dns.Fqdn(target)
+
+	ctx, err := followCNAME(ctx, qname, target)
+	if err != nil {
+		return false, err
+	}
+
+	var answers []dns.RR
+	if zname, rname := GetZoneAndRecord(plug.Config.Zones, target); zname != "" {
+		answers, err = plug.ResolveInternalAlias(ctx, zname, rname, target, qtype)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		answers = plug.ResolveExternalAlias(ctx, target, qtype)
+	}
+
+	minTTL := uint32(ttl)
+	for _, rr := range answers {
+		if rr.Header().Ttl < minTTL {
+			minTTL = rr.Header().Ttl
+		}
+	}
+
+	found := false
+	for _, rr := range answers {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		rr.Header().Name = dns.Fqdn(qname)
+		rr.Header().Ttl = minTTL
+
+		msg.Answer = append(msg.Answer, rr)
+		found = true
+	}
+
+	return found, nil
+}
+
+func (plug *ConsulKVPlugin) ResolveInternalAlias(ctx context.Context, zname, rname, target string, qtype uint16) ([]dns.RR, error) {
+	record, err := plug.GetZoneRecord(ctx, zname, rname)
+	if err != nil {
+		logging.Log.Errorf("Error receiving value for zone '%s' and name '%s': %v", zname, rname, err)
+		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+		return nil, nil
+	}
+
+	if record == nil {
+		logging.Log.Debugf("No record found for ALIAS target '%s'", target)
+		return nil, nil
+	}
+
+	resolved := new(dns.Msg)
+	if _, err := plug.HandleRecord(ctx, resolved, target, qtype, record); err != nil {
+		return nil, err
+	}
+
+	return resolved.Answer, nil
+}
+
+func (plug *ConsulKVPlugin) ResolveExternalAlias(ctx context.Context, target string, qtype uint16) []dns.RR {
+	MarkUncacheable(ctx)
+
+	if plug.Aliases != nil {
+		if rrs, exists := plug.Aliases.Get(target, qtype); exists {
+			return rrs
+		}
+	}
+
+	logging.Log.Debugf("Resolving external ALIAS target: %s", target)
+
+	resolved := new(dns.Msg)
+	req := new(dns.Msg)
+	req.SetQuestion(target, qtype)
+
+	writer := &aliasResponseWriter{ResponseWriterWrapper: ResponseWriterWrapper{WrappedMsg: resolved}, rcode: -1}
+	rcode, err := plugin.NextOrFailure(plug.Name(), plug.Next, ctx, writer, req)
+	if err != nil {
+		logging.Log.Errorf("Error resolving ALIAS target '%s': %v", target, err)
+		return nil
+	}
+
+	if !plugin.ClientWrite(rcode) {
+		writer.rcode = rcode
+	}
+
+	// Failures of the next plugin are temporary, so only actual answers are kept
+	if plug.Aliases != nil && (writer.rcode == dns.RcodeSuccess || writer.rcode == dns.RcodeNameError) {
+		ttl := uint32(aliasCacheNegativeTTL)
+		for i, rr := range resolved.Answer {
+			if i == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+
+		plug.Aliases.Set(target, qtype, resolved.Answer, ttl)
+	}
+
+	return resolved.Answer
+}
+
+// aliasResponseWriter captures the answer and response code of an external ALIAS target.
+type aliasResponseWriter struct {
+	ResponseWriterWrapper
+	rcode int
+}
+
+func (w *aliasResponseWriter) WriteMsg(res *dns.Msg) error {
+	w.rcode = res.Rcode
+	return w.ResponseWriterWrapper.WriteMsg(res)
+}
@@ -0,0 +1,98 @@
+package consulkv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestALIASRecords(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"@":    `{"ttl":300,"records":[{"type":"ALIAS","value":"lb.example.com"}]}`,
+			"lb":   `{"ttl":60,"records":[{"type":"A","value":["192.168.0.1","192.168.0.2"]}]}`,
+			"ext":  `{"ttl":300,"records":[{"type":"ALIAS","value":"lb.example.net"}]}`,
+			"fail": `{"ttl":300,"records":[{"type":"ALIAS","value":"fail.example.net"}]}`,
+			"deny": `{"ttl":300,"records":[{"type":"ALIAS","value":"refused.example.net"}]}`,
+			"loop": `{"ttl":300,"records":[{"type":"ALIAS","value":"loop.example.com"}]}`,
+		},
+	})
+
+	lookups := 0
+	plug.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		lookups++
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		switch r.Question[0].Name {
+		case "fail.example.net.":
+			m.Rcode = dns.RcodeServerFailure
+		case "refused.example.net.":
+			return dns.RcodeRefused, nil
+		}
+
+		if r.Question[0].Qtype == dns.TypeA && m.Rcode == dns.RcodeSuccess {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 120 IN A 203.0.113.1")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+
+	serve := func(qname string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, qtype)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		plug.ServeDNS(context.Background(), rec, req)
+
+		return rec.Msg
+	}
+
+	m := serve("example.com.", dns.TypeA)
+	if len(m.Answer) != 2 {
+		tst.Fatalf("Expected 2 A records for internal ALIAS, got %v", m.Answer)
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Name != "example.com." || rr.Header().Ttl != 60 {
+			tst.Errorf("Expected A record owned by 'example.com.' with TTL 60, got %v", rr)
+		}
+	}
+
+	m = serve("example.com.", dns.TypeAAAA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || len(m.Ns) == 0 {
+		tst.Errorf("Expected NODATA for AAAA of internal ALIAS, got %v", m)
+	}
+
+	for i := 0; i < 2; i++ {
+		m = serve("ext.example.com.", dns.TypeA)
+		if len(m.Answer) != 1 || m.Answer[0].Header().Name != "ext.example.com." || m.Answer[0].Header().Ttl != 120 {
+			tst.Errorf("Expected external A record owned by 'ext.example.com.' with TTL 120, got %v", m.Answer)
+		}
+	}
+
+	if lookups != 1 {
+		tst.Errorf("Expected external ALIAS target to be cached, got %d lookups", lookups)
+	}
+
+	// Failed lookups of the next plugin are retried with the next query
+	lookups = 0
+	for i := 0; i < 2; i++ {
+		serve("fail.example.com.", dns.TypeA)
+		serve("deny.example.com.", dns.TypeA)
+	}
+
+	if lookups != 4 {
+		tst.Errorf("Expected failed ALIAS targets not to be cached, got %d lookups", lookups)
+	}
+
+	if m = serve("loop.example.com.", dns.TypeA); m.Rcode != dns.RcodeServerFailure {
+		tst.Errorf("Expected SERVFAIL for ALIAS loop, got %s", dns.RcodeToString[m.Rcode])
+	}
+}
@@ -3,6 +3,9 @@ package consulkv
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
@@ -11,59 +14,115 @@ import (
 	"github.com/mwantia/coredns-consulkv-plugin/types"
 )
 
-func (plug *ConsulKVPlugin) AppendCNAMERecords(ctx context.Context, msg *dns.Msg, qname string, qtype uint16, ttl int, value json.RawMessage) bool {
+const cnameMaxDepth = 10
+
+var (
+	errCNAMELoop  = errors.New("CNAME loop detected")
+	errCNAMEDepth = errors.New("CNAME chain too long")
+)
+
+type cnameChainKey struct{}
+
+// followCNAME records the next step of a CNAME chain in the context.
+// Returns an error if the alias was already visited or the chain gets too long.
+func followCNAME(ctx context.Context, qname, alias string) (context.Context, error) {
+	chain, _ := ctx.Value(cnameChainKey{}).([]string)
+	if len(chain) == 0 {
+		chain = []string{strings.ToLower(dns.Fqdn(qname))}
+	}
+
+	alias = strings.ToLower(dns.Fqdn(alias))
+	for _, name := range chain {
+		if name == alias {
+			return ctx, fmt.Errorf("%w: %s -> %s", errCNAMELoop, strings.Join(chain, " -> "), alias)
+		}
+	}
+
+	if len(chain) > cnameMaxDepth {
+		return ctx, fmt.Errorf("%w: '%s' exceeds %d steps", errCNAMEDepth, chain[0], cnameMaxDepth)
+	}
+
+	next := append(append(make([]string, 0, len(chain)+1), chain...), alias)
+	return context.WithValue(ctx, cnameChainKey{}, next), nil
+}
+
+// AppendCNAMERecords adds the CNAME record and, depending on the flattening mode, follows
+// the chain to the records of the alias with the original query type.
+// Returns an error if the chain contains a loop or is too long.
+func (plug *ConsulKVPlugin) AppendCNAMERecords(ctx context.Context, msg *dns.Msg, qname string, qtype uint16, ttl int, value json.RawMessage) (bool, error) {
 	var alias string
 	if err := json.Unmarshal(value, &alias); err != nil {
 		logging.Log.Errorf("Error parsing JSON for CNAME record: %v", err)
 		IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
 
-		return false
+		return false, nil
 	}
 
+	alias = dns.Fqdn(alias)
 	rr := &dns.CNAME{
 		Hdr:    dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: uint32(ttl)},
-		Target: dns.Fqdn(alias),
+		Target: alias,
 	}
 	msg.Answer = append(msg.Answer, rr)
 
-	if plug.Config.Flattening == types.Flattening_None {
+	if qtype == dns.TypeCNAME {
+		return true, nil
+	}
+
+	flattening := plug.Config.GetFlattening(GetZone(plug.Config.Zones, qname))
+	if flattening == types.Flattening_None {
 		logging.Log.Debugf("CNAME flattening disabled; Only returning CNAME record for '%s'", alias)
 
-		return true
+		return true, nil
+	}
+
+	ctx, err := followCNAME(ctx, qname, alias)
+	if err != nil {
+		return true, err
 	}
 
 	zname, rname := GetZoneAndRecord(plug.Config.Zones, alias)
 	if zname == "" {
-		if plug.Config.Flattening == types.Flattening_Full {
-			logging.Log.Debugf("Zone %s not in configured zones %s, passing to next plugin ", zname, plug.Config.Zones)
-			return plug.HandleExternalCNAME(ctx, msg, alias, qtype)
+		if flattening == types.Flattening_Full {
+			logging.Log.Debugf("Alias %s not in configured zones %s, passing to next plugin ", alias, plug.Config.Zones)
+			plug.HandleExternalCNAME(ctx, msg, alias, qtype)
+
+			return true, nil
 		}
 
-		logging.Log.Debugf("Zone %s not in configured zones %s, skipping CNAME flattening", zname, plug.Config.Zones)
-		return true
+		logging.Log.Debugf("Alias %s not in configured zones %s, skipping CNAME flattening", alias, plug.Config.Zones)
+		return true, nil
 	}
 
-	logging.Log.Debugf("Received new request for zone '%s' and record '%s' with code '%s", zname, rname, dns.TypeToString[qtype])
+	logging.Log.Debugf("Following CNAME to zone '%s' and record '%s' with code '%s", zname, rname, dns.TypeToString[qtype])
 
-	record, err := plug.Consul.GetZoneRecordFromConsul(zname, rname, plug.Config.ConsulCache)
+	record, err := plug.GetZoneRecord(ctx, zname, rname)
 	if err != nil {
 		logging.Log.Errorf("Error receiving value for zone '%s' and name '%s': %v", zname, rname, err)
 		IncrementMetricsPluginErrorsTotal("CONSUL_GET")
 
-		return false
+		return true, nil
 	}
 
-	if record != nil {
-		return plug.HandleRecord(ctx, msg, rname, dns.TypeA, record)
+	if record == nil {
+		logging.Log.Debugf("No record found for alias '%s' and type '%s'", alias, dns.TypeToString[qtype])
+		return true, nil
 	}
 
-	logging.Log.Debugf("No record found for alias '%s' and type '%s'", alias, dns.TypeToString[qtype])
+	if _, err := plug.HandleRecord(ctx, msg, alias, qtype, record); err != nil {
+		return true, err
+	}
 
-	return true
+	return true, nil
 }
 
+// HandleExternalCNAME resolves an alias outside of the configured zones with the next plugin.
+// Returns true if any records have been added to the answer section.
 func (plug *ConsulKVPlugin) HandleExternalCNAME(ctx context.Context, msg *dns.Msg, alias string, qtype uint16) bool {
 	logging.Log.Debugf("Resolving external CNAME target: %s", alias)
+	MarkUncacheable(ctx)
+
+	answers := len(msg.Answer)
 
 	request := request.Request{W: &ResponseWriterWrapper{WrappedMsg: msg}, Req: new(dns.Msg)}
 	request.Req.SetQuestion(dns.Fqdn(alias), qtype)
@@ -74,5 +133,5 @@ func (plug *ConsulKVPlugin) HandleExternalCNAME(ctx context.Context, msg *dns.Ms
 		return false
 	}
 
-	return len(msg.Answer) > len(msg.Answer)-1
+	return len(msg.Answer) > answers
 }
@@ -0,0 +1,72 @@
+package consulkv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestCNAMEChain(tst *testing.T) {
+	values := map[string]string{
+		"www":   `{"ttl":300,"records":[{"type":"CNAME","value":"app.example.com"}]}`,
+		"app":   `{"ttl":300,"records":[{"type":"CNAME","value":"host.example.com"}]}`,
+		"host":  `{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]},{"type":"AAAA","value":["fd00::1"]}]}`,
+		"loop1": `{"ttl":300,"records":[{"type":"CNAME","value":"loop2.example.com"}]}`,
+		"loop2": `{"ttl":300,"records":[{"type":"CNAME","value":"LOOP1.example.com"}]}`,
+		"self":  `{"ttl":300,"records":[{"type":"CNAME","value":"self.example.com"}]}`,
+	}
+
+	for i := 0; i < 20; i++ {
+		values[fmt.Sprintf("chain%d", i)] = fmt.Sprintf(`{"ttl":300,"records":[{"type":"CNAME","value":"chain%d.example.com"}]}`, i+1)
+	}
+	values["chain20"] = `{"ttl":300,"records":[{"type":"A","value":["192.168.0.20"]}]}`
+
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{"example.com": values})
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []string
+	}{
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"www.example.com./CNAME", "app.example.com./CNAME", "host.example.com./AAAA"}},
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com./CNAME", "app.example.com./CNAME", "host.example.com./A"}},
+		{"www.example.com.", dns.TypeCNAME, dns.RcodeSuccess, []string{"www.example.com./CNAME"}},
+		{"www.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{"www.example.com./CNAME", "app.example.com./CNAME"}},
+		{"loop1.example.com.", dns.TypeA, dns.RcodeServerFailure, nil},
+		{"self.example.com.", dns.TypeA, dns.RcodeServerFailure, nil},
+		{"chain0.example.com.", dns.TypeA, dns.RcodeServerFailure, nil},
+		{"chain12.example.com.", dns.TypeA, dns.RcodeSuccess, []string{
+			"chain12.example.com./CNAME", "chain13.example.com./CNAME", "chain14.example.com./CNAME", "chain15.example.com./CNAME",
+			"chain16.example.com./CNAME", "chain17.example.com./CNAME", "chain18.example.com./CNAME", "chain19.example.com./CNAME",
+			"chain20.example.com./A"}},
+	}
+
+	for _, tc := range tests {
+		tst.Run(tc.qname+"/"+dns.TypeToString[tc.qtype], func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qname, tc.qtype)
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			plug.ServeDNS(context.Background(), rec, req)
+
+			if rec.Msg.Rcode != tc.rcode {
+				t.Fatalf("Expected rcode %s, got %s", dns.RcodeToString[tc.rcode], dns.RcodeToString[rec.Msg.Rcode])
+			}
+
+			if len(rec.Msg.Answer) != len(tc.answer) {
+				t.Fatalf("Expected answers %v, got %v", tc.answer, rec.Msg.Answer)
+			}
+
+			for i, rr := range rec.Msg.Answer {
+				if got := rr.Header().Name + "/" + dns.TypeToString[rr.Header().Rrtype]; got != tc.answer[i] {
+					t.Errorf("Expected answer %s, got %s", tc.answer[i], got)
+				}
+			}
+		})
+	}
+}
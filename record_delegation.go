@@ -0,0 +1,122 @@
+package consulkv
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+// GetDelegation returns the delegation point at or above rname, i.e. the name closest to
+// the zone apex that owns a NS record, together with its record. Returns an empty name
+// if rname isn't delegated. The record of rname itself is returned as well, so it doesn't
+// have to be loaded again to answer the query.
+func (plug ConsulKVPlugin) GetDelegation(ctx context.Context, zname, rname string) (string, *records.Record, *records.Record, error) {
+	record, err := plug.GetZoneRecord(ctx, zname, rname)
+	if err != nil || rname == "@" {
+		return "", nil, record, err
+	}
+
+	labels := strings.Split(rname, ".")
+	if len(labels) > 1 {
+		// Without the zone mirror, only ancestors that exist are loaded
+		var names map[string]bool
+		if plug.Mirror == nil || !plug.Mirror.IsLoaded(zname) {
+			listed, err := plug.GetZoneRecordNames(ctx, zname)
+			if err != nil {
+				return "", nil, nil, err
+			}
+
+			names = make(map[string]bool, len(listed))
+			for _, name := range listed {
+				names[name] = true
+			}
+		}
+
+		for i := len(labels) - 1; i > 0; i-- {
+			name := strings.Join(labels[i:], ".")
+			if names != nil && !names[name] {
+				continue
+			}
+
+			ancestor, err := plug.GetZoneRecord(ctx, zname, name)
+			if err != nil {
+				return "", nil, nil, err
+			}
+
+			if hasRecordType(ancestor, "NS") {
+				return name, ancestor, record, nil
+			}
+		}
+	}
+
+	if hasRecordType(record, "NS") {
+		return rname, record, record, nil
+	}
+
+	return "", nil, record, nil
+}
+
+func hasRecordType(record *records.Record, rtype string) bool {
+	if record == nil {
+		return false
+	}
+
+	for _, rec := range record.Records {
+		if rec.Type == rtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HandleDelegation answers a query at or below a delegation point with a referral:
+// The NS records of the delegation in the authority section, glue for name servers within
+// the zone in the additional section and, for DNSSEC aware clients, the DS records.
+func (plug ConsulKVPlugin) HandleDelegation(ctx context.Context, zname, cut string, record *records.Record, state request.Request, writer dns.ResponseWriter) (int, error) {
+	r := state.Req
+	owner := GetRecordOwnerName(zname, cut)
+	ttl := plug.Config.GetRecordTTL(zname, record)
+
+	logging.Log.Debugf("Referring '%s' to delegation '%s' in zone '%s'", state.Name(), owner, zname)
+
+	msg := PrepareResponseReply(r, false)
+	msg.Authoritative = false
+
+	ns := new(dns.Msg)
+	ds := new(dns.Msg)
+
+	for _, rec := range record.Records {
+		var err error
+
+		switch rec.Type {
+		case "NS":
+			_, err = records.AppendNSRecords(ns, owner, ttl, rec.Value)
+		case "DS":
+			if state.Do() {
+				_, err = records.AppendDSRecords(ds, owner, ttl, rec.Value)
+			}
+		}
+
+		if err != nil {
+			logging.Log.Errorf("Error parsing JSON for %s record: %v", rec.Type, err)
+			IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+		}
+	}
+
+	msg.Ns = append(ns.Answer, ds.Answer...)
+
+	origin := dns.Fqdn(zname)
+	for _, rr := range ns.Answer {
+		target := rr.(*dns.NS).Ns
+		if dns.IsSubDomain(origin, target) {
+			plug.AppendAdditionalAddresses(ctx, msg, target)
+		}
+	}
+
+	return SendDNSResponse(zname, state.QType(), msg, writer)
+}
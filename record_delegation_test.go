@@ -0,0 +1,157 @@
+package consulkv
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func CreateDelegationTestPlugin(tst *testing.T) *ConsulKVPlugin {
+	return CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"@":       `{"ttl":3600,"records":[{"type":"SOA","value":{"mname":"ns.example.com","rname":"hostmaster.example.com","serial":1,"minimum":300}},{"type":"NS","value":["ns.example.com"]}]}`,
+			"lab":     `{"ttl":3600,"records":[{"type":"NS","value":["ns1.lab.example.com","ns.example.net"]},{"type":"DS","value":[{"key_tag":12345,"algorithm":13,"digest_type":2,"digest":"8cb0fc6c527506a053f4f14c8464bebbd6dede2738d11468dd953d7d6a3021f1"}]}]}`,
+			"ns1.lab": `{"ttl":3600,"records":[{"type":"A","value":["192.168.10.1"]}]}`,
+			"dev":     `{"ttl":3600,"records":[{"type":"NS","value":["ns.example.net"]}]}`,
+		},
+	})
+}
+
+func TestDelegation(tst *testing.T) {
+	plug := CreateDelegationTestPlugin(tst)
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		answer int
+		ns     int
+		extra  int
+	}{
+		{"Name below delegation", "www.lab.example.com.", dns.TypeA, 0, 2, 1},
+		{"Delegation point", "lab.example.com.", dns.TypeNS, 0, 2, 1},
+		{"Glue below delegation", "ns1.lab.example.com.", dns.TypeA, 0, 2, 1},
+		{"DS at delegation point", "lab.example.com.", dns.TypeDS, 1, 0, 0},
+		{"Delegation without glue", "www.dev.example.com.", dns.TypeA, 0, 1, 0},
+	}
+
+	for _, tc := range tests {
+		tst.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qname, tc.qtype)
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			m := rec.Msg
+			if len(m.Answer) != tc.answer || len(m.Ns) != tc.ns || len(m.Extra) != tc.extra {
+				t.Fatalf("Expected %d/%d/%d records, got %v / %v / %v", tc.answer, tc.ns, tc.extra, m.Answer, m.Ns, m.Extra)
+			}
+
+			if tc.answer == 0 && m.Authoritative {
+				t.Errorf("Expected referral to be non-authoritative")
+			}
+		})
+	}
+}
+
+func TestDelegationSigned(tst *testing.T) {
+	plug := CreateDelegationTestPlugin(tst)
+
+	zsk, err := ParseSigningKey("example.com", CreateTestSigningKey(tst, "example.com", dns.ZONE))
+	if err != nil {
+		tst.Fatalf("Unable to parse ZSK: %v", err)
+	}
+
+	plug.DNSSEC = CreateDNSSEC(plug.Consul)
+	plug.DNSSEC.signers["example.com"] = &ZoneSigner{Zone: "example.com.", Keys: []*SigningKey{zsk}, cache: make(map[uint64][]dns.RR)}
+
+	for qname, expected := range map[string]uint16{"www.lab.example.com.": dns.TypeDS, "www.dev.example.com.": dns.TypeNSEC} {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		req.SetEdns0(4096, true)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+			tst.Fatalf("Unexpected error: %v", err)
+		}
+
+		var signed, unsigned bool
+		for _, rr := range rec.Msg.Ns {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				if sig.TypeCovered == expected {
+					signed = true
+				} else if sig.TypeCovered == dns.TypeNS {
+					unsigned = true
+				}
+			}
+		}
+
+		if !signed || unsigned {
+			tst.Errorf("Expected signed %s and unsigned NS in referral for '%s', got %v", dns.TypeToString[expected], qname, rec.Msg.Ns)
+		}
+	}
+}
+
+func TestDelegationLookups(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		backend memory
+	}`)
+
+	plug, err := CreatePlugin(c)
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/@", []byte(`{"ttl":3600,"records":[{"type":"SOA","value":{"mname":"ns.example.com","rname":"hostmaster.example.com","serial":1,"minimum":300}}]}`))
+	backend.Put("dns/zones/example.com/lab", []byte(`{"ttl":3600,"records":[{"type":"NS","value":["ns.example.net"]}]}`))
+	backend.Put("dns/zones/example.com/a.b.c", []byte(`{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]}]}`))
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+
+	counting := &countingBackend{Backend: backend}
+	plug.Consul.Backend = counting
+
+	serve := func(qname string) *dns.Msg {
+		counting.gets = nil
+
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+			tst.Fatalf("Unexpected error: %v", err)
+		}
+
+		return rec.Msg
+	}
+
+	// Ancestors that don't exist aren't loaded, and the name itself is only loaded once
+	if m := serve("a.b.c.example.com."); len(m.Answer) != 1 {
+		tst.Errorf("Expected an answer, got %v", m)
+	}
+	if slices.Contains(counting.gets, "dns/zones/example.com/b.c") || slices.Contains(counting.gets, "dns/zones/example.com/c") {
+		tst.Errorf("Expected no lookups of missing ancestors, got %v", counting.gets)
+	}
+
+	loads := 0
+	for _, key := range counting.gets {
+		if key == "dns/zones/example.com/a.b.c" {
+			loads++
+		}
+	}
+	if loads != 1 {
+		tst.Errorf("Expected the name to be loaded once, got %v", counting.gets)
+	}
+
+	if m := serve("www.lab.example.com."); len(m.Ns) != 1 || m.Authoritative {
+		tst.Errorf("Expected a referral to 'lab.example.com.', got %v", m)
+	}
+}
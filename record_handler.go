@@ -8,14 +8,16 @@ import (
 	"github.com/mwantia/coredns-consulkv-plugin/records"
 )
 
-func (plug *ConsulKVPlugin) HandleRecord(ctx context.Context, msg *dns.Msg, qname string, qtype uint16, record *records.Record) bool {
-	ttl := GetDefaultTTL(record)
+// HandleRecord adds all entries of the record matching qtype to the message.
+// Returns an error if a CNAME chain couldn't be followed or Consul couldn't be reached.
+func (plug *ConsulKVPlugin) HandleRecord(ctx context.Context, msg *dns.Msg, qname string, qtype uint16, record *records.Record) (bool, error) {
+	zname, _ := GetZoneAndRecord(plug.Config.Zones, qname)
+	ttl := plug.Config.GetRecordTTL(zname, record)
 	foundRequestedType := false
 
 	logging.Log.Debugf("Amount of available records: %v", len(record.Records))
 
-	zname, _ := GetZoneAndRecord(plug.Config.Zones, qname)
-	soa, err := plug.Consul.GetSOARecordFromConsul(zname, plug.Config.ConsulCache)
+	soa, err := plug.GetSOARecord(zname)
 
 	if err != nil {
 		logging.Log.Errorf("Error loading SOA record: %v", err)
@@ -27,10 +29,13 @@ func (plug *ConsulKVPlugin) HandleRecord(ctx context.Context, msg *dns.Msg, qnam
 
 		switch rec.Type {
 		case "CNAME":
-			if qtype == dns.TypeCNAME || qtype == dns.TypeA || qtype == dns.TypeAAAA || (qtype == dns.TypeHTTPS && !foundRequestedType) {
-				foundRequestedType = plug.AppendCNAMERecords(ctx, msg, qname, qtype, ttl, rec.Value)
+			found, err := plug.AppendCNAMERecords(ctx, msg, qname, qtype, ttl, rec.Value)
+			if err != nil {
+				return false, err
 			}
 
+			foundRequestedType = found
+
 		case "NS":
 			if qtype == dns.TypeNS {
 				found, err := records.AppendNSRecords(msg, qname, ttl, rec.Value)
@@ -123,6 +128,83 @@ func (plug *ConsulKVPlugin) HandleRecord(ctx context.Context, msg *dns.Msg, qnam
 				foundRequestedType = found
 			}
 
+		case "MX":
+			if qtype == dns.TypeMX {
+				found, err := records.AppendMXRecords(msg, qname, ttl, rec.Value)
+				if err != nil {
+					logging.Log.Errorf("Error parsing JSON for MX record: %v", err)
+					IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+				}
+
+				foundRequestedType = found
+			}
+
+		case "CAA":
+			if qtype == dns.TypeCAA {
+				found, err := records.AppendCAARecords(msg, qname, ttl, rec.Value)
+				if err != nil {
+					logging.Log.Errorf("Error parsing JSON for CAA record: %v", err)
+					IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+				}
+
+				foundRequestedType = found
+			}
+
+		case "TLSA":
+			if qtype == dns.TypeTLSA {
+				found, err := records.AppendTLSARecords(msg, qname, ttl, rec.Value)
+				if err != nil {
+					logging.Log.Errorf("Error parsing JSON for TLSA record: %v", err)
+					IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+				}
+
+				foundRequestedType = found
+			}
+
+		case "SSHFP":
+			if qtype == dns.TypeSSHFP {
+				found, err := records.AppendSSHFPRecords(msg, qname, ttl, rec.Value)
+				if err != nil {
+					logging.Log.Errorf("Error parsing JSON for SSHFP record: %v", err)
+					IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+				}
+
+				foundRequestedType = found
+			}
+
+		case "DS":
+			if qtype == dns.TypeDS {
+				found, err := records.AppendDSRecords(msg, qname, ttl, rec.Value)
+				if err != nil {
+					logging.Log.Errorf("Error parsing JSON for DS record: %v", err)
+					IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+				}
+
+				foundRequestedType = found
+			}
+
+		case "ALIAS":
+			if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+				found, err := plug.AppendALIASRecords(ctx, msg, qname, qtype, ttl, rec.Value)
+				if err != nil {
+					return false, err
+				}
+
+				foundRequestedType = found
+			}
+
+		case "CONSUL_SERVICE":
+			if qtype == dns.TypeA || qtype == dns.TypeAAAA || qtype == dns.TypeSRV {
+				// Instances are kept current by the service catalog instead
+				MarkUncacheable(ctx)
+				found, err := plug.AppendConsulServiceRecords(msg, qname, qtype, ttl, rec.Value)
+				if err != nil {
+					return false, err
+				}
+
+				foundRequestedType = found
+			}
+
 		case "TXT":
 			txtAnswered, err := records.AppendTXTRecords(msg, qtype, qname, ttl, rec.Value)
 			if err != nil {
@@ -144,5 +226,5 @@ func (plug *ConsulKVPlugin) HandleRecord(ctx context.Context, msg *dns.Msg, qnam
 		records.AppendSOAToAuthority(msg, qname, soa)
 	}
 
-	return foundRequestedType
+	return foundRequestedType, nil
 }
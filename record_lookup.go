@@ -0,0 +1,122 @@
+package consulkv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+// GetZoneRecord returns the record as seen by the view stored in the context.
+func (plug ConsulKVPlugin) GetZoneRecord(ctx context.Context, zname, rname string) (*records.Record, error) {
+	TrackResponseZone(ctx, zname)
+
+	record, err := plug.getZoneRecord(zname, rname)
+	if err != nil {
+		MarkUncacheable(ctx)
+		return nil, err
+	}
+
+	if record == nil {
+		return nil, nil
+	}
+
+	return record.ForView(GetView(ctx)), nil
+}
+
+func (plug ConsulKVPlugin) getZoneRecord(zname, rname string) (*records.Record, error) {
+	if plug.Mirror != nil {
+		if record, loaded := plug.Mirror.GetZoneRecord(zname, rname); loaded {
+			if record == nil && plug.Mirror.IsInvalidRecord(zname, rname) {
+				return nil, fmt.Errorf("%w '%s/zones/%s/%s'", errInvalidRecord, plug.Consul.KVPrefix, zname, rname)
+			}
+
+			return record, nil
+		}
+	}
+
+	return plug.Consul.GetZoneRecordFromConsul(zname, rname, plug.GetConsulCache())
+}
+
+func (plug ConsulKVPlugin) GetSOARecord(zname string) (*records.SOARecord, error) {
+	if plug.Mirror != nil {
+		if record, loaded := plug.Mirror.GetZoneRecord(zname, "@"); loaded {
+			return GetSOAFromRecord(zname, record)
+		}
+	}
+
+	return plug.Consul.GetSOARecordFromConsul(zname, plug.GetConsulCache())
+}
+
+// GetZoneRecordNames returns the names of all records within the zone.
+// Without the zone mirror, the zone is only listed once per request (see WithZoneNames).
+func (plug ConsulKVPlugin) GetZoneRecordNames(ctx context.Context, zname string) ([]string, error) {
+	if plug.Mirror != nil {
+		if recs, loaded := plug.Mirror.GetZoneRecords(zname); loaded {
+			names := make([]string, 0, len(recs))
+			for name := range recs {
+				names = append(names, name)
+			}
+
+			return names, nil
+		}
+	}
+
+	listed, ok := ctx.Value(zoneNamesKey{}).(map[string][]string)
+	if ok {
+		if names, exists := listed[zname]; exists {
+			return names, nil
+		}
+	}
+
+	names, err := plug.Consul.ListZoneRecordNamesFromConsul(zname, plug.GetConsulCache())
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		listed[zname] = names
+	}
+
+	return names, nil
+}
+
+type zoneNamesKey struct{}
+
+// WithZoneNames returns a context that keeps the names of every zone listed while the request
+// is handled, so looking up empty non-terminals and wildcards for several labels lists a zone only once.
+func WithZoneNames(ctx context.Context) context.Context {
+	return context.WithValue(ctx, zoneNamesKey{}, make(map[string][]string))
+}
+
+func (plug ConsulKVPlugin) GetZoneRecords(zname string) (map[string]*records.Record, error) {
+	if plug.Mirror != nil {
+		if recs, loaded := plug.Mirror.GetZoneRecords(zname); loaded {
+			return recs, nil
+		}
+	}
+
+	recs, _, err := plug.Consul.ListZoneRecordsFromConsul(zname, CreateQueryOptions(plug.GetConsulCache()))
+	return recs, err
+}
+
+// GetConsulCache returns the cache options used to read records from Consul.
+// With the response cache enabled, records are only read after the cached answers
+// have been dropped, so they must not be served from the agent cache or a stale server.
+func (plug ConsulKVPlugin) GetConsulCache() *ConsulKVCache {
+	if plug.Cache == nil {
+		return plug.Config.ConsulCache
+	}
+
+	useCache, allowStale := false, false
+	cache := &ConsulKVCache{
+		UseCache:   &useCache,
+		AllowStale: &allowStale,
+	}
+
+	if plug.Config.ConsulCache != nil {
+		cache.Consistent = plug.Config.ConsulCache.Consistent
+	}
+
+	return cache
+}
@@ -0,0 +1,65 @@
+package consulkv
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+// GetWildcardRecord returns the wildcard record that synthesizes answers for a name
+// that doesn't exist in the zone (RFC 4592 section 4.1). The closest existing ancestor of
+// the name is its closest encloser; only a wildcard directly below it can match, so any
+// existing name in between blocks wildcards further up.
+func (plug ConsulKVPlugin) GetWildcardRecord(ctx context.Context, zname, rname string) (*records.Record, error) {
+	labels := strings.Split(rname, ".")
+
+	for i := 1; i < len(labels); i++ {
+		encloser := strings.Join(labels[i:], ".")
+
+		wildcard, err := plug.GetZoneRecord(ctx, zname, "*."+encloser)
+		if err != nil || wildcard != nil {
+			return wildcard, err
+		}
+
+		exists, err := plug.NameExists(ctx, zname, encloser)
+		if err != nil || exists {
+			return nil, err
+		}
+	}
+
+	return plug.GetZoneRecord(ctx, zname, "*")
+}
+
+// NameExists returns true if the name owns a record within the zone,
+// or if it is an empty non-terminal.
+func (plug ConsulKVPlugin) NameExists(ctx context.Context, zname, rname string) (bool, error) {
+	record, err := plug.GetZoneRecord(ctx, zname, rname)
+	if err != nil || record != nil {
+		return record != nil, err
+	}
+
+	return plug.IsEmptyNonTerminal(ctx, zname, rname)
+}
+
+// IsEmptyNonTerminal returns true if the name owns no records itself,
+// but other names exist below it (e.g. '_tcp' for '_sip._tcp').
+func (plug ConsulKVPlugin) IsEmptyNonTerminal(ctx context.Context, zname, rname string) (bool, error) {
+	if rname == "@" {
+		return false, nil
+	}
+
+	names, err := plug.GetZoneRecordNames(ctx, zname)
+	if err != nil {
+		return false, err
+	}
+
+	suffix := "." + rname
+	for _, name := range names {
+		if strings.HasSuffix(name, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,151 @@
+package consulkv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestWildcardRecords(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"@":     `{"ttl":3600,"records":[{"type":"SOA","value":{"mname":"ns.example.com","rname":"hostmaster.example.com","serial":1,"minimum":300}}]}`,
+			"*":     `{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]}]}`,
+			"*.dev": `{"ttl":300,"records":[{"type":"A","value":["192.168.0.2"]}]}`,
+			"b":     `{"ttl":300,"records":[{"type":"A","value":["192.168.0.3"]}]}`,
+			"host":  `{"ttl":300,"records":[{"type":"TXT","value":["text"]}]}`,
+		},
+	})
+
+	tests := []struct {
+		qname    string
+		rcode    int
+		expected string
+	}{
+		{"a.example.com.", dns.RcodeSuccess, "192.168.0.1"},
+		{"c.d.example.com.", dns.RcodeSuccess, "192.168.0.1"},
+		{"x.dev.example.com.", dns.RcodeSuccess, "192.168.0.2"},
+		{"y.x.dev.example.com.", dns.RcodeSuccess, "192.168.0.2"},
+		{"b.example.com.", dns.RcodeSuccess, "192.168.0.3"},
+		{"a.b.example.com.", dns.RcodeNameError, ""},
+		{"host.example.com.", dns.RcodeSuccess, ""},
+	}
+
+	for _, tc := range tests {
+		tst.Run(tc.qname, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qname, dns.TypeA)
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if rec.Msg.Rcode != tc.rcode {
+				t.Fatalf("Expected rcode %s, got %s", dns.RcodeToString[tc.rcode], dns.RcodeToString[rec.Msg.Rcode])
+			}
+
+			if tc.expected == "" {
+				if len(rec.Msg.Answer) != 0 {
+					t.Errorf("Expected no answer, got %v", rec.Msg.Answer)
+				}
+				return
+			}
+
+			if len(rec.Msg.Answer) != 1 {
+				t.Fatalf("Expected a single answer, got %v", rec.Msg.Answer)
+			}
+
+			a := rec.Msg.Answer[0].(*dns.A)
+			if a.A.String() != tc.expected || a.Hdr.Name != tc.qname {
+				t.Errorf("Expected %s owned by '%s', got %v", tc.expected, tc.qname, a)
+			}
+		})
+	}
+}
+
+func TestEmptyNonTerminals(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"@":         `{"ttl":3600,"records":[{"type":"SOA","value":{"mname":"ns.example.com","rname":"hostmaster.example.com","serial":1,"minimum":300}}]}`,
+			"*":         `{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]}]}`,
+			"_sip._tcp": `{"ttl":300,"records":[{"type":"SRV","value":[{"target":"sip.example.com","port":5060}]}]}`,
+			"a.b":       `{"ttl":300,"records":[{"type":"A","value":["192.168.0.2"]}]}`,
+		},
+	})
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"_tcp.example.com.", dns.TypeSRV, dns.RcodeSuccess, 0},
+		{"b.example.com.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"a.b.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		// The empty non-terminal is the closest encloser and blocks the wildcard at the apex
+		{"c.b.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+		{"c.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+	}
+
+	for _, tc := range tests {
+		tst.Run(tc.qname, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qname, tc.qtype)
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if rec.Msg.Rcode != tc.rcode || len(rec.Msg.Answer) != tc.answer {
+				t.Fatalf("Expected rcode %s with %d answers, got %s with %v",
+					dns.RcodeToString[tc.rcode], tc.answer, dns.RcodeToString[rec.Msg.Rcode], rec.Msg.Answer)
+			}
+
+			if tc.answer == 0 && (len(rec.Msg.Ns) == 0 || rec.Msg.Ns[0].Header().Rrtype != dns.TypeSOA) {
+				t.Errorf("Expected SOA in authority section, got %v", rec.Msg.Ns)
+			}
+		})
+	}
+}
+
+func TestEmptyNonTerminalsListing(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		backend memory
+	}`)
+
+	plug, err := CreatePlugin(c)
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/@", []byte(`{"ttl":3600,"records":[{"type":"SOA","value":{"mname":"ns.example.com","rname":"hostmaster.example.com","serial":1,"minimum":300}}]}`))
+	backend.Put("dns/zones/example.com/a.b", []byte(`{"ttl":300,"records":[{"type":"A","value":["192.168.0.2"]}]}`))
+	backend.Put("dns/zones/example.com/a.b/ignored", []byte(`{}`))
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+
+	counting := &countingBackend{Backend: backend}
+	plug.Consul.Backend = counting
+
+	req := new(dns.Msg)
+	req.SetQuestion("x.y.z.b.example.com.", dns.TypeA)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+		tst.Fatalf("Unexpected error: %v", err)
+	}
+
+	if rec.Msg.Rcode != dns.RcodeNameError {
+		tst.Errorf("Expected NXDOMAIN below the empty non-terminal, got %s", dns.RcodeToString[rec.Msg.Rcode])
+	}
+
+	if counting.keys != 1 {
+		tst.Errorf("Expected the zone to be listed once per request, got %d listings", counting.keys)
+	}
+}
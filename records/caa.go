@@ -0,0 +1,60 @@
+package records
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// CAA issuer critical flag (RFC 8659 section 4.1)
+const caaFlagCritical = 128
+
+type CAARecord struct {
+	Flag  uint8  `json:"flag"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+func AppendCAARecords(msg *dns.Msg, qname string, ttl int, value json.RawMessage) (bool, error) {
+	var records []CAARecord
+	if err := json.Unmarshal(value, &records); err != nil {
+		return false, err
+	}
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		if err := record.Validate(); err != nil {
+			return false, fmt.Errorf("invalid CAA record for '%s': %w", qname, err)
+		}
+
+		rr := &dns.CAA{
+			Hdr:   dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: uint32(ttl)},
+			Flag:  record.Flag,
+			Tag:   record.Tag,
+			Value: record.Value,
+		}
+		rrs = append(rrs, rr)
+	}
+
+	msg.Answer = append(msg.Answer, rrs...)
+	return len(rrs) > 0, nil
+}
+
+func (record CAARecord) Validate() error {
+	if record.Flag != 0 && record.Flag != caaFlagCritical {
+		return fmt.Errorf("flag must be 0 or %d, got %d", caaFlagCritical, record.Flag)
+	}
+
+	if len(record.Tag) == 0 || len(record.Tag) > 15 {
+		return fmt.Errorf("tag must be between 1 and 15 characters, got '%s'", record.Tag)
+	}
+
+	for _, char := range record.Tag {
+		if !((char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')) {
+			return fmt.Errorf("tag must be alphanumeric, got '%s'", record.Tag)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package records
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ConsulServiceRecord resolves a service from the Consul catalog at query time.
+type ConsulServiceRecord struct {
+	Service     string `json:"service"`
+	Tag         string `json:"tag,omitempty"`
+	Datacenter  string `json:"datacenter,omitempty"`
+	PassingOnly bool   `json:"passing_only,omitempty"`
+}
+
+// ServiceInstance is a single instance of a service returned by the Consul catalog.
+type ServiceInstance struct {
+	Node    string
+	Address string
+	Port    uint16
+}
+
+func (record ConsulServiceRecord) Key() string {
+	key := record.Service + "/" + record.Tag + "/" + record.Datacenter
+	if record.PassingOnly {
+		key += "/passing"
+	}
+
+	return key
+}
+
+// AppendConsulServiceRecords expands service instances into A, AAAA or SRV records.
+// Every SRV record uses '<node>.<qname>' of its instance as target, so the address of
+// each instance is added to the additional section under its own target.
+func AppendConsulServiceRecords(msg *dns.Msg, qname string, qtype uint16, ttl int, instances []ServiceInstance) bool {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		rrs := getServiceAddressRecords(qname, ttl, instances, qtype)
+		msg.Answer = append(msg.Answer, rrs...)
+
+		return len(rrs) > 0
+
+	case dns.TypeSRV:
+		labels := GetServiceInstanceLabels(instances)
+		found := false
+		seen := make(map[string]bool)
+
+		for i, instance := range instances {
+			target := labels[i] + "." + dns.Fqdn(qname)
+			key := fmt.Sprintf("%s:%d", target, instance.Port)
+
+			if seen[key] || instance.Port == 0 {
+				continue
+			}
+			found = true
+
+			msg.Answer = append(msg.Answer, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: uint32(ttl)},
+				Priority: 1,
+				Weight:   1,
+				Port:     instance.Port,
+				Target:   target,
+			})
+
+			// Instances on the same node share their target and its addresses
+			if !seen[target] {
+				msg.Extra = append(msg.Extra, getServiceAddressRecords(target, ttl, instances[i:i+1], dns.TypeA)...)
+				msg.Extra = append(msg.Extra, getServiceAddressRecords(target, ttl, instances[i:i+1], dns.TypeAAAA)...)
+			}
+
+			seen[key] = true
+			seen[target] = true
+		}
+
+		return found
+	}
+
+	return false
+}
+
+// GetServiceInstanceLabels returns the label of every instance used for its SRV target.
+// Labels are derived from the node name; instances on the same node with a different address
+// are told apart by their port.
+func GetServiceInstanceLabels(instances []ServiceInstance) []string {
+	labels := make([]string, len(instances))
+	addresses := make(map[string]string)
+
+	for i, instance := range instances {
+		label := getServiceInstanceLabel(instance.Node)
+		if label == "" {
+			label = getServiceInstanceLabel(instance.Address)
+		}
+
+		if address, taken := addresses[label]; taken && address != instance.Address {
+			label = fmt.Sprintf("%s-%d", label, instance.Port)
+			if address, taken := addresses[label]; taken && address != instance.Address {
+				label = fmt.Sprintf("%s-%d", label, i)
+			}
+		}
+
+		addresses[label] = instance.Address
+		labels[i] = label
+	}
+
+	return labels
+}
+
+// GetServiceInstanceRecord returns the addresses of all instances with the label
+// as A and AAAA entries, or nil if no instance uses the label.
+func GetServiceInstanceRecord(label string, ttl *int, instances []ServiceInstance) *Record {
+	var ipv4, ipv6 []string
+	seen := make(map[string]bool)
+
+	for i, l := range GetServiceInstanceLabels(instances) {
+		ip := net.ParseIP(instances[i].Address)
+		if l != strings.ToLower(label) || ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip.String())
+		} else {
+			ipv6 = append(ipv6, ip.String())
+		}
+	}
+
+	if len(ipv4) == 0 && len(ipv6) == 0 {
+		return nil
+	}
+
+	record := &Record{TTL: ttl}
+	if len(ipv4) > 0 {
+		value, _ := json.Marshal(ipv4)
+		record.Records = append(record.Records, RecordEntry{Type: "A", Value: value})
+	}
+	if len(ipv6) > 0 {
+		value, _ := json.Marshal(ipv6)
+		record.Records = append(record.Records, RecordEntry{Type: "AAAA", Value: value})
+	}
+
+	return record
+}
+
+func getServiceInstanceLabel(name string) string {
+	label := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+
+	return strings.Trim(label, "-")
+}
+
+func getServiceAddressRecords(qname string, ttl int, instances []ServiceInstance, qtype uint16) []dns.RR {
+	rrs := []dns.RR{}
+	seen := make(map[string]bool)
+
+	for _, instance := range instances {
+		ip := net.ParseIP(instance.Address)
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+
+		hdr := dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: qtype, Class: dns.ClassINET, Ttl: uint32(ttl)}
+		if ip4 := ip.To4(); ip4 != nil && qtype == dns.TypeA {
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && qtype == dns.TypeAAAA {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		} else {
+			continue
+		}
+
+		seen[ip.String()] = true
+	}
+
+	return rrs
+}
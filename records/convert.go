@@ -0,0 +1,280 @@
+package records
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// ToRRs expands every entry of the record into resource records owned by qname.
+// Entries that are resolved at query time (e.g. CNAME flattening) are returned as-is,
+// entries of unknown types are skipped.
+func ToRRs(qname string, record *Record) ([]dns.RR, error) {
+	ttl := GetRecordTTL(record)
+	msg := new(dns.Msg)
+
+	for _, rec := range record.Records {
+		var err error
+
+		switch rec.Type {
+		case "A":
+			_, err = AppendARecords(msg, qname, ttl, rec.Value)
+		case "AAAA":
+			_, err = AppendAAAARecords(msg, qname, ttl, rec.Value)
+		case "CNAME":
+			err = appendCNAMERecord(msg, qname, ttl, rec.Value)
+		case "NS":
+			_, err = AppendNSRecords(msg, qname, ttl, rec.Value)
+		case "MX":
+			_, err = AppendMXRecords(msg, qname, ttl, rec.Value)
+		case "SRV":
+			_, err = AppendSRVRecords(msg, qname, ttl, rec.Value)
+		case "TXT":
+			_, err = AppendTXTRecords(msg, dns.TypeTXT, qname, ttl, rec.Value)
+		case "CAA":
+			_, err = AppendCAARecords(msg, qname, ttl, rec.Value)
+		case "TLSA":
+			_, err = AppendTLSARecords(msg, qname, ttl, rec.Value)
+		case "SSHFP":
+			_, err = AppendSSHFPRecords(msg, qname, ttl, rec.Value)
+		case "DS":
+			_, err = AppendDSRecords(msg, qname, ttl, rec.Value)
+		case "SVCB":
+			_, err = AppendSVCBRecords(msg, qname, ttl, rec.Value, dns.TypeSVCB)
+		case "HTTPS":
+			_, err = AppendSVCBRecords(msg, qname, ttl, rec.Value, dns.TypeHTTPS)
+		case "PTR":
+			if IsDnsSdQuery(dns.Fqdn(qname)) {
+				_, err = AppendDnsSdPTRRecords(msg, qname, ttl, rec.Value)
+			} else {
+				_, err = AppendPTRRecords(msg, qname, ttl, rec.Value)
+			}
+		case "SOA":
+			var soa SOARecord
+			if err = json.Unmarshal(rec.Value, &soa); err == nil {
+				AppendSOARecord(msg, qname, &soa)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error parsing JSON for %s record of '%s': %w", rec.Type, qname, err)
+		}
+	}
+
+	return msg.Answer, nil
+}
+
+func appendCNAMERecord(msg *dns.Msg, qname string, ttl int, value json.RawMessage) error {
+	var alias string
+	if err := json.Unmarshal(value, &alias); err != nil {
+		return err
+	}
+
+	rr := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: uint32(ttl)},
+		Target: dns.Fqdn(alias),
+	}
+	msg.Answer = append(msg.Answer, rr)
+
+	return nil
+}
+
+// FromRRs converts a RRset back into record entries. All records have to be of the same type;
+// TXT records are converted into one entry per record, as every TXT entry holds a single record.
+func FromRRs(rrs []dns.RR) ([]RecordEntry, error) {
+	if len(rrs) == 0 {
+		return nil, nil
+	}
+
+	rtype := rrs[0].Header().Rrtype
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != rtype {
+			return nil, fmt.Errorf("RRset contains mixed types %s and %s", dns.TypeToString[rtype], dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+
+	var value interface{}
+
+	switch rtype {
+	case dns.TypeA:
+		ips := make([]string, 0, len(rrs))
+		for _, rr := range rrs {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		value = ips
+
+	case dns.TypeAAAA:
+		ips := make([]string, 0, len(rrs))
+		for _, rr := range rrs {
+			ips = append(ips, rr.(*dns.AAAA).AAAA.String())
+		}
+		value = ips
+
+	case dns.TypeCNAME:
+		if len(rrs) > 1 {
+			return nil, fmt.Errorf("CNAME RRset can only contain a single record")
+		}
+		value = trimDot(rrs[0].(*dns.CNAME).Target)
+
+	case dns.TypeNS:
+		names := make([]string, 0, len(rrs))
+		for _, rr := range rrs {
+			names = append(names, trimDot(rr.(*dns.NS).Ns))
+		}
+		value = names
+
+	case dns.TypePTR:
+		names := make([]string, 0, len(rrs))
+		for _, rr := range rrs {
+			names = append(names, trimDot(rr.(*dns.PTR).Ptr))
+		}
+		value = names
+
+	case dns.TypeMX:
+		mxs := make([]MXRecord, 0, len(rrs))
+		for _, rr := range rrs {
+			mx := rr.(*dns.MX)
+			mxs = append(mxs, MXRecord{Preference: mx.Preference, Exchange: trimDot(mx.Mx)})
+		}
+		value = mxs
+
+	case dns.TypeSRV:
+		srvs := make([]SRVRecord, 0, len(rrs))
+		for _, rr := range rrs {
+			srv := rr.(*dns.SRV)
+			srvs = append(srvs, SRVRecord{Target: trimDot(srv.Target), Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+		}
+		value = srvs
+
+	case dns.TypeTXT:
+		entries := make([]RecordEntry, 0, len(rrs))
+		for _, rr := range rrs {
+			raw, err := json.Marshal(rr.(*dns.TXT).Txt)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, RecordEntry{Type: "TXT", Value: raw})
+		}
+		return entries, nil
+
+	case dns.TypeCAA:
+		caas := make([]CAARecord, 0, len(rrs))
+		for _, rr := range rrs {
+			caa := rr.(*dns.CAA)
+			caas = append(caas, CAARecord{Flag: caa.Flag, Tag: caa.Tag, Value: caa.Value})
+		}
+		value = caas
+
+	case dns.TypeTLSA:
+		tlsas := make([]TLSARecord, 0, len(rrs))
+		for _, rr := range rrs {
+			tlsa := rr.(*dns.TLSA)
+			tlsas = append(tlsas, TLSARecord{Usage: tlsa.Usage, Selector: tlsa.Selector, MatchingType: tlsa.MatchingType, Certificate: tlsa.Certificate})
+		}
+		value = tlsas
+
+	case dns.TypeSSHFP:
+		sshfps := make([]SSHFPRecord, 0, len(rrs))
+		for _, rr := range rrs {
+			sshfp := rr.(*dns.SSHFP)
+			sshfps = append(sshfps, SSHFPRecord{Algorithm: sshfp.Algorithm, Type: sshfp.Type, Fingerprint: sshfp.FingerPrint})
+		}
+		value = sshfps
+
+	case dns.TypeDS:
+		dss := make([]DSRecord, 0, len(rrs))
+		for _, rr := range rrs {
+			ds := rr.(*dns.DS)
+			dss = append(dss, DSRecord{KeyTag: ds.KeyTag, Algorithm: ds.Algorithm, DigestType: ds.DigestType, Digest: ds.Digest})
+		}
+		value = dss
+
+	case dns.TypeSVCB, dns.TypeHTTPS:
+		svcbs := make([]SVCBRecord, 0, len(rrs))
+		for _, rr := range rrs {
+			var svcb *dns.SVCB
+			if https, ok := rr.(*dns.HTTPS); ok {
+				svcb = &https.SVCB
+			} else {
+				svcb = rr.(*dns.SVCB)
+			}
+
+			params := make(map[string]string, len(svcb.Value))
+			for _, kv := range svcb.Value {
+				params[kv.Key().String()] = kv.String()
+			}
+			svcbs = append(svcbs, SVCBRecord{Priority: svcb.Priority, Target: trimDot(svcb.Target), Params: params})
+		}
+		value = svcbs
+
+	case dns.TypeSOA:
+		if len(rrs) > 1 {
+			return nil, fmt.Errorf("SOA RRset can only contain a single record")
+		}
+		soa := rrs[0].(*dns.SOA)
+		value = SOARecord{
+			MNAME:   trimDot(soa.Ns),
+			RNAME:   trimDot(soa.Mbox),
+			SERIAL:  soa.Serial,
+			REFRESH: soa.Refresh,
+			RETRY:   soa.Retry,
+			EXPIRE:  soa.Expire,
+			MINIMUM: soa.Minttl,
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported record type %s", dns.TypeToString[rtype])
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return []RecordEntry{{Type: dns.TypeToString[rtype], Value: raw}}, nil
+}
+
+// GetRRset returns the records of the given type owned by qname.
+func (record *Record) GetRRset(qname string, rtype uint16) ([]dns.RR, error) {
+	filtered := &Record{TTL: record.TTL}
+	for _, rec := range record.Records {
+		if rec.Type == dns.TypeToString[rtype] {
+			filtered.Records = append(filtered.Records, rec)
+		}
+	}
+
+	return ToRRs(qname, filtered)
+}
+
+// SetRRset replaces all entries of the given type with the RRset;
+// an empty RRset removes the type from the record.
+func (record *Record) SetRRset(rtype uint16, rrs []dns.RR) error {
+	entries, err := FromRRs(rrs)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]RecordEntry, 0, len(record.Records)+len(entries))
+	for _, rec := range record.Records {
+		if rec.Type != dns.TypeToString[rtype] {
+			kept = append(kept, rec)
+		}
+	}
+
+	if record.TTL == nil && len(rrs) > 0 {
+		ttl := int(rrs[0].Header().Ttl)
+		record.TTL = &ttl
+	}
+
+	record.Records = append(kept, entries...)
+	return nil
+}
+
+func trimDot(name string) string {
+	if len(name) > 1 && name[len(name)-1] == '.' {
+		return name[:len(name)-1]
+	}
+
+	return name
+}
@@ -0,0 +1,74 @@
+package records
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type DSRecord struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest"`
+}
+
+func AppendDSRecords(msg *dns.Msg, qname string, ttl int, value json.RawMessage) (bool, error) {
+	var records []DSRecord
+	if err := json.Unmarshal(value, &records); err != nil {
+		return false, err
+	}
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		if err := record.Validate(); err != nil {
+			return false, fmt.Errorf("invalid DS record for '%s': %w", qname, err)
+		}
+
+		rr := &dns.DS{
+			Hdr:        dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: uint32(ttl)},
+			KeyTag:     record.KeyTag,
+			Algorithm:  record.Algorithm,
+			DigestType: record.DigestType,
+			Digest:     strings.ToUpper(record.Digest),
+		}
+		rrs = append(rrs, rr)
+	}
+
+	msg.Answer = append(msg.Answer, rrs...)
+	return len(rrs) > 0, nil
+}
+
+func (record DSRecord) Validate() error {
+	if record.Algorithm == 0 {
+		return fmt.Errorf("algorithm can't be 0")
+	}
+
+	data, err := hex.DecodeString(record.Digest)
+	if err != nil {
+		return fmt.Errorf("digest must be hex encoded: %w", err)
+	}
+
+	// Digest types from RFC 4034, RFC 4509 and RFC 6605
+	switch record.DigestType {
+	case dns.SHA1:
+		if len(data) != 20 {
+			return fmt.Errorf("SHA-1 digest must be 20 bytes, got %d", len(data))
+		}
+	case dns.SHA256:
+		if len(data) != 32 {
+			return fmt.Errorf("SHA-256 digest must be 32 bytes, got %d", len(data))
+		}
+	case dns.SHA384:
+		if len(data) != 48 {
+			return fmt.Errorf("SHA-384 digest must be 48 bytes, got %d", len(data))
+		}
+	default:
+		return fmt.Errorf("digest type must be 1 (SHA-1), 2 (SHA-256) or 4 (SHA-384), got %d", record.DigestType)
+	}
+
+	return nil
+}
@@ -8,11 +8,15 @@ import (
 )
 
 type Record struct {
-	TTL     *int `json:"ttl"`
-	Records []struct {
-		Type  string          `json:"type"`
-		Value json.RawMessage `json:"value"`
-	} `json:"records"`
+	TTL     *int          `json:"ttl"`
+	Records []RecordEntry `json:"records"`
+	// Views contains separate entries served instead of Records to clients of a view.
+	Views map[string][]RecordEntry `json:"views,omitempty"`
+}
+
+type RecordEntry struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
 }
 
 func HandleRecord(msg *dns.Msg, qname string, qtype uint16, record *Record) bool {
@@ -24,6 +28,54 @@ func HandleRecord(msg *dns.Msg, qname string, qtype uint16, record *Record) bool
 	return foundRequestedType
 }
 
+// Clone returns a deep copy of the record.
+func (record *Record) Clone() *Record {
+	clone := &Record{}
+
+	if record.TTL != nil {
+		ttl := *record.TTL
+		clone.TTL = &ttl
+	}
+
+	clone.Records = cloneEntries(record.Records)
+
+	if record.Views != nil {
+		clone.Views = make(map[string][]RecordEntry, len(record.Views))
+		for view, entries := range record.Views {
+			clone.Views[view] = cloneEntries(entries)
+		}
+	}
+
+	return clone
+}
+
+func cloneEntries(entries []RecordEntry) []RecordEntry {
+	clone := make([]RecordEntry, len(entries))
+	for i, rec := range entries {
+		clone[i] = RecordEntry{
+			Type:  rec.Type,
+			Value: append(json.RawMessage(nil), rec.Value...),
+		}
+	}
+
+	return clone
+}
+
+// ForView returns the record as seen by clients of the view.
+// Records without entries for the view are returned unchanged.
+func (record *Record) ForView(view string) *Record {
+	if view == "" {
+		return record
+	}
+
+	entries, exists := record.Views[view]
+	if !exists {
+		return record
+	}
+
+	return &Record{TTL: record.TTL, Records: entries}
+}
+
 func GetRecordTTL(record *Record) int {
 	if record.TTL != nil {
 		return *record.TTL
@@ -0,0 +1,37 @@
+package records
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+type MXRecord struct {
+	Preference uint16 `json:"preference"`
+	Exchange   string `json:"exchange"`
+}
+
+func AppendMXRecords(msg *dns.Msg, qname string, ttl int, value json.RawMessage) (bool, error) {
+	var records []MXRecord
+	if err := json.Unmarshal(value, &records); err != nil {
+		return false, err
+	}
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		if record.Exchange == "" {
+			return false, fmt.Errorf("MX record for '%s' is missing an exchange", qname)
+		}
+
+		rr := &dns.MX{
+			Hdr:        dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: uint32(ttl)},
+			Preference: record.Preference,
+			Mx:         dns.Fqdn(record.Exchange),
+		}
+		rrs = append(rrs, rr)
+	}
+
+	msg.Answer = append(msg.Answer, rrs...)
+	return len(rrs) > 0, nil
+}
@@ -0,0 +1,227 @@
+package records
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAppendSecurityRecords(tst *testing.T) {
+	sha256 := "8cb0fc6c527506a053f4f14c8464bebbd6dede2738d11468dd953d7d6a3021f1"
+
+	tests := []struct {
+		name   string
+		append func(*dns.Msg, string, int, json.RawMessage) (bool, error)
+		value  string
+		valid  bool
+	}{
+		{"CAA issue", AppendCAARecords, `[{"flag":0,"tag":"issue","value":"letsencrypt.org"}]`, true},
+		{"CAA critical", AppendCAARecords, `[{"flag":128,"tag":"tbs","value":"unknown"}]`, true},
+		{"CAA invalid flag", AppendCAARecords, `[{"flag":1,"tag":"issue","value":"letsencrypt.org"}]`, false},
+		{"CAA invalid tag", AppendCAARecords, `[{"flag":0,"tag":"is-sue","value":"letsencrypt.org"}]`, false},
+		{"CAA empty tag", AppendCAARecords, `[{"flag":0,"tag":"","value":"letsencrypt.org"}]`, false},
+		{"TLSA DANE-EE", AppendTLSARecords, `[{"usage":3,"selector":1,"matching_type":1,"certificate":"` + sha256 + `"}]`, true},
+		{"TLSA invalid usage", AppendTLSARecords, `[{"usage":4,"selector":1,"matching_type":1,"certificate":"` + sha256 + `"}]`, false},
+		{"TLSA invalid selector", AppendTLSARecords, `[{"usage":3,"selector":2,"matching_type":1,"certificate":"` + sha256 + `"}]`, false},
+		{"TLSA invalid matching type", AppendTLSARecords, `[{"usage":3,"selector":1,"matching_type":3,"certificate":"` + sha256 + `"}]`, false},
+		{"TLSA invalid hex", AppendTLSARecords, `[{"usage":3,"selector":1,"matching_type":1,"certificate":"xyz"}]`, false},
+		{"TLSA wrong length", AppendTLSARecords, `[{"usage":3,"selector":1,"matching_type":2,"certificate":"` + sha256 + `"}]`, false},
+		{"SSHFP Ed25519", AppendSSHFPRecords, `[{"algorithm":4,"type":2,"fingerprint":"` + sha256 + `"}]`, true},
+		{"SSHFP invalid algorithm", AppendSSHFPRecords, `[{"algorithm":5,"type":2,"fingerprint":"` + sha256 + `"}]`, false},
+		{"SSHFP invalid type", AppendSSHFPRecords, `[{"algorithm":4,"type":3,"fingerprint":"` + sha256 + `"}]`, false},
+		{"SSHFP wrong length", AppendSSHFPRecords, `[{"algorithm":4,"type":1,"fingerprint":"` + sha256 + `"}]`, false},
+		{"DS SHA-256", AppendDSRecords, `[{"key_tag":12345,"algorithm":13,"digest_type":2,"digest":"` + sha256 + `"}]`, true},
+		{"DS invalid algorithm", AppendDSRecords, `[{"key_tag":12345,"algorithm":0,"digest_type":2,"digest":"` + sha256 + `"}]`, false},
+		{"DS invalid digest type", AppendDSRecords, `[{"key_tag":12345,"algorithm":13,"digest_type":3,"digest":"` + sha256 + `"}]`, false},
+		{"DS wrong length", AppendDSRecords, `[{"key_tag":12345,"algorithm":13,"digest_type":1,"digest":"` + sha256 + `"}]`, false},
+	}
+
+	for _, tc := range tests {
+		tst.Run(tc.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			found, err := tc.append(msg, "example.com", 3600, json.RawMessage(tc.value))
+
+			if tc.valid {
+				if err != nil || !found || len(msg.Answer) != 1 {
+					t.Errorf("Expected one valid record, but got %v (error: %v)", msg.Answer, err)
+				}
+			} else if err == nil || len(msg.Answer) != 0 {
+				t.Errorf("Expected validation error, but got %v", msg.Answer)
+			}
+		})
+	}
+}
+
+func TestRecordRRsetRoundTrip(tst *testing.T) {
+	var record Record
+	value := `{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]},{"type":"MX","value":[{"preference":10,"exchange":"mail.example.com"}]}]}`
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		tst.Fatal(err)
+	}
+
+	txt1, _ := dns.NewRR(`www.example.com. 300 IN TXT "first"`)
+	txt2, _ := dns.NewRR(`www.example.com. 300 IN TXT "second"`)
+	if err := record.SetRRset(dns.TypeTXT, []dns.RR{txt1, txt2}); err != nil {
+		tst.Fatal(err)
+	}
+
+	rrs, err := record.GetRRset("www.example.com.", dns.TypeTXT)
+	if err != nil {
+		tst.Fatal(err)
+	}
+	if len(rrs) != 2 || !dns.IsDuplicate(rrs[0], txt1) || !dns.IsDuplicate(rrs[1], txt2) {
+		tst.Errorf("Expected TXT records to round-trip, got %v", rrs)
+	}
+
+	mx, err := record.GetRRset("www.example.com.", dns.TypeMX)
+	if err != nil {
+		tst.Fatal(err)
+	}
+	if len(mx) != 1 || mx[0].(*dns.MX).Mx != "mail.example.com." {
+		tst.Errorf("Expected MX record to be unchanged, got %v", mx)
+	}
+
+	if err := record.SetRRset(dns.TypeA, nil); err != nil {
+		tst.Fatal(err)
+	}
+	for _, rec := range record.Records {
+		if rec.Type == "A" {
+			tst.Errorf("Expected A records to be removed")
+		}
+	}
+}
+
+func TestZoneFileRoundTrip(tst *testing.T) {
+	zone := `$ORIGIN example.com.
+$TTL 3600
+@        IN SOA  ns1.example.com. hostmaster.example.com. 2024081001 7200 3600 1209600 300
+@        IN NS   ns1
+@        IN MX   10 mail
+ns1      IN A    192.168.0.1
+WWW  300 IN A    192.168.0.2
+www      IN A    192.168.0.3
+www      IN TXT  "hello world"
+ftp      IN CNAME www
+@        IN RRSIG SOA 13 2 3600 20240101000000 20231201000000 12345 example.com. dGVzdA==
+`
+
+	recs, err := ParseZoneFile(strings.NewReader(zone), "example.com", "test.zone")
+	if err != nil {
+		tst.Fatalf("Unable to parse zone file: %v", err)
+	}
+
+	if len(recs) != 4 {
+		tst.Fatalf("Expected 4 names, got %d", len(recs))
+	}
+
+	www := recs["www"]
+	if www == nil || *www.TTL != 300 || len(www.Records) != 2 {
+		tst.Fatalf("Expected 'www' with TTL 300 and A and TXT entries, got %+v", www)
+	}
+
+	apex := recs["@"]
+	if apex == nil || len(apex.Records) != 3 || apex.Records[0].Type != "SOA" {
+		tst.Fatalf("Expected apex with SOA, NS and MX entries, got %+v", apex)
+	}
+
+	recs["alias"] = &Record{Records: []RecordEntry{{Type: "ALIAS", Value: json.RawMessage(`"lb.example.net"`)}}}
+
+	var buf strings.Builder
+	if err := RenderZoneFile(&buf, "example.com", recs); err != nil {
+		tst.Fatalf("Unable to render zone file: %v", err)
+	}
+
+	rendered := buf.String()
+	if !strings.HasPrefix(rendered, "$ORIGIN example.com.\nexample.com.\t300\tIN\tSOA\t") {
+		tst.Errorf("Expected zone file to start with the SOA record, got:\n%s", rendered)
+	}
+
+	if !strings.Contains(rendered, `; alias.example.com. ALIAS "lb.example.net"`) {
+		tst.Errorf("Expected ALIAS entry to be rendered as comment, got:\n%s", rendered)
+	}
+
+	parsed, err := ParseZoneFile(strings.NewReader(rendered), "example.com", "rendered.zone")
+	if err != nil {
+		tst.Fatalf("Unable to parse rendered zone file: %v", err)
+	}
+
+	for name, record := range parsed {
+		expected, _ := json.Marshal(recs[name])
+		actual, _ := json.Marshal(record)
+
+		if string(expected) != string(actual) {
+			tst.Errorf("Expected '%s' to survive the round trip:\n%s\n%s", name, expected, actual)
+		}
+	}
+
+	if _, err := ParseZoneFile(strings.NewReader("www.example.org. 300 IN A 192.168.0.1\n"), "example.com", "test.zone"); err == nil {
+		tst.Errorf("Expected names outside of the zone to be rejected")
+	}
+}
+
+func TestValidateZone(tst *testing.T) {
+	values := map[string][]byte{
+		"@":       []byte(`{"records":[{"type":"SOA","value":{"mname":"ns1.example.com","rname":"hostmaster.example.com","serial":1,"refresh":7200,"retry":3600,"expire":1209600,"minimum":300}},{"type":"MX","value":[{"preference":10,"exchange":"mail.example.com"}]}]}`),
+		"www":     []byte(`{"ttl":300,"records":[{"type":"A","value":["192.168.0.1"]}]}`),
+		"bad-ip":  []byte(`{"records":[{"type":"A","value":["192.168.0.256"]}]}`),
+		"v6-as-4": []byte(`{"records":[{"type":"A","value":["2001:db8::1"]}]}`),
+		"broken":  []byte(`{"records":[`),
+		"unknown": []byte(`{"records":[{"type":"LOC","value":"52 22 23.000 N 4 53 32.000 E -2.00m"}]}`),
+		"both":    []byte(`{"records":[{"type":"CNAME","value":"www.example.com"},{"type":"TXT","value":["text"]}]}`),
+		"ftp":     []byte(`{"records":[{"type":"CNAME","value":"files.example.com"}]}`),
+		"ext":     []byte(`{"records":[{"type":"CNAME","value":"www.example.net"}]}`),
+		"wild":    []byte(`{"records":[{"type":"CNAME","value":"host.apps.example.com"}]}`),
+		"*.apps":  []byte(`{"records":[{"type":"A","value":["192.168.0.2"]}]}`),
+		"long":    []byte(`{"ttl":604800,"records":[{"type":"A","value":["192.168.0.3"]}]}`),
+	}
+
+	issues := ValidateZone("example.com", values, ValidateOptions{MaxTTL: 86400})
+
+	expected := map[string]string{
+		"@":       "missing NS record",
+		"@/mx":    "target 'mail.example.com.' doesn't exist",
+		"bad-ip":  "invalid address '192.168.0.256'",
+		"v6-as-4": "invalid address '2001:db8::1'",
+		"broken":  "unparseable value",
+		"unknown": "LOC entry: unknown type",
+		"both":    "CNAME can't coexist with other data",
+		"ftp":     "target 'files.example.com.' doesn't exist",
+		"long":    "ttl 604800 is out of bounds",
+	}
+
+	found := make(map[string]bool)
+	for _, issue := range issues {
+		matched := false
+		for key, message := range expected {
+			if strings.SplitN(key, "/", 2)[0] == issue.Name && strings.Contains(issue.Message, message) {
+				found[key] = true
+				matched = true
+			}
+		}
+
+		if !matched {
+			tst.Errorf("Unexpected issue %s", issue)
+		}
+	}
+
+	for key, message := range expected {
+		if !found[key] {
+			tst.Errorf("Expected issue '%s' for '%s'", message, key)
+		}
+	}
+
+	issues = ValidateZone("example.com", map[string][]byte{
+		"@": []byte(`{"records":[{"type":"CNAME","value":"www.example.net"}]}`),
+	}, ValidateOptions{})
+
+	messages := []string{}
+	for _, issue := range issues {
+		messages = append(messages, issue.Message)
+	}
+
+	if !strings.Contains(strings.Join(messages, ";"), "CNAME isn't allowed at zone apex") || !strings.Contains(strings.Join(messages, ";"), "missing SOA record") {
+		tst.Errorf("Expected CNAME at apex and missing SOA, got %v", messages)
+	}
+}
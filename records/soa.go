@@ -1,6 +1,7 @@
 package records
 
 import (
+	"encoding/json"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -45,3 +46,30 @@ func AppendSOARecord(msg *dns.Msg, qname string, soa *SOARecord) bool {
 
 	return true
 }
+
+// BumpSOASerial increments the serial of the SOA entry within the record.
+// Returns false if the record doesn't contain a SOA entry.
+func BumpSOASerial(record *Record) (bool, error) {
+	for i, rec := range record.Records {
+		if rec.Type != "SOA" {
+			continue
+		}
+
+		var soa SOARecord
+		if err := json.Unmarshal(rec.Value, &soa); err != nil {
+			return false, err
+		}
+
+		soa.SERIAL++
+
+		value, err := json.Marshal(soa)
+		if err != nil {
+			return false, err
+		}
+
+		record.Records[i].Value = value
+		return true, nil
+	}
+
+	return false, nil
+}
@@ -0,0 +1,70 @@
+package records
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type SSHFPRecord struct {
+	Algorithm   uint8  `json:"algorithm"`
+	Type        uint8  `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func AppendSSHFPRecords(msg *dns.Msg, qname string, ttl int, value json.RawMessage) (bool, error) {
+	var records []SSHFPRecord
+	if err := json.Unmarshal(value, &records); err != nil {
+		return false, err
+	}
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		if err := record.Validate(); err != nil {
+			return false, fmt.Errorf("invalid SSHFP record for '%s': %w", qname, err)
+		}
+
+		rr := &dns.SSHFP{
+			Hdr:         dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeSSHFP, Class: dns.ClassINET, Ttl: uint32(ttl)},
+			Algorithm:   record.Algorithm,
+			Type:        record.Type,
+			FingerPrint: strings.ToLower(record.Fingerprint),
+		}
+		rrs = append(rrs, rr)
+	}
+
+	msg.Answer = append(msg.Answer, rrs...)
+	return len(rrs) > 0, nil
+}
+
+func (record SSHFPRecord) Validate() error {
+	// Algorithms from RFC 4255, RFC 6594, RFC 7479 and RFC 8709
+	switch record.Algorithm {
+	case 1, 2, 3, 4, 6:
+	default:
+		return fmt.Errorf("algorithm must be one of 1 (RSA), 2 (DSA), 3 (ECDSA), 4 (Ed25519) or 6 (Ed448), got %d", record.Algorithm)
+	}
+
+	data, err := hex.DecodeString(record.Fingerprint)
+	if err != nil {
+		return fmt.Errorf("fingerprint must be hex encoded: %w", err)
+	}
+
+	switch record.Type {
+	case 1:
+		if len(data) != 20 {
+			return fmt.Errorf("SHA-1 fingerprint must be 20 bytes, got %d", len(data))
+		}
+	case 2:
+		if len(data) != 32 {
+			return fmt.Errorf("SHA-256 fingerprint must be 32 bytes, got %d", len(data))
+		}
+	default:
+		return fmt.Errorf("fingerprint type must be 1 (SHA-1) or 2 (SHA-256), got %d", record.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package records
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type TLSARecord struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	Certificate  string `json:"certificate"`
+}
+
+func AppendTLSARecords(msg *dns.Msg, qname string, ttl int, value json.RawMessage) (bool, error) {
+	var records []TLSARecord
+	if err := json.Unmarshal(value, &records); err != nil {
+		return false, err
+	}
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		if err := record.Validate(); err != nil {
+			return false, fmt.Errorf("invalid TLSA record for '%s': %w", qname, err)
+		}
+
+		rr := &dns.TLSA{
+			Hdr:          dns.RR_Header{Name: dns.Fqdn(qname), Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: uint32(ttl)},
+			Usage:        record.Usage,
+			Selector:     record.Selector,
+			MatchingType: record.MatchingType,
+			Certificate:  strings.ToLower(record.Certificate),
+		}
+		rrs = append(rrs, rr)
+	}
+
+	msg.Answer = append(msg.Answer, rrs...)
+	return len(rrs) > 0, nil
+}
+
+func (record TLSARecord) Validate() error {
+	// Certificate usages, selectors and matching types from RFC 6698 section 7
+	if record.Usage > 3 {
+		return fmt.Errorf("usage must be between 0 and 3, got %d", record.Usage)
+	}
+
+	if record.Selector > 1 {
+		return fmt.Errorf("selector must be 0 or 1, got %d", record.Selector)
+	}
+
+	if record.MatchingType > 2 {
+		return fmt.Errorf("matching type must be between 0 and 2, got %d", record.MatchingType)
+	}
+
+	data, err := hex.DecodeString(record.Certificate)
+	if err != nil {
+		return fmt.Errorf("certificate must be hex encoded: %w", err)
+	}
+
+	switch {
+	case len(data) == 0:
+		return fmt.Errorf("certificate can't be empty")
+	case record.MatchingType == 1 && len(data) != 32:
+		return fmt.Errorf("SHA-256 certificate data must be 32 bytes, got %d", len(data))
+	case record.MatchingType == 2 && len(data) != 64:
+		return fmt.Errorf("SHA-512 certificate data must be 64 bytes, got %d", len(data))
+	}
+
+	return nil
+}
@@ -0,0 +1,315 @@
+package records
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+
+	// RFC 2181, section 8
+	MaxTTL = 2147483647
+)
+
+// Issue is a single problem found while validating a record or zone.
+type Issue struct {
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (issue Issue) String() string {
+	return fmt.Sprintf("%s: %s: %s", issue.Name, issue.Severity, issue.Message)
+}
+
+// ValidateOptions defines the bounds every record TTL is checked against.
+type ValidateOptions struct {
+	MinTTL int
+	MaxTTL int
+}
+
+// ValidateRecord parses the value stored for name and checks every entry it contains.
+// The returned record is nil if the value can't be parsed at all.
+func ValidateRecord(name string, value []byte, options ValidateOptions) (*Record, []Issue) {
+	issues := []Issue{}
+	add := func(severity, format string, args ...interface{}) {
+		issues = append(issues, Issue{Name: name, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var record Record
+	if err := json.Unmarshal(value, &record); err != nil {
+		add(SeverityError, "unparseable value: %v", err)
+		return nil, issues
+	}
+
+	if name != strings.ToLower(name) {
+		add(SeverityWarning, "name isn't lower case and can't be found by queries")
+	}
+
+	if record.TTL != nil {
+		maxTTL := options.MaxTTL
+		if maxTTL <= 0 || maxTTL > MaxTTL {
+			maxTTL = MaxTTL
+		}
+
+		if *record.TTL < options.MinTTL || *record.TTL < 0 || *record.TTL > maxTTL {
+			add(SeverityWarning, "ttl %d is out of bounds (%d-%d)", *record.TTL, options.MinTTL, maxTTL)
+		}
+	}
+
+	if len(record.Records) == 0 && len(record.Views) == 0 {
+		add(SeverityWarning, "record doesn't contain any entries")
+	}
+
+	views := []string{""}
+	for view := range record.Views {
+		views = append(views, view)
+	}
+	sort.Strings(views[1:])
+
+	for _, view := range views {
+		entries := record.Records
+		if view != "" {
+			entries = record.Views[view]
+		}
+
+		prefix := ""
+		if view != "" {
+			prefix = fmt.Sprintf("view '%s': ", view)
+		}
+
+		cname := false
+		types := make(map[string]bool)
+
+		for _, rec := range entries {
+			if err := ValidateEntry(name, rec); err != nil {
+				add(SeverityError, "%s%s entry: %v", prefix, rec.Type, err)
+			}
+
+			cname = cname || rec.Type == "CNAME"
+			types[rec.Type] = true
+		}
+
+		if cname && len(types) > 1 {
+			add(SeverityError, "%sCNAME can't coexist with other data", prefix)
+		}
+	}
+
+	return &record, issues
+}
+
+// ValidateEntry checks that the value of a single entry can be served.
+func ValidateEntry(name string, rec RecordEntry) error {
+	switch rec.Type {
+	case "A", "AAAA":
+		var ips []string
+		if err := json.Unmarshal(rec.Value, &ips); err != nil {
+			return err
+		}
+
+		if len(ips) == 0 {
+			return fmt.Errorf("no addresses")
+		}
+
+		for _, ip := range ips {
+			parsed := net.ParseIP(ip)
+			if parsed == nil || (rec.Type == "A") != (parsed.To4() != nil) {
+				return fmt.Errorf("invalid address '%s'", ip)
+			}
+		}
+
+		return nil
+
+	case "ALIAS":
+		var target string
+		if err := json.Unmarshal(rec.Value, &target); err != nil {
+			return err
+		}
+
+		if _, ok := dns.IsDomainName(target); !ok || target == "" {
+			return fmt.Errorf("invalid target '%s'", target)
+		}
+
+		return nil
+
+	case "CONSUL_SERVICE":
+		var service ConsulServiceRecord
+		if err := json.Unmarshal(rec.Value, &service); err != nil {
+			return err
+		}
+
+		if service.Service == "" {
+			return fmt.Errorf("missing service")
+		}
+
+		return nil
+	}
+
+	if !IsConvertibleType(rec.Type) {
+		return fmt.Errorf("unknown type")
+	}
+
+	if _, err := ToRRs(GetAbsoluteName(name, "validate."), &Record{Records: []RecordEntry{rec}}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ValidateZone validates every record of the zone and checks the zone as a whole:
+// SOA and NS records at the apex, CNAME records at the apex and targets within the zone
+// that don't exist.
+func ValidateZone(zone string, values map[string][]byte, options ValidateOptions) []Issue {
+	issues := []Issue{}
+	recs := make(map[string]*Record, len(values))
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		record, found := ValidateRecord(name, values[name], options)
+		issues = append(issues, found...)
+
+		if record != nil {
+			recs[name] = record
+		}
+	}
+
+	apex, exists := recs["@"]
+	switch {
+	case !exists:
+		if _, unparseable := values["@"]; !unparseable {
+			issues = append(issues, Issue{Name: "@", Severity: SeverityError, Message: "missing record at zone apex"})
+		}
+	default:
+		if !hasEntryType(apex, "SOA") {
+			issues = append(issues, Issue{Name: "@", Severity: SeverityError, Message: "missing SOA record at zone apex"})
+		}
+		if !hasEntryType(apex, "NS") {
+			issues = append(issues, Issue{Name: "@", Severity: SeverityWarning, Message: "missing NS record at zone apex"})
+		}
+		if hasEntryType(apex, "CNAME") {
+			issues = append(issues, Issue{Name: "@", Severity: SeverityError, Message: "CNAME isn't allowed at zone apex"})
+		}
+	}
+
+	origin := strings.ToLower(dns.Fqdn(zone))
+	for _, name := range names {
+		record, exists := recs[name]
+		if !exists {
+			continue
+		}
+
+		for _, target := range getEntryTargets(record) {
+			target = strings.ToLower(dns.Fqdn(target))
+			if !dns.IsSubDomain(origin, target) {
+				continue
+			}
+
+			relative, err := GetRelativeName(target, origin)
+			if err != nil || nameExists(recs, relative) || isDelegated(recs, relative) {
+				continue
+			}
+
+			issues = append(issues, Issue{Name: name, Severity: SeverityWarning, Message: fmt.Sprintf("target '%s' doesn't exist within the zone", target)})
+		}
+	}
+
+	return issues
+}
+
+func hasEntryType(record *Record, rtype string) bool {
+	for _, rec := range record.Records {
+		if rec.Type == rtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getEntryTargets returns the names the entries of the record point to.
+func getEntryTargets(record *Record) []string {
+	targets := []string{}
+
+	for _, rec := range record.Records {
+		if rec.Type == "ALIAS" {
+			var target string
+			if err := json.Unmarshal(rec.Value, &target); err == nil {
+				targets = append(targets, target)
+			}
+			continue
+		}
+
+		if rec.Type == "PTR" || !IsConvertibleType(rec.Type) {
+			continue
+		}
+
+		rrs, err := ToRRs("validate.", &Record{Records: []RecordEntry{rec}})
+		if err != nil {
+			continue
+		}
+
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				targets = append(targets, rr.Target)
+			case *dns.MX:
+				targets = append(targets, rr.Mx)
+			case *dns.SRV:
+				targets = append(targets, rr.Target)
+			case *dns.NS:
+				targets = append(targets, rr.Ns)
+			case *dns.SVCB:
+				if rr.Target != "." {
+					targets = append(targets, rr.Target)
+				}
+			case *dns.HTTPS:
+				if rr.Target != "." {
+					targets = append(targets, rr.Target)
+				}
+			}
+		}
+	}
+
+	return targets
+}
+
+// nameExists returns true if the name has a record or is covered by a wildcard.
+func nameExists(recs map[string]*Record, name string) bool {
+	if _, exists := recs[name]; exists {
+		return true
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if _, exists := recs["*."+strings.Join(labels[i:], ".")]; exists {
+			return true
+		}
+	}
+
+	_, exists := recs["*"]
+	return exists
+}
+
+// isDelegated returns true if the name is below a zone cut within the zone.
+func isDelegated(recs map[string]*Record, name string) bool {
+	labels := dns.SplitDomainName(name)
+	for i := 0; i < len(labels); i++ {
+		if record, exists := recs[strings.Join(labels[i:], ".")]; exists && hasEntryType(record, "NS") {
+			return true
+		}
+	}
+
+	return false
+}
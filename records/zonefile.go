@@ -0,0 +1,194 @@
+package records
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ParseZoneFile parses a RFC 1035 master file and groups its records by owner
+// into one record per name relative to origin ('@' for the apex).
+// The TTL of each record is the lowest TTL of all records owned by the name,
+// except for the SOA record, which is always served with its minimum TTL.
+// DNSSEC records are skipped, as signatures are created by the plugin itself.
+func ParseZoneFile(reader io.Reader, origin, filename string) (map[string]*Record, error) {
+	origin = strings.ToLower(dns.Fqdn(origin))
+
+	parser := dns.NewZoneParser(reader, origin, filename)
+	parser.SetIncludeAllowed(false)
+
+	owners := make(map[string]map[uint16][]dns.RR)
+	order := make(map[string][]uint16)
+
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		header := rr.Header()
+		if header.Class != dns.ClassINET {
+			continue
+		}
+
+		switch header.Rrtype {
+		case dns.TypeDNSKEY, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM:
+			continue
+		}
+
+		name, err := GetRelativeName(header.Name, origin)
+		if err != nil {
+			return nil, err
+		}
+
+		if owners[name] == nil {
+			owners[name] = make(map[uint16][]dns.RR)
+		}
+		if len(owners[name][header.Rrtype]) == 0 {
+			order[name] = append(order[name], header.Rrtype)
+		}
+
+		owners[name][header.Rrtype] = append(owners[name][header.Rrtype], rr)
+	}
+
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+
+	recs := make(map[string]*Record, len(owners))
+	for name, rrsets := range owners {
+		record := &Record{}
+
+		for _, rtype := range order[name] {
+			rrs := rrsets[rtype]
+			entries, err := FromRRs(rrs)
+			if err != nil {
+				return nil, fmt.Errorf("error converting records of '%s': %w", rrs[0].Header().Name, err)
+			}
+
+			for _, rr := range rrs {
+				if rtype == dns.TypeSOA {
+					break
+				}
+
+				ttl := int(rr.Header().Ttl)
+				if record.TTL == nil || ttl < *record.TTL {
+					record.TTL = &ttl
+				}
+			}
+
+			record.Records = append(record.Records, entries...)
+		}
+
+		if record.TTL == nil {
+			ttl := int(rrsets[dns.TypeSOA][0].Header().Ttl)
+			record.TTL = &ttl
+		}
+
+		recs[name] = record
+	}
+
+	return recs, nil
+}
+
+// RenderZoneFile writes the records as RFC 1035 master file for origin.
+// Entries that can't be expressed as resource records (e.g. ALIAS or CONSUL_SERVICE)
+// are written as comments, so they aren't lost silently.
+func RenderZoneFile(writer io.Writer, origin string, recs map[string]*Record) error {
+	origin = dns.Fqdn(origin)
+
+	names := make([]string, 0, len(recs))
+	for name := range recs {
+		names = append(names, name)
+	}
+
+	// The apex comes first, so the SOA record starts the zone
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == "@" || names[j] == "@" {
+			return names[i] == "@" && names[j] != "@"
+		}
+		return names[i] < names[j]
+	})
+
+	if _, err := fmt.Fprintf(writer, "$ORIGIN %s\n", origin); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		record := recs[name]
+		owner := GetAbsoluteName(name, origin)
+
+		rrs, err := ToRRs(owner, record)
+		if err != nil {
+			return err
+		}
+
+		for _, rr := range rrs {
+			if _, err := fmt.Fprintln(writer, rr.String()); err != nil {
+				return err
+			}
+		}
+
+		for _, rec := range record.Records {
+			if IsConvertibleType(rec.Type) {
+				continue
+			}
+
+			if _, err := fmt.Fprintf(writer, "; %s %s %s\n", owner, rec.Type, compactJSON(rec.Value)); err != nil {
+				return err
+			}
+		}
+
+		for view := range record.Views {
+			if _, err := fmt.Fprintf(writer, "; %s has separate records for view '%s'\n", owner, view); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetRelativeName returns the name relative to origin, '@' for the origin itself.
+func GetRelativeName(name, origin string) (string, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	origin = strings.ToLower(dns.Fqdn(origin))
+
+	if name == origin {
+		return "@", nil
+	}
+
+	if !dns.IsSubDomain(origin, name) {
+		return "", fmt.Errorf("name '%s' is outside of zone '%s'", name, origin)
+	}
+
+	return strings.TrimSuffix(name, "."+origin), nil
+}
+
+// GetAbsoluteName returns the fully qualified name of a name relative to origin.
+func GetAbsoluteName(name, origin string) string {
+	if name == "@" {
+		return dns.Fqdn(origin)
+	}
+
+	return dns.Fqdn(name + "." + strings.TrimSuffix(dns.Fqdn(origin), "."))
+}
+
+// IsConvertibleType returns true if entries of the type can be converted into resource records.
+func IsConvertibleType(rtype string) bool {
+	switch rtype {
+	case "A", "AAAA", "CNAME", "NS", "MX", "SRV", "TXT", "CAA", "TLSA", "SSHFP", "DS", "SVCB", "HTTPS", "PTR", "SOA":
+		return true
+	}
+
+	return false
+}
+
+func compactJSON(value json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return string(value)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,294 @@
+package consulkv
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+)
+
+const (
+	responseCacheMaxEntries   = 10000
+	responseCacheWaitTime     = 5 * time.Minute
+	responseCacheRetryBackoff = 5 * time.Second
+)
+
+// ResponseCache keeps the answers created from the records of the configured zones.
+// Entries don't expire; they are dropped as soon as a blocking query on the prefix
+// of a zone they were created from returns a new index.
+// With 'zone_mirror', the mirror reports these changes instead of a separate watch.
+type ResponseCache struct {
+	consul     *ConsulConfig
+	watch      bool
+	mu         sync.RWMutex
+	entries    map[responseCacheKey]*cachedResponse
+	zones      map[string]*cachedZone
+	generation uint64
+}
+
+type responseCacheKey struct {
+	zone  string
+	name  string
+	qtype uint16
+	view  string
+}
+
+type cachedResponse struct {
+	msg   *dns.Msg
+	zones []string
+}
+
+type cachedZone struct {
+	loaded bool
+	cancel context.CancelFunc
+}
+
+// responseDeps collects the zones an answer was created from while a request is handled.
+type responseDeps struct {
+	generation  uint64
+	zones       map[string]bool
+	uncacheable bool
+}
+
+type responseDepsKey struct{}
+
+func CreateResponseCache(consul *ConsulConfig, watch bool) *ResponseCache {
+	return &ResponseCache{
+		consul:  consul,
+		watch:   watch,
+		entries: make(map[responseCacheKey]*cachedResponse),
+		zones:   make(map[string]*cachedZone),
+	}
+}
+
+// Track returns a context that collects the zones the answer of the request depends on.
+func (cache *ResponseCache) Track(ctx context.Context) context.Context {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	return context.WithValue(ctx, responseDepsKey{}, &responseDeps{
+		generation: cache.generation,
+		zones:      make(map[string]bool),
+	})
+}
+
+// TrackResponseZone records that the answer of the request depends on the zone.
+func TrackResponseZone(ctx context.Context, zone string) {
+	if deps, ok := ctx.Value(responseDepsKey{}).(*responseDeps); ok {
+		deps.zones[zone] = true
+	}
+}
+
+// MarkUncacheable prevents the answer of the request from being cached,
+// e.g. because it contains data that isn't stored within the zones.
+func MarkUncacheable(ctx context.Context) {
+	if deps, ok := ctx.Value(responseDepsKey{}).(*responseDeps); ok {
+		deps.uncacheable = true
+	}
+}
+
+// Get returns a reply to r built from the cached answer, or nil if there is none.
+func (cache *ResponseCache) Get(ctx context.Context, zname, rname string, qtype uint16, r *dns.Msg, size int) *dns.Msg {
+	key := responseCacheKey{zone: zname, name: rname, qtype: qtype, view: GetView(ctx)}
+
+	cache.mu.RLock()
+	entry, exists := cache.entries[key]
+	cache.mu.RUnlock()
+
+	if !exists {
+		IncrementMetricsResponseCacheMissesTotal(zname)
+		return nil
+	}
+
+	IncrementMetricsResponseCacheHitsTotal(zname)
+
+	msg := PrepareResponseRcode(r, entry.msg.Rcode, false)
+	qname := msg.Question[0].Name
+
+	msg.Answer = copyResponseSection(entry.msg.Answer, qname)
+	msg.Ns = copyResponseSection(entry.msg.Ns, qname)
+	msg.Extra = copyResponseSection(entry.msg.Extra, qname)
+
+	// The cached answer may have been created for a client with a larger buffer
+	for len(msg.Extra) > 0 && msg.Len() > size {
+		msg.Extra = msg.Extra[:len(msg.Extra)-1]
+	}
+
+	return msg
+}
+
+// Set caches the answer, unless the zones it was created from have changed
+// since the request was received or haven't been watched yet.
+func (cache *ResponseCache) Set(ctx context.Context, zname, rname string, qtype uint16, msg *dns.Msg) {
+	deps, ok := ctx.Value(responseDepsKey{}).(*responseDeps)
+	if !ok || deps.uncacheable {
+		return
+	}
+
+	key := responseCacheKey{zone: zname, name: rname, qtype: qtype, view: GetView(ctx)}
+	zones := []string{zname}
+	for zone := range deps.zones {
+		if zone != zname {
+			zones = append(zones, zone)
+		}
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if deps.generation != cache.generation {
+		return
+	}
+
+	for _, zone := range zones {
+		if cached, exists := cache.zones[zone]; !exists || !cached.loaded {
+			return
+		}
+	}
+
+	if _, exists := cache.entries[key]; !exists && len(cache.entries) >= responseCacheMaxEntries {
+		for k := range cache.entries {
+			delete(cache.entries, k)
+			break
+		}
+	}
+
+	cache.entries[key] = &cachedResponse{
+		msg:   msg.Copy(),
+		zones: zones,
+	}
+}
+
+// InvalidateZone drops every answer that was created from the zone.
+func (cache *ResponseCache) InvalidateZone(zone string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.generation++
+	if cached, exists := cache.zones[zone]; exists {
+		cached.loaded = true
+	}
+
+	dropped := 0
+	for key, entry := range cache.entries {
+		for _, z := range entry.zones {
+			if z == zone {
+				delete(cache.entries, key)
+				dropped++
+				break
+			}
+		}
+	}
+
+	logging.Log.Debugf("Dropped %d cached responses for zone '%s'", dropped, zone)
+}
+
+// Flush drops every cached answer, e.g. after the config has been updated.
+func (cache *ResponseCache) Flush() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.generation++
+	cache.entries = make(map[responseCacheKey]*cachedResponse)
+}
+
+// SyncZones starts watching zones that are new in the list and
+// stops watching zones that have been removed from it.
+func (cache *ResponseCache) SyncZones(zones []string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	wanted := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		wanted[zone] = true
+
+		if _, exists := cache.zones[zone]; exists {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cache.zones[zone] = &cachedZone{cancel: cancel}
+
+		if cache.watch {
+			go cache.watchZone(ctx, zone)
+		}
+	}
+
+	for zone, cached := range cache.zones {
+		if !wanted[zone] {
+			cached.cancel()
+			delete(cache.zones, zone)
+		}
+	}
+}
+
+func (cache *ResponseCache) Stop() error {
+	cache.SyncZones(nil)
+	return nil
+}
+
+func (cache *ResponseCache) watchZone(ctx context.Context, zone string) {
+	prefix := cache.consul.KVPrefix + "/zones/" + zone + "/"
+	var index uint64
+
+	for ctx.Err() == nil {
+		options := &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  responseCacheWaitTime,
+		}
+
+		_, meta, err := cache.consul.Backend.Keys(prefix, "", options.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logging.Log.Errorf("Error watching zone '%s' for cached responses: %v", zone, err)
+			IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(responseCacheRetryBackoff):
+			}
+			continue
+		}
+
+		if index != 0 && meta.LastIndex == index {
+			continue
+		}
+
+		// The index went backwards, e.g. after a snapshot restore; start over.
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+
+		index = meta.LastIndex
+		cache.InvalidateZone(zone)
+	}
+}
+
+// copyResponseSection copies the records of a cached section and replaces
+// owner names that only differ in case with the name of the question.
+func copyResponseSection(rrs []dns.RR, qname string) []dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+
+	copied := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if strings.EqualFold(rr.Header().Name, qname) {
+			rr.Header().Name = qname
+		}
+
+		copied = append(copied, rr)
+	}
+
+	return copied
+}
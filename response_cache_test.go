@@ -0,0 +1,195 @@
+package consulkv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+)
+
+func TestResponseCache(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"www": `{"records":[{"type":"A","value":["192.168.0.1"]}]}`,
+			"ext": `{"records":[{"type":"CNAME","value":"www.example.net"}]}`,
+			"org": `{"records":[{"type":"CNAME","value":"www.example.org"}]}`,
+		},
+		"example.org": {
+			"www": `{"records":[{"type":"A","value":["192.168.1.1"]}]}`,
+		},
+	})
+
+	plug.Config.Flattening = "full"
+	plug.Cache = CreateResponseCache(plug.Consul, false)
+	plug.Cache.SyncZones(plug.Config.Zones)
+	plug.Cache.InvalidateZone("example.com")
+	plug.Cache.InvalidateZone("example.org")
+
+	lookups := 0
+	plug.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		lookups++
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 120 IN A 203.0.113.1")
+		m.Answer = append(m.Answer, rr)
+
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+
+	serve := func(qname string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		plug.ServeDNS(context.Background(), rec, req)
+
+		return rec.Msg
+	}
+
+	update := func(zone, name, value string) {
+		updated := ConvertZoneRecords("dns/zones/"+zone+"/", api.KVPairs{{Key: "dns/zones/" + zone + "/" + name, Value: []byte(value)}})
+		for n, r := range plug.Mirror.zones[zone].Records {
+			if _, exists := updated[n]; !exists {
+				updated[n] = r
+			}
+		}
+
+		plug.Mirror.UpdateZone(zone, 2, updated)
+	}
+
+	serve("www.example.com.")
+	update("example.com", "www", `{"records":[{"type":"A","value":["192.168.0.2"]}]}`)
+
+	m := serve("WWW.example.com.")
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.168.0.1" {
+		tst.Fatalf("Expected cached answer before invalidation, got %v", m.Answer)
+	}
+
+	if m.Answer[0].Header().Name != "WWW.example.com." {
+		tst.Errorf("Expected cached answer to use the name of the question, got %s", m.Answer[0].Header().Name)
+	}
+
+	plug.Cache.InvalidateZone("example.com")
+
+	m = serve("www.example.com.")
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.168.0.2" {
+		tst.Errorf("Expected updated answer after invalidation, got %v", m.Answer)
+	}
+
+	// Answers following a CNAME into another zone depend on both zones
+	serve("org.example.com.")
+	update("example.org", "www", `{"records":[{"type":"A","value":["192.168.1.2"]}]}`)
+	plug.Cache.InvalidateZone("example.org")
+
+	m = serve("org.example.com.")
+	if len(m.Answer) != 2 || m.Answer[1].(*dns.A).A.String() != "192.168.1.2" {
+		tst.Errorf("Expected answer to be dropped with the target zone, got %v", m.Answer)
+	}
+
+	// Answers of the next plugin are never cached
+	serve("ext.example.com.")
+	serve("ext.example.com.")
+	if lookups != 2 {
+		tst.Errorf("Expected external CNAME to be resolved for every query, got %d lookups", lookups)
+	}
+}
+
+func TestResponseCacheNegative(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"@":   `{"ttl":3600,"records":[{"type":"SOA","value":{"mname":"ns.example.com","rname":"hostmaster.example.com","serial":1,"minimum":300}}]}`,
+			"www": `{"records":[{"type":"A","value":["192.168.0.1"]}]}`,
+		},
+	})
+
+	plug.Cache = CreateResponseCache(plug.Consul, false)
+	plug.Cache.SyncZones(plug.Config.Zones)
+	plug.Cache.InvalidateZone("example.com")
+
+	serve := func(qname string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, qtype)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		plug.ServeDNS(context.Background(), rec, req)
+
+		return rec.Msg
+	}
+
+	serve("new.example.com.", dns.TypeA)
+	serve("www.example.com.", dns.TypeAAAA)
+
+	updated := ConvertZoneRecords("dns/zones/example.com/", api.KVPairs{
+		{Key: "dns/zones/example.com/@", Value: []byte(`{"ttl":3600,"records":[{"type":"SOA","value":{"mname":"ns.example.com","rname":"hostmaster.example.com","serial":2,"minimum":300}}]}`)},
+		{Key: "dns/zones/example.com/www", Value: []byte(`{"records":[{"type":"A","value":["192.168.0.1"]},{"type":"AAAA","value":["fd00::1"]}]}`)},
+		{Key: "dns/zones/example.com/new", Value: []byte(`{"records":[{"type":"A","value":["192.168.0.2"]}]}`)},
+	})
+	plug.Mirror.UpdateZone("example.com", 2, updated)
+
+	m := serve("new.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError || len(m.Ns) != 1 || m.Ns[0].(*dns.SOA).Serial != 1 {
+		tst.Errorf("Expected cached NXDOMAIN before invalidation, got %v", m)
+	}
+
+	m = serve("www.example.com.", dns.TypeAAAA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || len(m.Ns) != 1 {
+		tst.Errorf("Expected cached NODATA before invalidation, got %v", m)
+	}
+
+	plug.Cache.InvalidateZone("example.com")
+
+	if m = serve("new.example.com.", dns.TypeA); len(m.Answer) != 1 {
+		tst.Errorf("Expected answer for new name after invalidation, got %v", m)
+	}
+
+	if m = serve("www.example.com.", dns.TypeAAAA); len(m.Answer) != 1 {
+		tst.Errorf("Expected answer for new type after invalidation, got %v", m)
+	}
+}
+
+func TestResponseCacheGeneration(tst *testing.T) {
+	cache := CreateResponseCache(&ConsulConfig{KVPrefix: "dns"}, false)
+	cache.SyncZones([]string{"example.com"})
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+
+	// The zone hasn't been loaded by the watch yet
+	ctx := cache.Track(context.Background())
+	cache.Set(ctx, "example.com", "www", dns.TypeA, msg)
+	if len(cache.entries) != 0 {
+		tst.Errorf("Expected no answer to be cached before the zone was watched")
+	}
+
+	cache.InvalidateZone("example.com")
+
+	// The zone changed while the request was handled
+	ctx = cache.Track(context.Background())
+	cache.InvalidateZone("example.com")
+	cache.Set(ctx, "example.com", "www", dns.TypeA, msg)
+	if len(cache.entries) != 0 {
+		tst.Errorf("Expected no answer to be cached after the zone changed")
+	}
+
+	ctx = cache.Track(context.Background())
+	cache.Set(ctx, "example.com", "www", dns.TypeA, msg)
+	if len(cache.entries) != 1 {
+		tst.Errorf("Expected answer to be cached")
+	}
+}
+
+func TestCreateQueryOptionsMaxAge(tst *testing.T) {
+	maxAge := 30
+	options := CreateQueryOptions(&ConsulKVCache{MaxAge: &maxAge})
+
+	if options.MaxAge != 30*time.Second {
+		tst.Errorf("Expected max_age to be read as seconds, got %v", options.MaxAge)
+	}
+}
@@ -0,0 +1,204 @@
+package consulkv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+const (
+	serviceCatalogWaitTime     = 5 * time.Minute
+	serviceCatalogRetryBackoff = 5 * time.Second
+	serviceCatalogIdleTimeout  = time.Hour
+)
+
+// ServiceCatalog caches the healthy instances of every service referenced by a
+// CONSUL_SERVICE record. Each service is kept current with a blocking query,
+// so instances that turn unhealthy drop out of DNS without waiting for a TTL.
+// Services that haven't been queried for an hour are no longer watched.
+type ServiceCatalog struct {
+	consul   *ConsulConfig
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	services map[string]*cachedService
+}
+
+type cachedService struct {
+	instances []records.ServiceInstance
+	lastUsed  time.Time
+}
+
+func CreateServiceCatalog(consul *ConsulConfig) *ServiceCatalog {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &ServiceCatalog{
+		consul:   consul,
+		ctx:      ctx,
+		cancel:   cancel,
+		services: make(map[string]*cachedService),
+	}
+}
+
+// GetInstances returns the cached instances of a service.
+// The first lookup of a service queries Consul directly and starts watching it.
+func (catalog *ServiceCatalog) GetInstances(service records.ConsulServiceRecord) ([]records.ServiceInstance, error) {
+	key := service.Key()
+
+	catalog.mu.Lock()
+	if cached, exists := catalog.services[key]; exists {
+		cached.lastUsed = time.Now()
+		instances := cached.instances
+		catalog.mu.Unlock()
+
+		return instances, nil
+	}
+	catalog.mu.Unlock()
+
+	instances, meta, err := catalog.consul.GetServiceInstancesFromConsul(service, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+
+	if _, exists := catalog.services[key]; !exists && catalog.ctx.Err() == nil {
+		catalog.services[key] = &cachedService{instances: instances, lastUsed: time.Now()}
+
+		go catalog.watchService(key, service, meta.LastIndex)
+		logging.Log.Infof("Started watching service '%s' in the Consul catalog", service.Service)
+	}
+
+	return instances, nil
+}
+
+func (catalog *ServiceCatalog) Stop() error {
+	catalog.cancel()
+	return nil
+}
+
+func (catalog *ServiceCatalog) UpdateService(key string, instances []records.ServiceInstance) bool {
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+
+	cached, exists := catalog.services[key]
+	if !exists {
+		return false
+	}
+
+	if time.Since(cached.lastUsed) > serviceCatalogIdleTimeout {
+		delete(catalog.services, key)
+		return false
+	}
+
+	cached.instances = instances
+	return true
+}
+
+func (catalog *ServiceCatalog) watchService(key string, service records.ConsulServiceRecord, index uint64) {
+	ctx := catalog.ctx
+
+	for ctx.Err() == nil {
+		options := &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  serviceCatalogWaitTime,
+		}
+
+		instances, meta, err := catalog.consul.GetServiceInstancesFromConsul(service, options.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logging.Log.Errorf("Error watching service '%s': %v", service.Service, err)
+			IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(serviceCatalogRetryBackoff):
+			}
+			continue
+		}
+
+		// The index went backwards, e.g. after a snapshot restore; start over.
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+
+		index = meta.LastIndex
+		if !catalog.UpdateService(key, instances) {
+			logging.Log.Infof("Stopped watching unused service '%s'", service.Service)
+			return
+		}
+
+		logging.Log.Debugf("Updated %d instances of service '%s' at index %d", len(instances), service.Service, index)
+	}
+}
+
+// AppendConsulServiceRecords adds the instances of the service to the message.
+// Returns an error if the instances couldn't be received from Consul.
+func (plug *ConsulKVPlugin) AppendConsulServiceRecords(msg *dns.Msg, qname string, qtype uint16, ttl int, value json.RawMessage) (bool, error) {
+	var service records.ConsulServiceRecord
+	if err := json.Unmarshal(value, &service); err != nil || service.Service == "" {
+		logging.Log.Errorf("Error parsing JSON for CONSUL_SERVICE record: %v", err)
+		IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+
+		return false, nil
+	}
+
+	instances, err := plug.Catalog.GetInstances(service)
+	if err != nil {
+		return false, fmt.Errorf("error receiving instances of service '%s': %w", service.Service, err)
+	}
+
+	return records.AppendConsulServiceRecords(msg, qname, qtype, ttl, instances), nil
+}
+
+// GetConsulServiceInstanceRecord returns the addresses of a single service instance,
+// if rname is the SRV target '<node>.<name>' of an instance of a CONSUL_SERVICE record at name.
+func (plug *ConsulKVPlugin) GetConsulServiceInstanceRecord(ctx context.Context, zname, rname string) (*records.Record, error) {
+	label, parent, found := strings.Cut(rname, ".")
+	if !found {
+		parent = "@"
+	}
+
+	record, err := plug.GetZoneRecord(ctx, zname, parent)
+	if err != nil || record == nil {
+		return nil, err
+	}
+
+	for _, rec := range record.Records {
+		if rec.Type != "CONSUL_SERVICE" {
+			continue
+		}
+
+		var service records.ConsulServiceRecord
+		if err := json.Unmarshal(rec.Value, &service); err != nil || service.Service == "" {
+			continue
+		}
+
+		instances, err := plug.Catalog.GetInstances(service)
+		if err != nil {
+			return nil, fmt.Errorf("error receiving instances of service '%s': %w", service.Service, err)
+		}
+
+		if instance := records.GetServiceInstanceRecord(label, record.TTL, instances); instance != nil {
+			// Instances are kept current by the service catalog instead
+			MarkUncacheable(ctx)
+			return instance, nil
+		}
+	}
+
+	return nil, nil
+}
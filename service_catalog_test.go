@@ -0,0 +1,147 @@
+package consulkv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+func TestConsulServiceRecords(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"api": `{"ttl":30,"records":[{"type":"CONSUL_SERVICE","value":{"service":"api","tag":"v2","passing_only":true}}]}`,
+		},
+	})
+
+	service := records.ConsulServiceRecord{Service: "api", Tag: "v2", PassingOnly: true}
+	plug.Catalog.services[service.Key()] = &cachedService{
+		lastUsed: time.Now(),
+		instances: []records.ServiceInstance{
+			{Node: "node1", Address: "10.0.0.1", Port: 8080},
+			{Node: "node2", Address: "10.0.0.2", Port: 8080},
+			{Node: "node2", Address: "10.0.0.2", Port: 8081},
+			{Node: "Node3.dc1", Address: "fd00::1", Port: 8443},
+		},
+	}
+
+	serve := func(qname string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, qtype)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+			tst.Fatalf("Unexpected error: %v", err)
+		}
+
+		return rec.Msg
+	}
+
+	tests := []struct {
+		qtype  uint16
+		answer int
+		extra  int
+	}{
+		{dns.TypeA, 2, 0},
+		{dns.TypeAAAA, 1, 0},
+		{dns.TypeSRV, 4, 3},
+		{dns.TypeTXT, 0, 0},
+	}
+
+	for _, tc := range tests {
+		tst.Run(dns.TypeToString[tc.qtype], func(t *testing.T) {
+			m := serve("api.example.com.", tc.qtype)
+			if len(m.Answer) != tc.answer || len(m.Extra) != tc.extra {
+				t.Errorf("Expected %d answers and %d additional records, got %v and %v", tc.answer, tc.extra, m.Answer, m.Extra)
+			}
+		})
+	}
+
+	// Every instance is its own target, with only its own address as glue
+	m := serve("api.example.com.", dns.TypeSRV)
+	targets := map[uint16]string{
+		8080: "",
+		8081: "node2.api.example.com.",
+		8443: "node3-dc1.api.example.com.",
+	}
+	for _, rr := range m.Answer {
+		srv := rr.(*dns.SRV)
+		if expected := targets[srv.Port]; expected != "" && srv.Target != expected {
+			tst.Errorf("Expected SRV target '%s' for port %d, got '%s'", expected, srv.Port, srv.Target)
+		}
+	}
+
+	glue := map[string]string{}
+	for _, rr := range m.Extra {
+		switch rr := rr.(type) {
+		case *dns.A:
+			glue[rr.Hdr.Name] = rr.A.String()
+		case *dns.AAAA:
+			glue[rr.Hdr.Name] = rr.AAAA.String()
+		}
+	}
+	if glue["node1.api.example.com."] != "10.0.0.1" || glue["node2.api.example.com."] != "10.0.0.2" || glue["node3-dc1.api.example.com."] != "fd00::1" {
+		tst.Errorf("Expected the address of every instance under its target, got %v", m.Extra)
+	}
+
+	// Targets resolve to the address of their instance
+	m = serve("node2.api.example.com.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		tst.Errorf("Expected address of 'node2' for its target, got %v", m.Answer)
+	}
+
+	m = serve("node3-dc1.api.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		tst.Errorf("Expected NODATA for A of an IPv6 only instance, got %v", m)
+	}
+
+	m = serve("node4.api.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError {
+		tst.Errorf("Expected NXDOMAIN for an unknown instance, got %v", m)
+	}
+
+	// Instances that can't be received from Consul are never answered with NODATA
+	plug.Catalog.services = map[string]*cachedService{}
+	for _, qname := range []string{"api.example.com.", "node1.api.example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := plug.ServeDNS(context.Background(), rec, req); err == nil || rec.Msg.Rcode != dns.RcodeServerFailure {
+			tst.Errorf("Expected SERVFAIL for '%s' without instances from Consul, got %v (%v)", qname, rec.Msg, err)
+		}
+	}
+}
+
+func TestServiceInstanceLabels(tst *testing.T) {
+	labels := records.GetServiceInstanceLabels([]records.ServiceInstance{
+		{Node: "node1", Address: "10.0.0.1", Port: 80},
+		{Node: "node1", Address: "10.0.0.1", Port: 81},
+		{Node: "node1", Address: "10.0.0.2", Port: 82},
+		{Address: "10.0.0.3", Port: 80},
+	})
+
+	expected := []string{"node1", "node1", "node1-82", "10-0-0-3"}
+	for i := range expected {
+		if labels[i] != expected[i] {
+			tst.Errorf("Expected labels %v, got %v", expected, labels)
+		}
+	}
+}
+
+func TestServiceCatalogIdle(tst *testing.T) {
+	catalog := CreateServiceCatalog(&ConsulConfig{})
+	catalog.services["api"] = &cachedService{lastUsed: time.Now().Add(-2 * serviceCatalogIdleTimeout)}
+
+	if catalog.UpdateService("api", nil) {
+		tst.Errorf("Expected idle service to be dropped")
+	}
+
+	if _, exists := catalog.services["api"]; exists {
+		tst.Errorf("Expected idle service to be removed from the catalog")
+	}
+}
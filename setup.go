@@ -1,6 +1,7 @@
 package consulkv
 
 import (
+	"context"
 	"time"
 
 	"github.com/coredns/caddy"
@@ -24,6 +25,13 @@ func setup(c *caddy.Controller) error {
 		prometheus.MustRegister(metricsQueryRequestsTotal)
 		prometheus.MustRegister(metricsQueryResponsesSuccessfulTotal)
 		prometheus.MustRegister(metricsQueryResponsesFailedTotal)
+		prometheus.MustRegister(metricsZoneMirrorUpdatesTotal)
+		prometheus.MustRegister(metricsLockdownActive)
+		prometheus.MustRegister(metricsLockdownResponsesTotal)
+		prometheus.MustRegister(metricsDynamicUpdatesTotal)
+		prometheus.MustRegister(metricsResponseCacheHitsTotal)
+		prometheus.MustRegister(metricsResponseCacheMissesTotal)
+		prometheus.MustRegister(metricsAdminRequestsTotal)
 		return nil
 	})
 
@@ -32,13 +40,67 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("consulkv", err)
 	}
 
+	c.OnShutdown(conf.Consul.Backend.Close)
+
+	if conf.Mirror != nil {
+		c.OnShutdown(conf.Mirror.Stop)
+	}
+
+	if conf.Cache != nil {
+		c.OnShutdown(conf.Cache.Stop)
+	}
+
+	c.OnShutdown(conf.Catalog.Stop)
+
+	if conf.Admin != nil {
+		c.OnStartup(conf.Admin.Start)
+		c.OnRestart(conf.Admin.Stop)
+		c.OnRestartFailed(conf.Admin.Start)
+		c.OnFinalShutdown(conf.Admin.Stop)
+	}
+
+	if conf.Webhook != nil {
+		c.OnStartup(conf.Webhook.Start)
+		c.OnRestart(conf.Webhook.Stop)
+		c.OnRestartFailed(conf.Webhook.Start)
+		c.OnFinalShutdown(conf.Webhook.Stop)
+	}
+
+	if conf.DNSSEC != nil && !conf.Consul.DisableWatch {
+		conf.DNSSEC.Start()
+		c.OnShutdown(conf.DNSSEC.Stop)
+	}
+
+	if conf.Discover != nil && !conf.Consul.DisableWatch {
+		conf.Discover.Start(conf.UpdateConsulConfig)
+		c.OnShutdown(conf.Discover.Stop)
+	}
+
 	if !conf.Consul.DisableWatch {
-		err = conf.Consul.WatchConsulConfig(conf.UpdateConsulConfig)
+		ctx, cancel := context.WithCancel(context.Background())
+		c.OnShutdown(func() error {
+			cancel()
+			return nil
+		})
+
+		err = conf.Consul.WatchConsulConfig(ctx, conf.UpdateConsulConfig)
 		if err != nil {
 			logging.Log.Warningf("Unable to create Consul watcher for '%s/config'", conf.Consul.KVPrefix)
 		}
 	}
 
+	// TSIG secrets have to be known by the server to verify signed updates
+	if len(conf.TSIGKeys) > 0 {
+		cfg := dnsserver.GetConfig(c)
+		if cfg.TsigSecret == nil {
+			cfg.TsigSecret = make(map[string]string)
+		}
+
+		for name, key := range conf.TSIGKeys {
+			cfg.TsigSecret[name] = key.Secret
+		}
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		conf.Next = next
 		return conf
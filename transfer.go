@@ -0,0 +1,224 @@
+package consulkv
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+// Transfer implements the transfer.Transferer interface.
+// The zone is streamed from '<kv_prefix>/zones/<zone>/' between two SOA records;
+// IXFR requests are answered with a single SOA if the serial is up-to-date and fall back to AXFR otherwise.
+func (plug ConsulKVPlugin) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	plug.cfgMu.RLock()
+	defer plug.cfgMu.RUnlock()
+
+	zname, rname := GetZoneAndRecord(plug.Config.Zones, zone)
+	if zname == "" || rname != "@" {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	return plug.TransferZone(zname, serial)
+}
+
+// TransferZone expects the caller to hold the config lock.
+func (plug ConsulKVPlugin) TransferZone(zname string, serial uint32) (<-chan []dns.RR, error) {
+	soa, err := plug.GetSOARecord(zname)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	records.AppendSOARecord(msg, zname, soa)
+	soaRR := msg.Answer[0]
+
+	ch := make(chan []dns.RR)
+
+	if serial != 0 && !isSerialLess(serial, soa.SERIAL) {
+		go func() {
+			ch <- []dns.RR{soaRR}
+			close(ch)
+		}()
+
+		return ch, nil
+	}
+
+	recs, err := plug.GetZoneRecords(zname)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(recs))
+	for name := range recs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == "@" || names[j] == "@" {
+			return names[i] == "@" && names[j] != "@"
+		}
+		return names[i] < names[j]
+	})
+
+	go func() {
+		defer close(ch)
+
+		ch <- []dns.RR{soaRR}
+
+		for _, name := range names {
+			owner := GetRecordOwnerName(zname, name)
+
+			rrs, err := records.ToRRs(owner, recs[name])
+			if err != nil {
+				logging.Log.Errorf("Error expanding record '%s' for transfer of zone '%s': %v", name, zname, err)
+				IncrementMetricsPluginErrorsTotal("JSON_UNMARSHAL")
+				continue
+			}
+
+			ttl := uint32(plug.Config.GetRecordTTL(zname, recs[name]))
+			rrset := make([]dns.RR, 0, len(rrs))
+			for _, rr := range rrs {
+				if rr.Header().Rrtype != dns.TypeSOA {
+					rr.Header().Ttl = ttl
+					rrset = append(rrset, rr)
+				}
+			}
+
+			if len(rrset) > 0 {
+				ch <- rrset
+			}
+		}
+
+		ch <- []dns.RR{soaRR}
+	}()
+
+	return ch, nil
+}
+
+// HandleTransfer answers AXFR and IXFR requests that reach this plugin directly,
+// i.e. without the 'transfer' plugin in front of it. Transfers are only allowed over TCP
+// and from the subnets configured with 'transfer_acl'.
+func (plug ConsulKVPlugin) HandleTransfer(state request.Request, zname string) (int, error) {
+	r := state.Req
+
+	if state.Proto() != "tcp" || !plug.IsTransferAllowed(state.IP()) {
+		logging.Log.Warningf("Refused transfer of zone '%s' to %s", zname, state.IP())
+		IncrementMetricsResponsesFailedTotal(zname, state.QType(), "REFUSED")
+
+		return HandleError(r, dns.RcodeRefused, state.W, nil)
+	}
+
+	var serial uint32
+	if state.QType() == dns.TypeIXFR {
+		if len(r.Ns) != 1 {
+			return HandleError(r, dns.RcodeFormatError, state.W, nil)
+		}
+
+		soa, ok := r.Ns[0].(*dns.SOA)
+		if !ok {
+			return HandleError(r, dns.RcodeFormatError, state.W, nil)
+		}
+		serial = soa.Serial
+	}
+
+	ch, err := plug.TransferZone(zname, serial)
+	if err != nil {
+		logging.Log.Errorf("Error preparing transfer of zone '%s': %v", zname, err)
+		IncrementMetricsResponsesFailedTotal(zname, state.QType(), "ERROR")
+
+		return HandleError(r, dns.RcodeServerFailure, state.W, err)
+	}
+
+	envelopes := make(chan *dns.Envelope)
+	errCh := make(chan error, 1)
+
+	go func() {
+		tr := new(dns.Transfer)
+		errCh <- tr.Out(state.W, r, envelopes)
+	}()
+
+	count := 0
+	batch := []dns.RR{}
+
+	for rrs := range ch {
+		batch = append(batch, rrs...)
+		if len(batch) <= 500 {
+			continue
+		}
+
+		select {
+		case envelopes <- &dns.Envelope{RR: batch}:
+			count += len(batch)
+			batch = []dns.RR{}
+
+		case err := <-errCh:
+			go func() {
+				for range ch {
+				}
+			}()
+
+			return plug.HandleTransferError(zname, err)
+		}
+	}
+
+	if len(batch) > 0 {
+		select {
+		case envelopes <- &dns.Envelope{RR: batch}:
+			count += len(batch)
+
+		case err := <-errCh:
+			return plug.HandleTransferError(zname, err)
+		}
+	}
+
+	close(envelopes)
+	if err := <-errCh; err != nil {
+		return plug.HandleTransferError(zname, err)
+	}
+
+	logging.Log.Infof("Outgoing transfer of %d records of zone '%s' to %s", count, zname, state.IP())
+	IncrementMetricsResponsesSuccessfulTotal(zname, state.QType())
+
+	return dns.RcodeSuccess, nil
+}
+
+func (plug ConsulKVPlugin) HandleTransferError(zname string, err error) (int, error) {
+	logging.Log.Errorf("Error writing transfer of zone '%s': %v", zname, err)
+	IncrementMetricsPluginErrorsTotal("WRITE_MSG")
+
+	return dns.RcodeServerFailure, err
+}
+
+func (plug ConsulKVPlugin) IsTransferAllowed(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, subnet := range plug.Consul.TransferACL {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetRecordOwnerName returns the fully qualified owner name of a record key within a zone.
+func GetRecordOwnerName(zname, rname string) string {
+	if rname == "@" {
+		return dns.Fqdn(zname)
+	}
+
+	return dns.Fqdn(rname + "." + strings.TrimSuffix(zname, "."))
+}
+
+// isSerialLess compares two SOA serials using serial number arithmetic (RFC 1982).
+func isSerialLess(a, b uint32) bool {
+	return a != b && int32(a-b) < 0
+}
@@ -0,0 +1,81 @@
+package consulkv
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func CollectTransfer(tst *testing.T, plug *ConsulKVPlugin, zone string, serial uint32) []dns.RR {
+	ch, err := plug.Transfer(zone, serial)
+	if err != nil {
+		tst.Fatalf("Expected transfer of zone '%s', but got: %v", zone, err)
+	}
+
+	rrs := []dns.RR{}
+	for batch := range ch {
+		rrs = append(rrs, batch...)
+	}
+
+	return rrs
+}
+
+func TestTransfer(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"@":   `{"ttl":3600,"records":[{"type":"SOA","value":{"mname":"ns.example.com","rname":"hostmaster.example.com","serial":2024081001,"minimum":300}},{"type":"NS","value":["ns.example.com"]}]}`,
+			"ns":  `{"ttl":3600,"records":[{"type":"A","value":["192.168.0.5"]}]}`,
+			"www": `{"ttl":3600,"records":[{"type":"A","value":["192.168.0.3"]},{"type":"AAAA","value":["fd00::3"]}]}`,
+		},
+	})
+
+	if _, err := plug.Transfer("example.org.", 0); err == nil {
+		tst.Errorf("Expected transfer of unknown zone to fail")
+	}
+
+	if _, err := plug.Transfer("www.example.com.", 0); err == nil {
+		tst.Errorf("Expected transfer of non-apex name to fail")
+	}
+
+	rrs := CollectTransfer(tst, plug, "example.com.", 0)
+	if len(rrs) != 6 {
+		tst.Fatalf("Expected 6 records in AXFR, but got %d: %v", len(rrs), rrs)
+	}
+
+	first, ok1 := rrs[0].(*dns.SOA)
+	last, ok2 := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok1 || !ok2 || first.Serial != 2024081001 || last.Serial != 2024081001 {
+		tst.Errorf("Expected AXFR to start and end with SOA, but got %v and %v", rrs[0], rrs[len(rrs)-1])
+	}
+
+	if rrs[1].Header().Rrtype != dns.TypeNS || rrs[1].Header().Name != "example.com." {
+		tst.Errorf("Expected apex NS directly after the SOA, but got %v", rrs[1])
+	}
+
+	if rrs := CollectTransfer(tst, plug, "example.com.", 2024081001); len(rrs) != 1 {
+		tst.Errorf("Expected single SOA for up-to-date IXFR, but got %v", rrs)
+	}
+
+	if rrs := CollectTransfer(tst, plug, "example.com.", 2024081000); len(rrs) != 6 {
+		tst.Errorf("Expected AXFR fallback for outdated IXFR, but got %v", rrs)
+	}
+}
+
+func TestIsSerialLess(tst *testing.T) {
+	tests := []struct {
+		a, b     uint32
+		expected bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{4294967295, 1, true},
+		{1, 4294967295, false},
+	}
+
+	for _, tc := range tests {
+		if isSerialLess(tc.a, tc.b) != tc.expected {
+			tst.Errorf("Expected isSerialLess(%d, %d) to be %v", tc.a, tc.b, tc.expected)
+		}
+	}
+}
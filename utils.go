@@ -1,6 +1,7 @@
 package consulkv
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"strings"
@@ -56,23 +57,40 @@ func PrepareResponseReply(request *dns.Msg, recursionAvailable bool) *dns.Msg {
 	return m
 }
 
+// GetZoneAndRecord returns the most specific configured zone containing qname and the
+// name of the record relative to that zone ('@' for the zone apex). Zones are matched on
+// label boundaries and case-insensitive; the record name is returned in lower case.
 func GetZoneAndRecord(zones []string, qname string) (string, string) {
-	qname = strings.TrimSuffix(dns.Fqdn(qname), ".")
+	qname = strings.ToLower(dns.Fqdn(qname))
 
+	match, origin := "", ""
 	for _, zone := range zones {
-		if strings.HasSuffix(qname, zone) {
-			record := strings.TrimSuffix(qname, zone)
-			record = strings.TrimSuffix(record, ".")
-
-			if record == "" {
-				record = "@"
-			}
+		z := strings.ToLower(dns.Fqdn(zone))
+		if !dns.IsSubDomain(z, qname) {
+			continue
+		}
 
-			return zone, record
+		if match == "" || dns.CountLabel(z) > dns.CountLabel(origin) {
+			match, origin = zone, z
 		}
 	}
 
-	return "", ""
+	if match == "" {
+		return "", ""
+	}
+
+	record := strings.TrimSuffix(strings.TrimSuffix(qname, origin), ".")
+	if record == "" {
+		record = "@"
+	}
+
+	return match, record
+}
+
+// GetZone returns the most specific configured zone containing qname.
+func GetZone(zones []string, qname string) string {
+	zone, _ := GetZoneAndRecord(zones, qname)
+	return zone
 }
 
 func GetDefaultSOA(zoneName string) *records.SOARecord {
@@ -87,6 +105,23 @@ func GetDefaultSOA(zoneName string) *records.SOARecord {
 	}
 }
 
+func GetSOAFromRecord(zoneName string, record *records.Record) (*records.SOARecord, error) {
+	if record != nil {
+		for _, rec := range record.Records {
+			if rec.Type == "SOA" {
+				var soa records.SOARecord
+				if err := json.Unmarshal(rec.Value, &soa); err != nil {
+					return nil, err
+				}
+
+				return &soa, nil
+			}
+		}
+	}
+
+	return GetDefaultSOA(zoneName), nil
+}
+
 func GetDefaultTTL(record *records.Record) int {
 	if record.TTL != nil {
 		return *record.TTL
@@ -0,0 +1,44 @@
+package consulkv
+
+import "testing"
+
+func TestGetZoneAndRecord(tst *testing.T) {
+	zones := []string{"example.com", "sub.example.com", "0.168.192.in-addr.arpa", "example.org."}
+
+	tests := []struct {
+		qname  string
+		zone   string
+		record string
+	}{
+		{"example.com.", "example.com", "@"},
+		{"www.example.com.", "example.com", "www"},
+		{"www.example.com", "example.com", "www"},
+		{"a.b.example.com.", "example.com", "a.b"},
+		{"WWW.Example.COM.", "example.com", "www"},
+		{"sub.example.com.", "sub.example.com", "@"},
+		{"www.sub.example.com.", "sub.example.com", "www"},
+		{"www.notsub.example.com.", "example.com", "www.notsub"},
+		{"badexample.com.", "", ""},
+		{"www.badexample.com.", "", ""},
+		{"com.", "", ""},
+		{"1.0.168.192.in-addr.arpa.", "0.168.192.in-addr.arpa", "1"},
+		{"10.168.192.in-addr.arpa.", "", ""},
+		{"www.example.org.", "example.org.", "www"},
+		{"example.org", "example.org.", "@"},
+	}
+
+	for _, tc := range tests {
+		tst.Run(tc.qname, func(t *testing.T) {
+			zone, record := GetZoneAndRecord(zones, tc.qname)
+			if zone != tc.zone || record != tc.record {
+				t.Errorf("Expected zone '%s' and record '%s', got '%s' and '%s'", tc.zone, tc.record, zone, record)
+			}
+		})
+	}
+
+	// The longest match wins regardless of the order of the configured zones
+	zone, record := GetZoneAndRecord([]string{"sub.example.com", "example.com"}, "www.sub.example.com.")
+	if zone != "sub.example.com" || record != "www" {
+		tst.Errorf("Expected zone 'sub.example.com' and record 'www', got '%s' and '%s'", zone, record)
+	}
+}
@@ -0,0 +1,152 @@
+package consulkv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// ViewConfig assigns a name to a list of client subnets.
+// Records can define separate entries for every view, which are served
+// to clients within these subnets instead of the default entries.
+type ViewConfig struct {
+	Name     string   `json:"name"`
+	Networks []string `json:"networks"`
+
+	subnets []*net.IPNet
+}
+
+func (view *ViewConfig) UnmarshalJSON(data []byte) error {
+	type viewConfig ViewConfig
+
+	var v viewConfig
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	if v.Name == "" {
+		return fmt.Errorf("view name can't be empty")
+	}
+
+	for _, network := range v.Networks {
+		_, subnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return fmt.Errorf("invalid network '%s' for view '%s': %w", network, v.Name, err)
+		}
+
+		v.subnets = append(v.subnets, subnet)
+	}
+
+	*view = ViewConfig(v)
+	return nil
+}
+
+func (view *ViewConfig) Contains(ip net.IP) bool {
+	for _, subnet := range view.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SelectView returns the name of the first view containing the address,
+// or an empty string for the default view.
+func (config *ConsulKVConfig) SelectView(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	for i := range config.Views {
+		if config.Views[i].Contains(ip) {
+			return config.Views[i].Name
+		}
+	}
+
+	return ""
+}
+
+// GetClientAddress returns the address from the EDNS Client Subnet option (RFC 7871)
+// and the option itself, if present and sent by one of the trusted resolvers,
+// and the address of the client otherwise.
+func GetClientAddress(state request.Request, trusted []*net.IPNet) (net.IP, *dns.EDNS0_SUBNET) {
+	ip := net.ParseIP(state.IP())
+
+	if opt := state.Req.IsEdns0(); opt != nil && isTrustedResolver(ip, trusted) {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				if subnet.SourceNetmask > 0 {
+					return subnet.Address, subnet
+				}
+
+				return ip, subnet
+			}
+		}
+	}
+
+	return ip, nil
+}
+
+func isTrustedResolver(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, subnet := range trusted {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientSubnetResponseWriter echoes the EDNS Client Subnet option of the request in the response.
+// The scope is the source prefix length if the answer may depend on the subnet, and 0 otherwise.
+type ClientSubnetResponseWriter struct {
+	dns.ResponseWriter
+	subnet *dns.EDNS0_SUBNET
+	scope  uint8
+}
+
+func (w *ClientSubnetResponseWriter) WriteMsg(res *dns.Msg) error {
+	// The message may be kept by the response cache, so the option is only added to a copy
+	res = res.Copy()
+
+	opt := res.IsEdns0()
+	if opt == nil {
+		res.SetEdns0(dns.MinMsgSize, false)
+		opt = res.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        w.subnet.Family,
+		SourceNetmask: w.subnet.SourceNetmask,
+		SourceScope:   w.scope,
+		Address:       w.subnet.Address,
+	})
+
+	return w.ResponseWriter.WriteMsg(res)
+}
+
+type viewContextKey struct{}
+
+// WithView stores the view selected for a request in its context.
+func WithView(ctx context.Context, view string) context.Context {
+	return context.WithValue(ctx, viewContextKey{}, view)
+}
+
+// GetView returns the view stored in the context, or an empty string for the default view.
+func GetView(ctx context.Context) string {
+	if view, ok := ctx.Value(viewContextKey{}).(string); ok {
+		return view
+	}
+
+	return ""
+}
@@ -0,0 +1,93 @@
+package consulkv
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestViews(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"www": `{"ttl":300,"records":[{"type":"A","value":["203.0.113.10"]}],"views":{"office":[{"type":"A","value":["10.0.0.10"]}]}}`,
+			"api": `{"ttl":300,"records":[{"type":"A","value":["203.0.113.20"]}]}`,
+		},
+	})
+
+	if err := json.Unmarshal([]byte(`[{"name":"office","networks":["10.0.0.0/8","fd00::/8"]}]`), &plug.Config.Views); err != nil {
+		tst.Fatalf("Unable to parse views: %v", err)
+	}
+
+	_, resolver, _ := net.ParseCIDR("198.51.100.0/24")
+	plug.Consul.ECSTrusted = []*net.IPNet{resolver}
+
+	tests := []struct {
+		name     string
+		qname    string
+		remoteIP string
+		subnet   string
+		expected string
+	}{
+		{"Default view", "www.example.com.", "198.51.100.1", "", "203.0.113.10"},
+		{"Office view", "www.example.com.", "10.1.2.3", "", "10.0.0.10"},
+		{"Office view from client subnet", "www.example.com.", "198.51.100.1", "10.20.0.0", "10.0.0.10"},
+		{"Client subnet from untrusted resolver", "www.example.com.", "192.0.2.1", "10.20.0.0", "203.0.113.10"},
+		{"Record without view", "api.example.com.", "10.1.2.3", "", "203.0.113.20"},
+	}
+
+	for _, tc := range tests {
+		tst.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qname, dns.TypeA)
+
+			if tc.subnet != "" {
+				req.SetEdns0(4096, false)
+				req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        1,
+					SourceNetmask: 16,
+					Address:       net.ParseIP(tc.subnet).To4(),
+				})
+			}
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.remoteIP})
+			if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != tc.expected {
+				t.Errorf("Expected answer %s, got %v", tc.expected, rec.Msg.Answer)
+			}
+
+			// The client subnet is only echoed if it has been used
+			var echoed *dns.EDNS0_SUBNET
+			if opt := rec.Msg.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+						echoed = subnet
+					}
+				}
+			}
+
+			trusted := tc.subnet != "" && resolver.Contains(net.ParseIP(tc.remoteIP))
+			if trusted != (echoed != nil) {
+				t.Errorf("Expected client subnet to be echoed: %v, got %v", trusted, echoed)
+			}
+			if echoed != nil && echoed.SourceScope != 16 {
+				t.Errorf("Expected scope 16 of client subnet, got %d", echoed.SourceScope)
+			}
+		})
+	}
+}
+
+func TestViewConfigInvalidNetwork(tst *testing.T) {
+	var views []ViewConfig
+	if err := json.Unmarshal([]byte(`[{"name":"office","networks":["10.0.0.0/33"]}]`), &views); err == nil {
+		tst.Errorf("Expected invalid network to be rejected")
+	}
+}
@@ -0,0 +1,148 @@
+package consulkv
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/coredns/coredns/plugin/pkg/fall"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+	"github.com/mwantia/coredns-consulkv-plugin/types"
+)
+
+// ZoneConfig overrides the global settings for a single zone.
+// Zones can be configured as plain names or as objects.
+type ZoneConfig struct {
+	Name        string               `json:"name"`
+	Flattening  types.FlatteningType `json:"flattening,omitempty"`
+	MinTTL      *int                 `json:"min_ttl,omitempty"`
+	MaxTTL      *int                 `json:"max_ttl,omitempty"`
+	DefaultTTL  *int                 `json:"default_ttl,omitempty"`
+	Fallthrough bool                 `json:"fallthrough,omitempty"`
+}
+
+func (zone *ZoneConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*zone = ZoneConfig{Name: name}
+		return nil
+	}
+
+	type zoneConfig ZoneConfig
+
+	var z zoneConfig
+	if err := json.Unmarshal(data, &z); err != nil {
+		return err
+	}
+
+	if z.Name == "" {
+		return fmt.Errorf("zone name can't be empty")
+	}
+
+	if z.MinTTL != nil && z.MaxTTL != nil && *z.MinTTL > *z.MaxTTL {
+		return fmt.Errorf("min_ttl of zone '%s' can't be larger than max_ttl", z.Name)
+	}
+
+	*zone = ZoneConfig(z)
+	return nil
+}
+
+// FallthroughConfig is either 'true' to pass missing names of all zones to the next plugin,
+// or a list of zones to do so for.
+type FallthroughConfig struct {
+	fall.F
+}
+
+func (f *FallthroughConfig) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*f = FallthroughConfig{}
+		if enabled {
+			f.SetZonesFromArgs(nil)
+		}
+		return nil
+	}
+
+	var zones []string
+	if err := json.Unmarshal(data, &zones); err != nil {
+		return fmt.Errorf("fallthrough must be a boolean or a list of zones: %w", err)
+	}
+
+	*f = FallthroughConfig{}
+	f.SetZonesFromArgs(zones)
+	return nil
+}
+
+// IsFallthrough returns true if queries for missing names within the zone are passed to the next plugin,
+// either from the zone config, the 'fallthrough' key or the 'fallthrough' Corefile directive.
+func (plug ConsulKVPlugin) IsFallthrough(zname, qname string) bool {
+	if plug.Config.GetZoneConfig(zname).Fallthrough || plug.Config.Fallthrough.Through(qname) {
+		return true
+	}
+
+	return plug.Consul != nil && plug.Consul.Fall.Through(qname)
+}
+
+// UnmarshalJSON accepts zones as plain names or as objects with per-zone overrides.
+// Zones keeps the list of names, ZoneConfigs the overrides of every zone.
+func (config *ConsulKVConfig) UnmarshalJSON(data []byte) error {
+	type consulKVConfig ConsulKVConfig
+
+	var c struct {
+		consulKVConfig
+		Zones []ZoneConfig `json:"zones"`
+	}
+
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+
+	*config = ConsulKVConfig(c.consulKVConfig)
+	config.Zones = make([]string, 0, len(c.Zones))
+	config.ZoneConfigs = make(map[string]*ZoneConfig, len(c.Zones))
+
+	for i := range c.Zones {
+		zone := c.Zones[i]
+		config.Zones = append(config.Zones, zone.Name)
+		config.ZoneConfigs[zone.Name] = &zone
+	}
+
+	return nil
+}
+
+// GetZoneConfig returns the overrides of the zone, or an empty config if there are none.
+func (config *ConsulKVConfig) GetZoneConfig(zname string) *ZoneConfig {
+	if zone, exists := config.ZoneConfigs[zname]; exists {
+		return zone
+	}
+
+	return &ZoneConfig{Name: zname}
+}
+
+// GetFlattening returns the CNAME flattening mode of the zone.
+func (config *ConsulKVConfig) GetFlattening(zname string) types.FlatteningType {
+	if flattening := config.GetZoneConfig(zname).Flattening; flattening != "" {
+		return flattening
+	}
+
+	return config.Flattening
+}
+
+// GetRecordTTL returns the TTL of a record within the zone, using the default TTL
+// of the zone for records without a TTL and keeping it within the bounds of the zone.
+func (config *ConsulKVConfig) GetRecordTTL(zname string, record *records.Record) int {
+	zone := config.GetZoneConfig(zname)
+
+	ttl := GetDefaultTTL(record)
+	if record.TTL == nil && zone.DefaultTTL != nil {
+		ttl = *zone.DefaultTTL
+	}
+
+	if zone.MinTTL != nil && ttl < *zone.MinTTL {
+		ttl = *zone.MinTTL
+	}
+	if zone.MaxTTL != nil && ttl > *zone.MaxTTL {
+		ttl = *zone.MaxTTL
+	}
+
+	return ttl
+}
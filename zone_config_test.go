@@ -0,0 +1,126 @@
+package consulkv
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+	"github.com/mwantia/coredns-consulkv-plugin/types"
+)
+
+func TestZoneConfig(tst *testing.T) {
+	var config ConsulKVConfig
+	err := json.Unmarshal([]byte(`{
+		"flattening": "full",
+		"zones": [
+			"example.com",
+			{"name":"example.org","flattening":"none","min_ttl":60,"max_ttl":86400,"default_ttl":300,"fallthrough":true}
+		]
+	}`), &config)
+	if err != nil {
+		tst.Fatalf("Unable to parse config: %v", err)
+	}
+
+	if len(config.Zones) != 2 || config.Zones[0] != "example.com" || config.Zones[1] != "example.org" {
+		tst.Fatalf("Expected zones 'example.com' and 'example.org', got %v", config.Zones)
+	}
+
+	if config.GetFlattening("example.com") != types.Flattening_Full || config.GetFlattening("example.org") != types.Flattening_None {
+		tst.Errorf("Expected per-zone flattening to override the global setting")
+	}
+
+	ttl := func(value int) *records.Record {
+		return &records.Record{TTL: &value}
+	}
+
+	tests := []struct {
+		zone     string
+		record   *records.Record
+		expected int
+	}{
+		{"example.com", &records.Record{}, 3600},
+		{"example.com", ttl(5), 5},
+		{"example.org", &records.Record{}, 300},
+		{"example.org", ttl(5), 60},
+		{"example.org", ttl(604800), 86400},
+		{"example.org", ttl(3600), 3600},
+	}
+
+	for _, tc := range tests {
+		if got := config.GetRecordTTL(tc.zone, tc.record); got != tc.expected {
+			tst.Errorf("Expected TTL %d for zone '%s', got %d", tc.expected, tc.zone, got)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`{"zones":[{"name":"example.com","min_ttl":600,"max_ttl":60}]}`), &config); err == nil {
+		tst.Errorf("Expected min_ttl larger than max_ttl to be rejected")
+	}
+}
+
+func TestZoneConfigFallthrough(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {"www": `{"records":[{"type":"A","value":["192.168.0.1"]}]}`},
+		"example.org": {"www": `{"records":[{"type":"A","value":["192.168.0.2"]}]}`},
+	})
+	plug.Config.ZoneConfigs = map[string]*ZoneConfig{
+		"example.org": {Name: "example.org", Fallthrough: true},
+	}
+
+	passed := 0
+	plug.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		passed++
+		return dns.RcodeSuccess, nil
+	})
+
+	for qname, expected := range map[string]int{"missing.example.com.": 0, "missing.example.org.": 1} {
+		passed = 0
+
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		plug.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+
+		if passed != expected {
+			tst.Errorf("Expected '%s' to be passed to the next plugin %d times, got %d", qname, expected, passed)
+		}
+	}
+}
+
+func TestFallthroughConfig(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		fallthrough example.org
+	}`)
+
+	consul := &ConsulConfig{}
+	if err := LoadConsulConfig(c, consul); err != nil {
+		tst.Fatalf("Unable to parse Corefile: %v", err)
+	}
+
+	var config ConsulKVConfig
+	if err := json.Unmarshal([]byte(`{"zones":["example.com","example.org","example.net"],"fallthrough":["example.net"]}`), &config); err != nil {
+		tst.Fatalf("Unable to parse config: %v", err)
+	}
+
+	plug := ConsulKVPlugin{Consul: consul, Config: &config}
+
+	tests := map[string]bool{
+		"www.example.com.": false,
+		"www.example.org.": true,
+		"www.example.net.": true,
+	}
+
+	for qname, expected := range tests {
+		if got := plug.IsFallthrough(GetZone(config.Zones, qname), qname); got != expected {
+			tst.Errorf("Expected fallthrough %v for '%s', got %v", expected, qname, got)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`{"fallthrough":true}`), &config); err != nil || !config.Fallthrough.Through("www.example.com.") {
+		tst.Errorf("Expected 'fallthrough: true' to apply to all zones (error: %v)", err)
+	}
+}
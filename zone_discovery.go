@@ -0,0 +1,173 @@
+package consulkv
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+)
+
+const (
+	zoneDiscoveryWaitTime     = 5 * time.Minute
+	zoneDiscoveryRetryBackoff = 5 * time.Second
+)
+
+// ZoneDiscovery serves every zone that has a key folder below '<kv_prefix>/zones/',
+// in addition to the zones listed in the Consul config.
+// The prefix is watched with a blocking query, so zones can be added and removed at runtime.
+type ZoneDiscovery struct {
+	consul *ConsulConfig
+	mu     sync.Mutex
+	zones  []string
+	config *ConsulKVConfig
+	cancel context.CancelFunc
+}
+
+func CreateZoneDiscovery(consul *ConsulConfig) *ZoneDiscovery {
+	return &ZoneDiscovery{
+		consul: consul,
+	}
+}
+
+// MergeConfig stores cfg as the latest config loaded from Consul and returns a copy
+// that also contains every discovered zone not already listed in it.
+func (discovery *ZoneDiscovery) MergeConfig(cfg *ConsulKVConfig) *ConsulKVConfig {
+	discovery.mu.Lock()
+	defer discovery.mu.Unlock()
+
+	if cfg == nil {
+		cfg = &ConsulKVConfig{}
+	}
+	discovery.config = cfg
+
+	return mergeDiscoveredZones(cfg, discovery.zones)
+}
+
+// UpdateZones replaces the discovered zones and returns the latest config loaded from Consul,
+// which has to be passed through MergeConfig again before it is served.
+// The second return value is false if the list of zones didn't change.
+func (discovery *ZoneDiscovery) UpdateZones(zones []string) (*ConsulKVConfig, bool) {
+	discovery.mu.Lock()
+	defer discovery.mu.Unlock()
+
+	if isSameZoneList(discovery.zones, zones) {
+		return nil, false
+	}
+
+	discovery.zones = zones
+	if discovery.config == nil {
+		discovery.config = &ConsulKVConfig{}
+	}
+
+	return discovery.config, true
+}
+
+// Start watches '<kv_prefix>/zones/' and calls f with the config loaded from Consul
+// every time a zone folder is added or removed. f is expected to merge the discovered zones
+// with MergeConfig, so the config is never stored with zones that may be removed later.
+func (discovery *ZoneDiscovery) Start(f cfgHandler) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	discovery.mu.Lock()
+	discovery.cancel = cancel
+	discovery.mu.Unlock()
+
+	go discovery.watchZones(ctx, f)
+	logging.Log.Infof("Started discovering zones from '%s/zones/'", discovery.consul.KVPrefix)
+}
+
+func (discovery *ZoneDiscovery) Stop() error {
+	discovery.mu.Lock()
+	defer discovery.mu.Unlock()
+
+	if discovery.cancel != nil {
+		discovery.cancel()
+		discovery.cancel = nil
+	}
+
+	return nil
+}
+
+func (discovery *ZoneDiscovery) watchZones(ctx context.Context, f cfgHandler) {
+	var index uint64
+
+	for ctx.Err() == nil {
+		options := &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  zoneDiscoveryWaitTime,
+		}
+
+		zones, meta, err := discovery.consul.ListZonesFromConsul(options.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logging.Log.Errorf("Error discovering zones from '%s/zones/': %v", discovery.consul.KVPrefix, err)
+			IncrementMetricsPluginErrorsTotal("CONSUL_GET")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(zoneDiscoveryRetryBackoff):
+			}
+			continue
+		}
+
+		if index != 0 && meta.LastIndex == index {
+			continue
+		}
+
+		// The index went backwards, e.g. after a snapshot restore; start over.
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+
+		index = meta.LastIndex
+		if cfg, changed := discovery.UpdateZones(zones); changed {
+			f(cfg)
+			logging.Log.Infof("Discovered %d zones from '%s/zones/'", len(zones), discovery.consul.KVPrefix)
+		}
+	}
+}
+
+func mergeDiscoveredZones(cfg *ConsulKVConfig, zones []string) *ConsulKVConfig {
+	merged := *cfg
+	merged.Zones = append([]string{}, cfg.Zones...)
+
+	for _, zone := range zones {
+		if !hasZone(merged.Zones, zone) {
+			merged.Zones = append(merged.Zones, zone)
+		}
+	}
+
+	return &merged
+}
+
+func hasZone(zones []string, zone string) bool {
+	for _, z := range zones {
+		if strings.EqualFold(strings.TrimSuffix(z, "."), strings.TrimSuffix(zone, ".")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSameZoneList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,154 @@
+package consulkv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+)
+
+func TestConvertZoneFolders(tst *testing.T) {
+	zones := ConvertZoneFolders("dns/zones/", []string{
+		"dns/zones/example.org/",
+		"dns/zones/example.com/",
+		"dns/zones/stray-key",
+		"dns/zones/",
+	})
+
+	if len(zones) != 2 || zones[0] != "example.com" || zones[1] != "example.org" {
+		tst.Errorf("Expected zones 'example.com' and 'example.org', got %v", zones)
+	}
+}
+
+func TestZoneDiscoveryMerge(tst *testing.T) {
+	discovery := CreateZoneDiscovery(&ConsulConfig{KVPrefix: "dns"})
+
+	if _, changed := discovery.UpdateZones([]string{"example.com", "example.org"}); !changed {
+		tst.Fatalf("Expected the first list of zones to be a change")
+	}
+
+	if _, changed := discovery.UpdateZones([]string{"example.com", "example.org"}); changed {
+		tst.Errorf("Expected the same list of zones not to be a change")
+	}
+
+	cfg := &ConsulKVConfig{Zones: []string{"Example.com.", "example.net"}}
+	merged := discovery.MergeConfig(cfg)
+
+	expected := []string{"Example.com.", "example.net", "example.org"}
+	if len(merged.Zones) != len(expected) {
+		tst.Fatalf("Expected zones %v, got %v", expected, merged.Zones)
+	}
+
+	for i := range expected {
+		if merged.Zones[i] != expected[i] {
+			tst.Errorf("Expected zones %v, got %v", expected, merged.Zones)
+		}
+	}
+
+	if len(cfg.Zones) != 2 {
+		tst.Errorf("Expected the config loaded from Consul to stay unchanged, got %v", cfg.Zones)
+	}
+
+	// A missing config key still serves the discovered zones
+	merged = discovery.MergeConfig(nil)
+	if len(merged.Zones) != 2 {
+		tst.Errorf("Expected discovered zones without config, got %v", merged.Zones)
+	}
+}
+
+func TestZoneDiscoveryUpdate(tst *testing.T) {
+	plug := CreateMirroredTestPlugin(tst, map[string]map[string]string{
+		"example.com": {
+			"@": `{"records":[{"type":"SOA","value":{"mname":"ns1.example.com","rname":"admin.example.com","serial":1,"refresh":3600,"retry":600,"expire":86400,"minimum":300}}]}`,
+		},
+		"example.org": {
+			"@":   `{"records":[{"type":"SOA","value":{"mname":"ns1.example.org","rname":"admin.example.org","serial":1,"refresh":3600,"retry":600,"expire":86400,"minimum":300}}]}`,
+			"www": `{"records":[{"type":"A","value":["192.0.2.1"]}]}`,
+		},
+	})
+
+	plug.Discover = CreateZoneDiscovery(plug.Consul)
+	plug.Discover.UpdateZones([]string{"example.org"})
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+
+	if len(plug.Config.Zones) != 2 {
+		tst.Fatalf("Expected discovered zone to be served, got %v", plug.Config.Zones)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := plug.ServeDNS(context.Background(), rec, req); err != nil {
+		tst.Fatalf("Unexpected error: %v", err)
+	}
+
+	if rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 1 {
+		tst.Errorf("Expected an answer from the discovered zone, got %v", rec.Msg)
+	}
+
+	cfg, changed := plug.Discover.UpdateZones(nil)
+	if !changed {
+		tst.Fatalf("Expected removing all zones to be a change")
+	}
+
+	plug.UpdateConsulConfig(cfg)
+	if len(plug.Config.Zones) != 1 || plug.Config.Zones[0] != "example.com" {
+		tst.Errorf("Expected only the configured zone to remain, got %v", plug.Config.Zones)
+	}
+
+	if plug.Mirror.IsLoaded("example.org") {
+		tst.Errorf("Expected removed zone to no longer be mirrored")
+	}
+}
+
+func TestZoneDiscoveryWatch(tst *testing.T) {
+	c := caddy.NewTestController("dns", `consulkv {
+		backend memory
+		auto_zones
+	}`)
+
+	plug, err := CreatePlugin(c)
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/www", []byte(`{"records":[{"type":"A","value":["192.0.2.1"]}]}`))
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+
+	updates := make(chan []string, 4)
+	plug.Discover.Start(func(cfg *ConsulKVConfig) {
+		plug.UpdateConsulConfig(cfg)
+		updates <- plug.Config.Zones
+	})
+	defer plug.Discover.Stop()
+
+	expect := func(expected ...string) {
+		for {
+			select {
+			case zones := <-updates:
+				if isSameZoneList(zones, expected) {
+					return
+				}
+			case <-time.After(time.Second):
+				tst.Fatalf("Expected zones %v, got %v", expected, plug.Config.Zones)
+			}
+		}
+	}
+
+	expect("example.com")
+
+	backend.Put("dns/zones/example.org/www", []byte(`{"records":[{"type":"A","value":["192.0.2.2"]}]}`))
+	expect("example.com", "example.org")
+
+	// Removed zone folders are no longer served, while the configured zones are kept
+	backend.Txn(api.KVTxnOps{{Verb: api.KVDelete, Key: "dns/zones/example.org/www"}})
+	backend.Txn(api.KVTxnOps{{Verb: api.KVDelete, Key: "dns/zones/example.com/www"}})
+	expect("example.com")
+}
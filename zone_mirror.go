@@ -0,0 +1,209 @@
+package consulkv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mwantia/coredns-consulkv-plugin/logging"
+	"github.com/mwantia/coredns-consulkv-plugin/records"
+)
+
+const (
+	zoneMirrorWaitTime     = 5 * time.Minute
+	zoneMirrorRetryBackoff = 5 * time.Second
+)
+
+// ZoneMirror keeps an in-memory copy of every configured zone prefix.
+// Each zone is kept current with a blocking query on its ModifyIndex,
+// so lookups never have to wait for a round trip to Consul.
+type ZoneMirror struct {
+	consul   *ConsulConfig
+	mu       sync.RWMutex
+	zones    map[string]*MirroredZone
+	onUpdate func(zone string)
+}
+
+type MirroredZone struct {
+	Name    string
+	Index   uint64
+	Records map[string]*records.Record
+	// Invalid contains the names of records that couldn't be converted,
+	// so they are answered with an error instead of as missing names.
+	Invalid map[string]bool
+	loaded  bool
+	cancel  context.CancelFunc
+}
+
+func CreateZoneMirror(consul *ConsulConfig) *ZoneMirror {
+	return &ZoneMirror{
+		consul: consul,
+		zones:  make(map[string]*MirroredZone),
+	}
+}
+
+// SyncZones starts mirroring zones that are new in the list and
+// stops mirroring zones that have been removed from it.
+func (mirror *ZoneMirror) SyncZones(zones []string) {
+	mirror.mu.Lock()
+	defer mirror.mu.Unlock()
+
+	wanted := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		wanted[zone] = true
+
+		if _, exists := mirror.zones[zone]; exists {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		mirrored := &MirroredZone{
+			Name:   zone,
+			cancel: cancel,
+		}
+		mirror.zones[zone] = mirrored
+
+		go mirror.watchZone(ctx, zone)
+		logging.Log.Infof("Started mirroring zone '%s' from '%s/zones/%s/'", zone, mirror.consul.KVPrefix, zone)
+	}
+
+	for zone, mirrored := range mirror.zones {
+		if !wanted[zone] {
+			mirrored.cancel()
+			delete(mirror.zones, zone)
+
+			logging.Log.Infof("Stopped mirroring zone '%s'", zone)
+		}
+	}
+}
+
+// GetZoneRecord returns the mirrored record for the zone and name.
+// The second return value is false if the zone has not been loaded yet,
+// in which case the caller has to fall back to Consul.
+func (mirror *ZoneMirror) GetZoneRecord(zone, name string) (*records.Record, bool) {
+	mirror.mu.RLock()
+	defer mirror.mu.RUnlock()
+
+	mirrored, exists := mirror.zones[zone]
+	if !exists || !mirrored.loaded {
+		return nil, false
+	}
+
+	return mirrored.Records[name], true
+}
+
+// IsInvalidRecord returns true if the record for the zone and name exists, but couldn't be converted.
+func (mirror *ZoneMirror) IsInvalidRecord(zone, name string) bool {
+	mirror.mu.RLock()
+	defer mirror.mu.RUnlock()
+
+	mirrored, exists := mirror.zones[zone]
+	return exists && mirrored.Invalid[name]
+}
+
+// GetZoneRecords returns all mirrored records of the zone.
+// The returned map is replaced on every update and must not be modified.
+func (mirror *ZoneMirror) GetZoneRecords(zone string) (map[string]*records.Record, bool) {
+	mirror.mu.RLock()
+	defer mirror.mu.RUnlock()
+
+	mirrored, exists := mirror.zones[zone]
+	if !exists || !mirrored.loaded {
+		return nil, false
+	}
+
+	return mirrored.Records, true
+}
+
+// OnUpdate registers fn to be called every time a zone has been reloaded.
+// It has to be called before any zone is mirrored.
+func (mirror *ZoneMirror) OnUpdate(fn func(zone string)) {
+	mirror.onUpdate = fn
+}
+
+func (mirror *ZoneMirror) IsLoaded(zone string) bool {
+	mirror.mu.RLock()
+	defer mirror.mu.RUnlock()
+
+	mirrored, exists := mirror.zones[zone]
+	return exists && mirrored.loaded
+}
+
+func (mirror *ZoneMirror) Stop() error {
+	mirror.SyncZones(nil)
+	return nil
+}
+
+func (mirror *ZoneMirror) UpdateZone(zone string, index uint64, recs map[string]*records.Record) bool {
+	return mirror.updateZone(zone, index, recs, nil)
+}
+
+func (mirror *ZoneMirror) updateZone(zone string, index uint64, recs map[string]*records.Record, invalid []string) bool {
+	mirror.mu.Lock()
+	defer mirror.mu.Unlock()
+
+	mirrored, exists := mirror.zones[zone]
+	if !exists {
+		return false
+	}
+
+	mirrored.Index = index
+	mirrored.Records = recs
+	mirrored.Invalid = make(map[string]bool, len(invalid))
+	mirrored.loaded = true
+
+	for _, name := range invalid {
+		mirrored.Invalid[name] = true
+	}
+
+	return true
+}
+
+func (mirror *ZoneMirror) watchZone(ctx context.Context, zone string) {
+	var index uint64
+
+	for ctx.Err() == nil {
+		options := &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  zoneMirrorWaitTime,
+		}
+
+		recs, invalid, meta, err := mirror.consul.listZoneRecords(zone, options.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logging.Log.Errorf("Error mirroring zone '%s': %v", zone, err)
+			IncrementMetricsZoneMirrorUpdatesTotal(zone, "ERROR")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(zoneMirrorRetryBackoff):
+			}
+			continue
+		}
+
+		if index != 0 && meta.LastIndex == index {
+			continue
+		}
+
+		// The index went backwards, e.g. after a snapshot restore; start over.
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+
+		index = meta.LastIndex
+		if mirror.updateZone(zone, index, recs, invalid) {
+			logging.Log.Debugf("Mirrored %d records for zone '%s' at index %d", len(recs), zone, index)
+			IncrementMetricsZoneMirrorUpdatesTotal(zone, "NOERROR")
+
+			if mirror.onUpdate != nil {
+				mirror.onUpdate(zone)
+			}
+		}
+	}
+}
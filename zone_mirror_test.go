@@ -0,0 +1,107 @@
+package consulkv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/hashicorp/consul/api"
+	"github.com/miekg/dns"
+)
+
+func TestConvertZoneRecords(tst *testing.T) {
+	pairs := api.KVPairs{
+		{Key: "dns/zones/example.com/", Value: nil},
+		{Key: "dns/zones/example.com/@", Value: []byte(`{"ttl":60,"records":[{"type":"NS","value":["ns.example.com"]}]}`)},
+		{Key: "dns/zones/example.com/www", Value: []byte(`{"records":[{"type":"A","value":["192.168.0.3"]}]}`)},
+		{Key: "dns/zones/example.com/broken", Value: []byte(`{"records":`)},
+		{Key: "dns/zones/example.com/nested/key", Value: []byte(`{"records":[]}`)},
+	}
+
+	recs := ConvertZoneRecords("dns/zones/example.com/", pairs)
+
+	if len(recs) != 2 {
+		tst.Fatalf("Expected 2 records, but got %d", len(recs))
+	}
+
+	if apex := recs["@"]; apex == nil || apex.TTL == nil || *apex.TTL != 60 {
+		tst.Errorf("Expected apex record with ttl 60, but got %+v", apex)
+	}
+
+	if www := recs["www"]; www == nil || len(www.Records) != 1 || www.Records[0].Type != "A" {
+		tst.Errorf("Expected A record for 'www', but got %+v", www)
+	}
+}
+
+func TestZoneMirrorLookup(tst *testing.T) {
+	mirror := CreateZoneMirror(&ConsulConfig{KVPrefix: "dns"})
+	mirror.zones["example.com"] = &MirroredZone{Name: "example.com", cancel: func() {}}
+
+	if _, loaded := mirror.GetZoneRecord("example.com", "www"); loaded {
+		tst.Errorf("Expected zone to be reported as not loaded before the first update")
+	}
+
+	recs := ConvertZoneRecords("dns/zones/example.com/", api.KVPairs{
+		{Key: "dns/zones/example.com/www", Value: []byte(`{"records":[{"type":"A","value":["192.168.0.3"]}]}`)},
+	})
+
+	if !mirror.UpdateZone("example.com", 42, recs) {
+		tst.Fatalf("Expected update of mirrored zone to succeed")
+	}
+
+	if record, loaded := mirror.GetZoneRecord("example.com", "www"); !loaded || record == nil {
+		tst.Errorf("Expected mirrored record for 'www', but got %+v (loaded: %v)", record, loaded)
+	}
+
+	if record, loaded := mirror.GetZoneRecord("example.com", "missing"); !loaded || record != nil {
+		tst.Errorf("Expected authoritative miss for 'missing', but got %+v (loaded: %v)", record, loaded)
+	}
+
+	if mirror.UpdateZone("example.org", 1, recs) {
+		tst.Errorf("Expected update of unknown zone to be ignored")
+	}
+}
+
+func TestZoneMirrorInvalidRecord(tst *testing.T) {
+	plug, err := CreatePlugin(caddy.NewTestController("dns", "consulkv {\n backend memory\n zone_mirror\n}"))
+	if err != nil {
+		tst.Fatalf("Unable to create plugin: %v", err)
+	}
+	defer plug.Mirror.Stop()
+
+	backend := plug.Consul.Backend.(*MemoryBackend)
+	backend.Put("dns/zones/example.com/www", []byte(`{"records":[{"type":"A","value":["192.168.0.1"]}]}`))
+	backend.Put("dns/zones/example.com/broken", []byte(`{"records":[`))
+	plug.UpdateConsulConfig(&ConsulKVConfig{Zones: []string{"example.com"}})
+
+	deadline := time.Now().Add(time.Second)
+	for !plug.Mirror.IsLoaded("example.com") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	serve := func(qname string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		plug.ServeDNS(context.Background(), rec, req)
+
+		return rec.Msg
+	}
+
+	if m := serve("www.example.com."); len(m.Answer) != 1 {
+		tst.Errorf("Expected answer for valid record, got %v", m)
+	}
+
+	// Like without the mirror, the invalid record isn't answered as a missing name
+	if m := serve("broken.example.com."); m.Rcode != dns.RcodeServerFailure {
+		tst.Errorf("Expected SERVFAIL for invalid record, got %v", m)
+	}
+
+	if !plug.Mirror.IsInvalidRecord("example.com", "broken") || plug.Mirror.IsInvalidRecord("example.com", "www") {
+		tst.Errorf("Expected only 'broken' to be reported as invalid")
+	}
+}